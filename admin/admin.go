@@ -0,0 +1,285 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/txn2/n2proxy/rweng"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// TokenCfg is a named bearer token. The name identifies the actor in
+// the audit log.
+type TokenCfg struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+}
+
+// Cfg defines the admin API configuration
+type Cfg struct {
+	// Listen is host:port or unix:/path/to/socket
+	Listen   string     `yaml:"listen"`
+	Tokens   []TokenCfg `yaml:"tokens"`
+	AuditLog string     `yaml:"auditLog"`
+}
+
+// StatsFunc returns runtime statistics to be rendered as JSON
+type StatsFunc func() interface{}
+
+// Server is the admin HTTP API
+type Server struct {
+	cfg    Cfg
+	eng    *rweng.Eng
+	engs   map[string]*rweng.Eng // listener rule sets by listener name
+	stats  StatsFunc
+	mux    *http.ServeMux
+	public *http.ServeMux
+	srv    *http.Server
+	audit  *zap.Logger
+	logger *zap.Logger
+}
+
+type ctxKey struct{}
+
+// NewServer instances an admin API server
+func NewServer(cfg Cfg, eng *rweng.Eng, stats StatsFunc, logger *zap.Logger) (*Server, error) {
+	if cfg.Listen == "" {
+		return nil, fmt.Errorf("admin listen address required")
+	}
+
+	if len(cfg.Tokens) == 0 {
+		return nil, fmt.Errorf("admin requires at least one token")
+	}
+
+	for _, t := range cfg.Tokens {
+		if t.Name == "" || len(t.Token) < 16 {
+			return nil, fmt.Errorf("admin tokens require a name and at least 16 characters")
+		}
+	}
+
+	audit := logger.Named("audit")
+	if cfg.AuditLog != "" {
+		zapCfg := zap.NewProductionConfig()
+		zapCfg.DisableCaller = true
+		zapCfg.DisableStacktrace = true
+		zapCfg.OutputPaths = []string{cfg.AuditLog}
+
+		auditLogger, err := zapCfg.Build()
+		if err != nil {
+			return nil, err
+		}
+		audit = auditLogger.Named("audit")
+	}
+
+	s := &Server{
+		cfg:    cfg,
+		eng:    eng,
+		engs:   make(map[string]*rweng.Eng, 0),
+		stats:  stats,
+		mux:    http.NewServeMux(),
+		public: http.NewServeMux(),
+		audit:  audit,
+		logger: logger,
+	}
+
+	s.mux.HandleFunc("GET /api/rules", s.listRules)
+	s.mux.HandleFunc("POST /api/rules", s.addRule)
+	s.mux.HandleFunc("DELETE /api/rules/{id}", s.removeRule)
+	s.mux.HandleFunc("POST /api/rules/{id}/enable", s.enableRule)
+	s.mux.HandleFunc("POST /api/rules/{id}/disable", s.disableRule)
+	s.mux.HandleFunc("GET /api/blocks", s.listBlocks)
+	s.mux.HandleFunc("POST /api/blocks", s.addBlock)
+	s.mux.HandleFunc("DELETE /api/blocks", s.clearBlocks)
+	s.mux.HandleFunc("DELETE /api/blocks/{ip}", s.removeBlock)
+	s.mux.HandleFunc("POST /api/reload", s.reload)
+	s.mux.HandleFunc("GET /api/stats", s.getStats)
+	s.mux.HandleFunc("GET /api/exclusions", s.listExclusions)
+	s.mux.HandleFunc("POST /api/exclusions", s.addExclusion)
+	s.mux.HandleFunc("DELETE /api/exclusions/{id}", s.removeExclusion)
+
+	// everything under /api/ requires a token
+	root := http.NewServeMux()
+	root.Handle("/api/", s.authenticate(s.mux))
+	root.Handle("/", s.public)
+
+	s.srv = &http.Server{
+		Handler:           root,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return s, nil
+}
+
+// AddRules registers the rule set of a listener, selected in rule and
+// exclusion requests with ?listener=name and reloaded with the others
+func (s *Server) AddRules(listener string, eng *rweng.Eng) error {
+	if listener == "" {
+		return fmt.Errorf("admin rule sets require a listener name")
+	}
+	if _, ok := s.engs[listener]; ok {
+		return fmt.Errorf("duplicate admin rule set for listener %s", listener)
+	}
+
+	s.engs[listener] = eng
+	return nil
+}
+
+// engine returns the rule set selected by the listener query parameter,
+// the --cfg rule set without one
+func (s *Server) engine(r *http.Request) (*rweng.Eng, string, error) {
+	listener := r.URL.Query().Get("listener")
+	if listener == "" {
+		return s.eng, "", nil
+	}
+
+	eng, ok := s.engs[listener]
+	if !ok {
+		return nil, listener, fmt.Errorf("no rule set for listener %s", listener)
+	}
+	return eng, listener, nil
+}
+
+// Handle registers an additional authenticated handler, pattern must
+// be under /api/
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// HandlePublic registers a handler that does not require a token, for
+// static assets only
+func (s *Server) HandlePublic(pattern string, handler http.Handler) {
+	s.public.Handle(pattern, handler)
+}
+
+// Audit records a change made through the admin listener
+func (s *Server) Audit(r *http.Request, action string, target string, err error) {
+	fields := []zap.Field{
+		zap.String("Actor", Actor(r)),
+		zap.String("RemoteAddr", r.RemoteAddr),
+		zap.String("Action", action),
+		zap.String("Target", target),
+	}
+
+	if err != nil {
+		s.audit.Warn("Admin change failed: "+err.Error(), fields...)
+		return
+	}
+
+	s.audit.Info("Admin change", fields...)
+}
+
+// Actor returns the token name that authenticated the request
+func Actor(r *http.Request) string {
+	actor, _ := r.Context().Value(ctxKey{}).(string)
+	return actor
+}
+
+// authenticate requires a configured bearer token
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the scheme is required, a bare token is refused
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		for _, t := range s.cfg.Tokens {
+			if ok && subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+				ctx := context.WithValue(r.Context(), ctxKey{}, t.Name)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+		}
+
+		s.audit.Warn("Admin authentication failed", zap.String("RemoteAddr", r.RemoteAddr), zap.String("Path", r.URL.Path))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="n2proxy"`)
+		WriteError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+	})
+}
+
+// listen opens a tcp or unix socket listener
+func (s *Server) listen() (net.Listener, error) {
+	if !strings.HasPrefix(s.cfg.Listen, "unix:") {
+		return net.Listen("tcp", s.cfg.Listen)
+	}
+
+	path := strings.TrimPrefix(s.cfg.Listen, "unix:")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// ListenAndServe serves the admin API until Shutdown is called
+func (s *Server) ListenAndServe() error {
+	ln, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Starting admin API on " + s.cfg.Listen)
+
+	err = s.srv.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// Shutdown gracefully stops the admin API
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// WriteJSON renders v as a JSON response
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// WriteError renders an error as a JSON response
+func WriteError(w http.ResponseWriter, status int, err error) {
+	WriteJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// ReadJSON decodes a JSON request body into v
+func ReadJSON(r *http.Request, v interface{}) error {
+	return json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20)).Decode(v)
+}
+
+// NewServerFromYaml loads an admin API server from yaml data
+func NewServerFromYaml(filename string, eng *rweng.Eng, stats StatsFunc, logger *zap.Logger) (*Server, error) {
+
+	ymlData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Cfg{}
+
+	err = yaml.Unmarshal([]byte(ymlData), &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewServer(cfg, eng, stats, logger)
+}
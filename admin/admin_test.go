@@ -0,0 +1,317 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/txn2/n2proxy/rweng"
+	"go.uber.org/zap"
+)
+
+const testToken = "0123456789abcdef"
+
+// testRules writes a rule configuration and loads it
+func testRules(t *testing.T, filename string, yml string) *rweng.Eng {
+	t.Helper()
+
+	if err := ioutil.WriteFile(filename, []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	eng, err := rweng.NewEngFromYml(filename, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return eng
+}
+
+// testServer serves an admin API for eng
+func testServer(t *testing.T, cfg Cfg, eng *rweng.Eng) (*Server, *httptest.Server) {
+	t.Helper()
+
+	if cfg.Listen == "" {
+		cfg.Listen = "127.0.0.1:0"
+	}
+	if len(cfg.Tokens) == 0 {
+		cfg.Tokens = []TokenCfg{{Name: "ops", Token: testToken}}
+	}
+
+	s, err := NewServer(cfg, eng, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.srv.Handler)
+	t.Cleanup(ts.Close)
+
+	return s, ts
+}
+
+// call sends an authenticated request and decodes the JSON response
+// into v unless v is nil
+func call(t *testing.T, ts *httptest.Server, method string, path string, body interface{}, v interface{}) int {
+	t.Helper()
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, &reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func TestListenerRules(t *testing.T) {
+	dir := t.TempDir()
+
+	main := testRules(t, filepath.Join(dir, "cfg.yml"), "urlBan:\n  - onload\n  - autofocus\n")
+	edgeFile := filepath.Join(dir, "edge.yml")
+	edge := testRules(t, edgeFile, "urlBan:\n  - wp-admin\n")
+
+	s, ts := testServer(t, Cfg{}, main)
+	if err := s.AddRules("edge", edge); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddRules("edge", edge); err == nil {
+		t.Error("AddRules accepted a duplicate listener")
+	}
+
+	var rules []struct {
+		ID string `json:"id"`
+	}
+	if status := call(t, ts, "GET", "/api/rules", nil, &rules); status != http.StatusOK || len(rules) != 2 {
+		t.Errorf("--cfg rules: status %d, %d rules, want 200 and 2", status, len(rules))
+	}
+	if status := call(t, ts, "GET", "/api/rules?listener=edge", nil, &rules); status != http.StatusOK || len(rules) != 1 {
+		t.Errorf("edge rules: status %d, %d rules, want 200 and 1", status, len(rules))
+	}
+	if status := call(t, ts, "GET", "/api/rules?listener=missing", nil, nil); status != http.StatusNotFound {
+		t.Errorf("unknown listener: status %d, want 404", status)
+	}
+
+	// a temporary rule only changes the selected rule set
+	req := TempRuleReq{Group: "urlBan", Pattern: "xmlrpc", TTL: "1h"}
+	if status := call(t, ts, "POST", "/api/rules?listener=edge", req, nil); status != http.StatusCreated {
+		t.Fatalf("adding an edge rule: status %d", status)
+	}
+	if n := len(main.Rules()); n != 2 {
+		t.Errorf("--cfg has %d rules, want 2", n)
+	}
+	if n := len(edge.Rules()); n != 2 {
+		t.Errorf("edge has %d rules, want 2", n)
+	}
+
+	// reload covers every rule set
+	if err := ioutil.WriteFile(edgeFile, []byte("urlBan:\n  - wp-admin\n  - wp-login\n  - phpmyadmin\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var counts struct {
+		Rules     int            `json:"rules"`
+		Listeners map[string]int `json:"listeners"`
+	}
+	if status := call(t, ts, "POST", "/api/reload", nil, &counts); status != http.StatusOK {
+		t.Fatalf("reload: status %d", status)
+	}
+	// the temporary rule outlives the reload
+	if counts.Rules != 2 || counts.Listeners["edge"] != 4 {
+		t.Errorf("reload counts %+v, want 2 and edge 4", counts)
+	}
+
+	// an invalid listener rule set fails the reload
+	if err := ioutil.WriteFile(edgeFile, []byte("urlBan:\n  - \"(\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if status := call(t, ts, "POST", "/api/reload", nil, nil); status != http.StatusUnprocessableEntity {
+		t.Errorf("invalid edge rules: status %d, want 422", status)
+	}
+}
+
+func TestNewServerTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []TokenCfg
+		valid  bool
+	}{
+		{name: "no tokens"},
+		{name: "no name", tokens: []TokenCfg{{Token: testToken}}},
+		{name: "15 characters", tokens: []TokenCfg{{Name: "ops", Token: testToken[:15]}}},
+		{name: "16 characters", tokens: []TokenCfg{{Name: "ops", Token: testToken}}, valid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewServer(Cfg{Listen: "127.0.0.1:0", Tokens: tt.tokens}, nil, nil, zap.NewNop())
+			if (err == nil) != tt.valid {
+				t.Errorf("NewServer() = %v, want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	_, ts := testServer(t, Cfg{}, testRules(t, filepath.Join(dir, "cfg.yml"), "urlBan:\n  - onload\n"))
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{name: "bearer token", header: "Bearer " + testToken, status: http.StatusOK},
+		{name: "no header", status: http.StatusUnauthorized},
+		{name: "bare token", header: testToken, status: http.StatusUnauthorized},
+		{name: "other scheme", header: "Basic " + testToken, status: http.StatusUnauthorized},
+		{name: "wrong token", header: "Bearer fedcba9876543210", status: http.StatusUnauthorized},
+		{name: "token prefix", header: "Bearer " + testToken[:8], status: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", ts.URL+"/api/rules", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			challenge := resp.Header.Get("WWW-Authenticate")
+			if tt.status == http.StatusUnauthorized && !strings.HasPrefix(challenge, "Bearer ") {
+				t.Errorf("WWW-Authenticate %q, want a Bearer challenge", challenge)
+			}
+		})
+	}
+}
+
+func TestRuleChanges(t *testing.T) {
+	dir := t.TempDir()
+	auditLog := filepath.Join(dir, "audit.log")
+	eng := testRules(t, filepath.Join(dir, "cfg.yml"), "urlBan:\n  - onload\n")
+	_, ts := testServer(t, Cfg{AuditLog: auditLog}, eng)
+
+	// rejected requests change nothing
+	if status := call(t, ts, "POST", "/api/rules", TempRuleReq{Group: "urlBan", Pattern: "x", TTL: "0s"}, nil); status != http.StatusBadRequest {
+		t.Errorf("zero ttl: status %d, want 400", status)
+	}
+	if status := call(t, ts, "POST", "/api/rules", TempRuleReq{Group: "nope", Pattern: "x", TTL: "1h"}, nil); status != http.StatusBadRequest {
+		t.Errorf("unknown group: status %d, want 400", status)
+	}
+
+	var rule struct {
+		ID        string `json:"id"`
+		Temporary bool   `json:"temporary"`
+	}
+	if status := call(t, ts, "POST", "/api/rules", TempRuleReq{Group: "urlBan", Pattern: "wp-admin", TTL: "1h"}, &rule); status != http.StatusCreated {
+		t.Fatalf("add: status %d, want 201", status)
+	}
+	if !rule.Temporary || len(eng.Rules()) != 2 {
+		t.Fatalf("added %+v, %d rules", rule, len(eng.Rules()))
+	}
+
+	if status := call(t, ts, "POST", "/api/rules/"+rule.ID+"/disable", nil, nil); status != http.StatusNoContent {
+		t.Errorf("disable: status %d, want 204", status)
+	}
+	if status := call(t, ts, "POST", "/api/rules/"+rule.ID+"/enable", nil, nil); status != http.StatusNoContent {
+		t.Errorf("enable: status %d, want 204", status)
+	}
+	if status := call(t, ts, "DELETE", "/api/rules/"+rule.ID, nil, nil); status != http.StatusNoContent {
+		t.Errorf("remove: status %d, want 204", status)
+	}
+	if status := call(t, ts, "DELETE", "/api/rules/"+rule.ID, nil, nil); status != http.StatusNotFound {
+		t.Errorf("remove again: status %d, want 404", status)
+	}
+	if status := call(t, ts, "POST", "/api/reload", nil, nil); status != http.StatusOK {
+		t.Errorf("reload: status %d, want 200", status)
+	}
+	if n := len(eng.Rules()); n != 1 {
+		t.Errorf("%d rules, want 1", n)
+	}
+
+	// every change, including failed ones, is audited with the token
+	// name; malformed requests are refused before any change
+	data, err := ioutil.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		action string
+		failed bool
+	}{
+		{"rule.add", true}, {"rule.add", false},
+		{"rule.disable", false}, {"rule.enable", false},
+		{"rule.remove", false}, {"rule.remove", true},
+		{"config.reload", false},
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("%d audit entries, want %d:\n%s", len(lines), len(want), data)
+	}
+	for i, line := range lines {
+		var entry struct {
+			Level  string `json:"level"`
+			Actor  string `json:"Actor"`
+			Action string `json:"Action"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		failed := entry.Level == "warn"
+		if entry.Actor != "ops" || entry.Action != want[i].action || failed != want[i].failed {
+			t.Errorf("audit entry %d: %s", i, line)
+		}
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	dir := t.TempDir()
+	eng := testRules(t, filepath.Join(dir, "cfg.yml"), "urlBan:\n  - onload\n")
+	_, ts := testServer(t, Cfg{}, eng)
+
+	if status := call(t, ts, "POST", "/api/blocks", BlockReq{IP: "not an ip"}, nil); status != http.StatusBadRequest {
+		t.Errorf("invalid ip: status %d, want 400", status)
+	}
+	if status := call(t, ts, "POST", "/api/blocks", BlockReq{IP: "203.0.113.7", Reason: "scanner", TTL: "1h"}, nil); status != http.StatusCreated {
+		t.Fatalf("add: status %d, want 201", status)
+	}
+	if _, ok := eng.Blocks().Blocked("203.0.113.7"); !ok {
+		t.Error("client not blocked")
+	}
+	if status := call(t, ts, "DELETE", "/api/blocks/203.0.113.7", nil, nil); status != http.StatusNoContent {
+		t.Errorf("remove: status %d, want 204", status)
+	}
+	if status := call(t, ts, "DELETE", "/api/blocks/203.0.113.7", nil, nil); status != http.StatusNotFound {
+		t.Errorf("remove again: status %d, want 404", status)
+	}
+}
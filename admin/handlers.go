@@ -0,0 +1,298 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/txn2/n2proxy/rweng"
+)
+
+// TempRuleReq adds a temporary rule
+type TempRuleReq struct {
+	Group   string `json:"group"`
+	Pattern string `json:"pattern"`
+	TTL     string `json:"ttl"`
+}
+
+// BlockReq blocks a client IP
+type BlockReq struct {
+	IP     string `json:"ip"`
+	Reason string `json:"reason"`
+	TTL    string `json:"ttl"`
+}
+
+func (s *Server) listRules(w http.ResponseWriter, r *http.Request) {
+	eng, _, err := s.engine(r)
+	if err != nil {
+		WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, eng.Rules())
+}
+
+func (s *Server) addRule(w http.ResponseWriter, r *http.Request) {
+	eng, listener, err := s.engine(r)
+	if err != nil {
+		WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	req := TempRuleReq{}
+	if err := ReadJSON(r, &req); err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 {
+		WriteError(w, http.StatusBadRequest, fmt.Errorf("ttl must be a positive duration such as 30m"))
+		return
+	}
+
+	rule, err := eng.AddTempRule(req.Group, req.Pattern, ttl)
+	s.Audit(r, "rule.add", ruleTarget(listener, req.Group+": "+req.Pattern+" ttl "+ttl.String()), err)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	WriteJSON(w, http.StatusCreated, rule)
+}
+
+func (s *Server) removeRule(w http.ResponseWriter, r *http.Request) {
+	eng, listener, err := s.engine(r)
+	if err != nil {
+		WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	id := r.PathValue("id")
+
+	err = eng.RemoveTempRule(id)
+	s.Audit(r, "rule.remove", ruleTarget(listener, id), err)
+	if err != nil {
+		WriteError(w, ruleStatus(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) setRuleEnabled(w http.ResponseWriter, r *http.Request, enabled bool) {
+	eng, listener, err := s.engine(r)
+	if err != nil {
+		WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	id := r.PathValue("id")
+
+	action := "rule.disable"
+	if enabled {
+		action = "rule.enable"
+	}
+
+	err = eng.SetRuleEnabled(id, enabled)
+	s.Audit(r, action, ruleTarget(listener, id), err)
+	if err != nil {
+		WriteError(w, ruleStatus(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) enableRule(w http.ResponseWriter, r *http.Request) {
+	s.setRuleEnabled(w, r, true)
+}
+
+func (s *Server) disableRule(w http.ResponseWriter, r *http.Request) {
+	s.setRuleEnabled(w, r, false)
+}
+
+func (s *Server) listBlocks(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusOK, s.eng.Blocks().List())
+}
+
+func (s *Server) addBlock(w http.ResponseWriter, r *http.Request) {
+	req := BlockReq{}
+	if err := ReadJSON(r, &req); err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl < 0 {
+			WriteError(w, http.StatusBadRequest, fmt.Errorf("ttl must be a duration such as 1h"))
+			return
+		}
+	}
+
+	blk, err := s.eng.Blocks().Add(req.IP, req.Reason, ttl)
+	s.Audit(r, "block.add", req.IP, err)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	WriteJSON(w, http.StatusCreated, blk)
+}
+
+func (s *Server) removeBlock(w http.ResponseWriter, r *http.Request) {
+	ip := r.PathValue("ip")
+
+	var err error
+	if !s.eng.Blocks().Remove(ip) {
+		err = fmt.Errorf("block not found")
+	}
+	s.Audit(r, "block.remove", ip, err)
+	if err != nil {
+		WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) clearBlocks(w http.ResponseWriter, r *http.Request) {
+	n := s.eng.Blocks().Clear()
+	s.Audit(r, "block.clear", fmt.Sprintf("%d blocks", n), nil)
+
+	WriteJSON(w, http.StatusOK, map[string]int{"cleared": n})
+}
+
+// reload reloads the --cfg rule set and every listener rule set, each
+// file once
+func (s *Server) reload(w http.ResponseWriter, r *http.Request) {
+	err := s.eng.Reload()
+	reloaded := map[*rweng.Eng]bool{s.eng: true}
+
+	names := make([]string, 0, len(s.engs))
+	for name := range s.engs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		eng := s.engs[name]
+		if err != nil {
+			break
+		}
+		if reloaded[eng] {
+			continue
+		}
+		reloaded[eng] = true
+
+		if err = eng.Reload(); err != nil {
+			err = fmt.Errorf("listener %s: %w", name, err)
+		}
+	}
+
+	s.Audit(r, "config.reload", "rules", err)
+	if err != nil {
+		WriteError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, s.ruleCounts())
+}
+
+// ruleCounts returns the number of rules of the --cfg rule set and of
+// each listener rule set
+func (s *Server) ruleCounts() map[string]interface{} {
+	counts := map[string]interface{}{"rules": len(s.eng.Rules())}
+
+	if len(s.engs) > 0 {
+		listeners := make(map[string]int, len(s.engs))
+		for name, eng := range s.engs {
+			listeners[name] = len(eng.Rules())
+		}
+		counts["listeners"] = listeners
+	}
+
+	return counts
+}
+
+func (s *Server) getStats(w http.ResponseWriter, r *http.Request) {
+	stats := s.ruleCounts()
+	stats["blocks"] = len(s.eng.Blocks().List())
+
+	if s.stats != nil {
+		stats["proxy"] = s.stats()
+	}
+
+	WriteJSON(w, http.StatusOK, stats)
+}
+
+func (s *Server) listExclusions(w http.ResponseWriter, r *http.Request) {
+	eng, _, err := s.engine(r)
+	if err != nil {
+		WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, eng.Exclusions())
+}
+
+func (s *Server) addExclusion(w http.ResponseWriter, r *http.Request) {
+	eng, listener, err := s.engine(r)
+	if err != nil {
+		WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	req := rweng.ExclusionCfg{}
+	if err := ReadJSON(r, &req); err != nil {
+		WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ex, err := eng.AddExclusion(req)
+	s.Audit(r, "exclusion.add", ruleTarget(listener, req.Rule+": "+req.Path), err)
+	if err != nil {
+		WriteError(w, ruleStatus(err), err)
+		return
+	}
+
+	WriteJSON(w, http.StatusCreated, ex)
+}
+
+func (s *Server) removeExclusion(w http.ResponseWriter, r *http.Request) {
+	eng, listener, err := s.engine(r)
+	if err != nil {
+		WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	id := r.PathValue("id")
+
+	err = eng.RemoveExclusion(id)
+	s.Audit(r, "exclusion.remove", ruleTarget(listener, id), err)
+	if err != nil {
+		WriteError(w, ruleStatus(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ruleTarget names the listener rule set in audit targets
+func ruleTarget(listener string, target string) string {
+	if listener == "" {
+		return target
+	}
+	return listener + " " + target
+}
+
+// ruleStatus maps a rule error to a response status
+func ruleStatus(err error) int {
+	if err == rweng.ErrRuleNotFound || err == rweng.ErrExclusionNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
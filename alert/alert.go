@@ -0,0 +1,279 @@
+package alert
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/txn2/n2proxy/evt"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// RateCfg fires a rule when more than Count matching events arrive
+// from one client IP within Window.
+type RateCfg struct {
+	Count  int           `yaml:"count"`
+	Window time.Duration `yaml:"window"`
+}
+
+// RuleCfg defines an alert rule over security events
+type RuleCfg struct {
+	Name        string        `yaml:"name"`
+	MinSeverity evt.Severity  `yaml:"minSeverity"`
+	Groups      []string      `yaml:"groups"`
+	Actions     []string      `yaml:"actions"`
+	Rate        *RateCfg      `yaml:"rate"`
+	Dedup       time.Duration `yaml:"dedup"`
+	Webhooks    []string      `yaml:"webhooks"`
+}
+
+// Cfg defines the alerting configuration
+type Cfg struct {
+	Webhooks []WebhookCfg `yaml:"webhooks"`
+	Rules    []RuleCfg    `yaml:"rules"`
+}
+
+// Alert is a fired alert rule, the unit sent to webhooks
+type Alert struct {
+	Rule  string     `json:"rule"`
+	Time  time.Time  `json:"timestamp"`
+	Count int        `json:"count"`
+	Event *evt.Event `json:"event"`
+}
+
+type rule struct {
+	cfg      RuleCfg
+	groups   map[string]bool
+	actions  map[string]bool
+	webhooks []*Webhook
+	hits     map[string][]time.Time
+	lastSent map[string]time.Time
+}
+
+// match reports whether an event passes the rule filters
+func (rl *rule) match(e *evt.Event) bool {
+	if e.Rule.Severity < rl.cfg.MinSeverity {
+		return false
+	}
+	if len(rl.groups) > 0 && !rl.groups[e.Rule.Group] {
+		return false
+	}
+	if len(rl.actions) > 0 && !rl.actions[e.Action] {
+		return false
+	}
+	return true
+}
+
+// fire records an event and returns the number of hits counted toward
+// the alert, or 0 if the rule does not fire.
+func (rl *rule) fire(e *evt.Event, now time.Time) int {
+	if rl.cfg.Rate == nil {
+		return 1
+	}
+
+	key := e.Client.IP
+	cutoff := now.Add(-rl.cfg.Rate.Window)
+
+	hits := rl.hits[key][:0]
+	for _, t := range rl.hits[key] {
+		if t.After(cutoff) {
+			hits = append(hits, t)
+		}
+	}
+	hits = append(hits, now)
+	rl.hits[key] = hits
+
+	if len(hits) <= rl.cfg.Rate.Count {
+		return 0
+	}
+
+	return len(hits)
+}
+
+// dedupKey identifies duplicate alerts for a rule
+func (rl *rule) dedupKey(e *evt.Event) string {
+	if rl.cfg.Rate != nil {
+		return e.Client.IP
+	}
+	return e.Rule.ID + "|" + e.Client.IP
+}
+
+// prune drops rate and de-duplication state older than the longest window
+func (rl *rule) prune(now time.Time) {
+	if rl.cfg.Rate != nil {
+		cutoff := now.Add(-rl.cfg.Rate.Window)
+		for key, hits := range rl.hits {
+			if len(hits) == 0 || !hits[len(hits)-1].After(cutoff) {
+				delete(rl.hits, key)
+			}
+		}
+	}
+
+	for key, t := range rl.lastSent {
+		if now.Sub(t) > rl.cfg.Dedup {
+			delete(rl.lastSent, key)
+		}
+	}
+}
+
+// Alerter evaluates alert rules over security events and delivers fired
+// alerts to webhooks. It implements evt.Sink.
+type Alerter struct {
+	mu        sync.Mutex
+	rules     []*rule
+	webhooks  []*Webhook
+	lastPrune time.Time
+	logger    *zap.Logger
+}
+
+// NewAlerter instances an Alerter from configuration
+func NewAlerter(cfg Cfg, logger *zap.Logger) (*Alerter, error) {
+	webhooks := make(map[string]*Webhook, 0)
+	a := &Alerter{
+		rules:     make([]*rule, 0),
+		webhooks:  make([]*Webhook, 0),
+		lastPrune: time.Now(),
+		logger:    logger,
+	}
+
+	for _, whCfg := range cfg.Webhooks {
+		if _, ok := webhooks[whCfg.Name]; ok {
+			return nil, fmt.Errorf("duplicate webhook name: %s", whCfg.Name)
+		}
+
+		wh, err := NewWebhook(whCfg, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks[whCfg.Name] = wh
+		a.webhooks = append(a.webhooks, wh)
+	}
+
+	for _, ruleCfg := range cfg.Rules {
+		if ruleCfg.Rate != nil && (ruleCfg.Rate.Count < 1 || ruleCfg.Rate.Window <= 0) {
+			return nil, fmt.Errorf("alert rule %s: rate requires count and window", ruleCfg.Name)
+		}
+
+		rl := &rule{
+			cfg:      ruleCfg,
+			groups:   make(map[string]bool, 0),
+			actions:  make(map[string]bool, 0),
+			webhooks: make([]*Webhook, 0),
+			hits:     make(map[string][]time.Time, 0),
+			lastSent: make(map[string]time.Time, 0),
+		}
+
+		for _, g := range ruleCfg.Groups {
+			rl.groups[g] = true
+		}
+
+		for _, act := range ruleCfg.Actions {
+			rl.actions[act] = true
+		}
+
+		for _, name := range ruleCfg.Webhooks {
+			wh, ok := webhooks[name]
+			if !ok {
+				return nil, fmt.Errorf("alert rule %s: unknown webhook %s", ruleCfg.Name, name)
+			}
+			rl.webhooks = append(rl.webhooks, wh)
+		}
+
+		if len(rl.webhooks) == 0 {
+			return nil, fmt.Errorf("alert rule %s: no webhooks", ruleCfg.Name)
+		}
+
+		logger.Info("Adding alert rule",
+			zap.String("Name", ruleCfg.Name),
+			zap.String("MinSeverity", ruleCfg.MinSeverity.String()),
+			zap.Strings("Webhooks", ruleCfg.Webhooks),
+		)
+
+		a.rules = append(a.rules, rl)
+	}
+
+	return a, nil
+}
+
+// Write implements evt.Sink
+func (a *Alerter) Write(e *evt.Event) error {
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, rl := range a.rules {
+		if !rl.match(e) {
+			continue
+		}
+
+		count := rl.fire(e, now)
+		if count == 0 {
+			continue
+		}
+
+		key := rl.dedupKey(e)
+		if last, ok := rl.lastSent[key]; ok && now.Sub(last) < rl.cfg.Dedup {
+			continue
+		}
+		rl.lastSent[key] = now
+
+		alert := &Alert{
+			Rule:  rl.cfg.Name,
+			Time:  now.UTC(),
+			Count: count,
+			Event: e,
+		}
+
+		for _, wh := range rl.webhooks {
+			wh.Send(alert)
+		}
+	}
+
+	if now.Sub(a.lastPrune) > time.Minute {
+		for _, rl := range a.rules {
+			rl.prune(now)
+		}
+		a.lastPrune = now
+	}
+
+	return nil
+}
+
+// Close implements evt.Sink, flushing pending alerts.
+func (a *Alerter) Close() error {
+	errs := make([]string, 0)
+	for _, wh := range a.webhooks {
+		if err := wh.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("closing webhooks: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// NewAlerterFromYaml loads an Alerter from yaml data
+func NewAlerterFromYaml(filename string, logger *zap.Logger) (*Alerter, error) {
+
+	ymlData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Cfg{}
+
+	err = yaml.Unmarshal([]byte(ymlData), &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAlerter(cfg, logger)
+}
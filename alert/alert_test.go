@@ -0,0 +1,145 @@
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/txn2/n2proxy/evt"
+	"go.uber.org/zap"
+)
+
+func testEvent(id string, group string, severity evt.Severity, ip string, action string) *evt.Event {
+	return &evt.Event{
+		ID:     evt.NewID(),
+		Rule:   evt.Rule{ID: id, Group: group, Severity: severity},
+		Client: evt.Client{IP: ip},
+		Action: action,
+	}
+}
+
+func TestAlerterRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   RuleCfg
+		events []*evt.Event
+		want   []int // alert counts in order
+	}{
+		{
+			name: "min severity",
+			rule: RuleCfg{MinSeverity: evt.SeverityHigh},
+			events: []*evt.Event{
+				testEvent("a", "sqli", evt.SeverityMedium, "10.0.0.1", "block"),
+				testEvent("b", "sqli", evt.SeverityHigh, "10.0.0.1", "block"),
+				testEvent("c", "sqli", evt.SeverityCritical, "10.0.0.1", "block"),
+			},
+			want: []int{1, 1},
+		},
+		{
+			name: "groups",
+			rule: RuleCfg{Groups: []string{"sqli"}},
+			events: []*evt.Event{
+				testEvent("a", "sqli", evt.SeverityHigh, "10.0.0.1", "block"),
+				testEvent("b", "xss", evt.SeverityHigh, "10.0.0.1", "block"),
+			},
+			want: []int{1},
+		},
+		{
+			name: "actions",
+			rule: RuleCfg{Actions: []string{"block"}},
+			events: []*evt.Event{
+				testEvent("a", "sqli", evt.SeverityHigh, "10.0.0.1", "log"),
+				testEvent("b", "sqli", evt.SeverityHigh, "10.0.0.1", "block"),
+			},
+			want: []int{1},
+		},
+		{
+			name: "rate",
+			rule: RuleCfg{Rate: &RateCfg{Count: 2, Window: time.Minute}, Dedup: time.Minute},
+			events: []*evt.Event{
+				testEvent("a", "sqli", evt.SeverityHigh, "10.0.0.1", "block"),
+				testEvent("b", "sqli", evt.SeverityHigh, "10.0.0.1", "block"),
+				testEvent("c", "sqli", evt.SeverityHigh, "10.0.0.2", "block"),
+				testEvent("d", "sqli", evt.SeverityHigh, "10.0.0.1", "block"),
+				testEvent("e", "sqli", evt.SeverityHigh, "10.0.0.1", "block"),
+			},
+			want: []int{3},
+		},
+		{
+			name: "dedup",
+			rule: RuleCfg{Dedup: time.Minute},
+			events: []*evt.Event{
+				testEvent("a", "sqli", evt.SeverityHigh, "10.0.0.1", "block"),
+				testEvent("a", "sqli", evt.SeverityHigh, "10.0.0.1", "block"),
+				testEvent("a", "sqli", evt.SeverityHigh, "10.0.0.2", "block"),
+				testEvent("b", "sqli", evt.SeverityHigh, "10.0.0.1", "block"),
+			},
+			want: []int{1, 1, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := newReceiver(t)
+
+			tt.rule.Name = tt.name
+			tt.rule.Webhooks = []string{"test"}
+			a, err := NewAlerter(Cfg{
+				Webhooks: []WebhookCfg{{Name: "test", URL: rc.URL, BatchInterval: time.Hour}},
+				Rules:    []RuleCfg{tt.rule},
+			}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, e := range tt.events {
+				if err := a.Write(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := a.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			alerts := rc.alerts()
+			if len(alerts) != len(tt.want) {
+				t.Fatalf("%d alerts, want %d", len(alerts), len(tt.want))
+			}
+			for i, al := range alerts {
+				if al.Rule != tt.name || al.Count != tt.want[i] {
+					t.Errorf("alert %d: rule %q count %d, want %q count %d", i, al.Rule, al.Count, tt.name, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAlerterConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Cfg
+	}{
+		{
+			name: "duplicate webhook",
+			cfg:  Cfg{Webhooks: []WebhookCfg{{Name: "a", URL: "http://127.0.0.1/"}, {Name: "a", URL: "http://127.0.0.1/"}}},
+		},
+		{
+			name: "unknown webhook",
+			cfg:  Cfg{Rules: []RuleCfg{{Name: "r", Webhooks: []string{"missing"}}}},
+		},
+		{
+			name: "rate without window",
+			cfg: Cfg{
+				Webhooks: []WebhookCfg{{Name: "a", URL: "http://127.0.0.1/"}},
+				Rules:    []RuleCfg{{Name: "r", Rate: &RateCfg{Count: 2}, Webhooks: []string{"a"}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewAlerter(tt.cfg, zap.NewNop()); err == nil {
+				t.Error("NewAlerter accepted the configuration")
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package alert
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Masterminds/sprig"
+	"go.uber.org/zap"
+)
+
+// DefaultTemplate renders a batch of alerts as JSON
+const DefaultTemplate = `{"source":"n2proxy","webhook":{{ .Name | toJson }},"alerts":{{ .Alerts | toJson }}}`
+
+// maxRetrying limits the batches of a webhook waiting to be retried,
+// further failed batches are dropped
+const maxRetrying = 10
+
+// WebhookCfg defines a webhook receiving batches of alerts
+type WebhookCfg struct {
+	Name          string            `yaml:"name"`
+	URL           string            `yaml:"url"`
+	Headers       map[string]string `yaml:"headers"`
+	Template      string            `yaml:"template"`
+	BatchSize     int               `yaml:"batchSize"`
+	BatchInterval time.Duration     `yaml:"batchInterval"`
+	MaxRetries    int               `yaml:"maxRetries"`
+	Backoff       time.Duration     `yaml:"backoff"`
+	MaxBackoff    time.Duration     `yaml:"maxBackoff"`
+	Timeout       time.Duration     `yaml:"timeout"`
+}
+
+// Payload is the data passed to a webhook template
+type Payload struct {
+	Name   string
+	Alerts []*Alert
+}
+
+// Webhook batches alerts and POSTs them to a URL. Failed batches are
+// retried aside, so the delivery loop keeps collecting alerts.
+type Webhook struct {
+	cfg      WebhookCfg
+	tmpl     *template.Template
+	client   *http.Client
+	queue    chan *Alert
+	done     chan struct{}
+	closing  chan struct{} // ends retry waits
+	retrying chan struct{} // one slot per batch waiting to be retried
+	retries  sync.WaitGroup
+	once     sync.Once
+	logger   *zap.Logger
+}
+
+// NewWebhook instances a Webhook and starts its delivery loop
+func NewWebhook(cfg WebhookCfg, logger *zap.Logger) (*Webhook, error) {
+	if cfg.Name == "" || cfg.URL == "" {
+		return nil, fmt.Errorf("webhook requires a name and url")
+	}
+
+	if cfg.Template == "" {
+		cfg.Template = DefaultTemplate
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 20
+	}
+	if cfg.BatchInterval <= 0 {
+		cfg.BatchInterval = 5 * time.Second
+	}
+	// 0 uses the default, a negative value disables retries
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	tmpl, err := template.New(cfg.Name).Funcs(sprig.TxtFuncMap()).Parse(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	wh := &Webhook{
+		cfg:      cfg,
+		tmpl:     tmpl,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		queue:    make(chan *Alert, cfg.BatchSize*10),
+		done:     make(chan struct{}),
+		closing:  make(chan struct{}),
+		retrying: make(chan struct{}, maxRetrying),
+		logger:   logger,
+	}
+
+	go wh.run()
+
+	return wh, nil
+}
+
+// Send queues an alert for the next batch
+func (wh *Webhook) Send(a *Alert) {
+	select {
+	case wh.queue <- a:
+	default:
+		wh.logger.Warn("Alert dropped, webhook queue full.", zap.String("Webhook", wh.cfg.Name), zap.String("Rule", a.Rule))
+	}
+}
+
+// Close delivers the pending batch once and stops the delivery loop.
+// Batches waiting to be retried are dropped.
+func (wh *Webhook) Close() error {
+	wh.once.Do(func() {
+		close(wh.closing)
+		close(wh.queue)
+		<-wh.done
+		wh.retries.Wait()
+	})
+	return nil
+}
+
+func (wh *Webhook) run() {
+	defer close(wh.done)
+
+	ticker := time.NewTicker(wh.cfg.BatchInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Alert, 0, wh.cfg.BatchSize)
+	for {
+		select {
+		case a, ok := <-wh.queue:
+			if !ok {
+				wh.deliver(batch)
+				return
+			}
+			batch = append(batch, a)
+			if len(batch) >= wh.cfg.BatchSize {
+				wh.deliver(batch)
+				batch = make([]*Alert, 0, wh.cfg.BatchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				wh.deliver(batch)
+				batch = make([]*Alert, 0, wh.cfg.BatchSize)
+			}
+		}
+	}
+}
+
+// deliver POSTs a batch and hands it to retry when that fails
+func (wh *Webhook) deliver(batch []*Alert) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var body bytes.Buffer
+	if err := wh.tmpl.Execute(&body, Payload{Name: wh.cfg.Name, Alerts: batch}); err != nil {
+		wh.logger.Error("Webhook template failed: "+err.Error(), zap.String("Webhook", wh.cfg.Name))
+		return
+	}
+
+	err := wh.post(body.Bytes())
+	if err == nil {
+		return
+	}
+
+	// the last batch on close gets one attempt
+	if wh.cfg.MaxRetries == 0 || wh.isClosing() {
+		wh.failed(err, len(batch), 1)
+		return
+	}
+
+	select {
+	case wh.retrying <- struct{}{}:
+	default:
+		wh.logger.Error("Webhook delivery failed, too many batches awaiting retry: "+err.Error(),
+			zap.String("Webhook", wh.cfg.Name),
+			zap.Int("Alerts", len(batch)),
+		)
+		return
+	}
+
+	wh.retries.Add(1)
+	go func() {
+		defer wh.retries.Done()
+		defer func() { <-wh.retrying }()
+		wh.retry(body.Bytes(), len(batch), err)
+	}()
+}
+
+// retry POSTs a failed batch again with exponential backoff until it
+// is delivered, attempts run out or the webhook is closed
+func (wh *Webhook) retry(body []byte, alerts int, err error) {
+	backoff := wh.cfg.Backoff
+	for attempt := 1; ; attempt++ {
+		wh.logger.Warn("Webhook delivery failed, retrying: "+err.Error(),
+			zap.String("Webhook", wh.cfg.Name),
+			zap.Duration("Backoff", backoff),
+		)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-wh.closing:
+			timer.Stop()
+			wh.logger.Error("Webhook closed, dropping alerts awaiting retry",
+				zap.String("Webhook", wh.cfg.Name),
+				zap.Int("Alerts", alerts),
+			)
+			return
+		}
+
+		err = wh.post(body)
+		if err == nil {
+			return
+		}
+
+		if attempt >= wh.cfg.MaxRetries {
+			wh.failed(err, alerts, attempt+1)
+			return
+		}
+
+		backoff *= 2
+		if backoff > wh.cfg.MaxBackoff {
+			backoff = wh.cfg.MaxBackoff
+		}
+	}
+}
+
+// isClosing reports whether Close was called
+func (wh *Webhook) isClosing() bool {
+	select {
+	case <-wh.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// failed logs a batch given up on
+func (wh *Webhook) failed(err error, alerts int, attempts int) {
+	wh.logger.Error("Webhook delivery failed: "+err.Error(),
+		zap.String("Webhook", wh.cfg.Name),
+		zap.Int("Alerts", alerts),
+		zap.Int("Attempts", attempts),
+	)
+}
+
+func (wh *Webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wh.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "n2proxy")
+	for k, v := range wh.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
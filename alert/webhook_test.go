@@ -0,0 +1,226 @@
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// received is the part of a delivered alert the tests check
+type received struct {
+	Rule  string `json:"rule"`
+	Count int    `json:"count"`
+}
+
+// receiver is a local webhook endpoint answering with statuses in
+// order, then 200, and recording the batches it accepted
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests int
+	batches  [][]received
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	rc := &receiver{statuses: statuses}
+	rc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+
+		rc.requests++
+		if len(rc.statuses) > 0 {
+			status := rc.statuses[0]
+			rc.statuses = rc.statuses[1:]
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+		}
+
+		var payload struct {
+			Alerts []received `json:"alerts"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+		rc.batches = append(rc.batches, payload.Alerts)
+	}))
+	t.Cleanup(rc.Close)
+	return rc
+}
+
+// counts returns the requests received and the accepted batch sizes
+func (rc *receiver) counts() (int, []int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	sizes := make([]int, 0, len(rc.batches))
+	for _, b := range rc.batches {
+		sizes = append(sizes, len(b))
+	}
+	return rc.requests, sizes
+}
+
+// waitRequests waits until the receiver got n requests
+func (rc *receiver) waitRequests(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if requests, _ := rc.counts(); requests >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("receiver did not get %d requests", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookBatching(t *testing.T) {
+	rc := newReceiver(t)
+
+	wh, err := NewWebhook(WebhookCfg{Name: "test", URL: rc.URL, BatchSize: 2, BatchInterval: time.Hour}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		wh.Send(&Alert{Rule: "rule"})
+	}
+	wh.Close()
+
+	_, sizes := rc.counts()
+	if len(sizes) != 3 || sizes[0] != 2 || sizes[1] != 2 || sizes[2] != 1 {
+		t.Errorf("batches %v, want [2 2 1]", sizes)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		maxRetries int
+		requests   int
+		delivered  int
+	}{
+		{name: "delivered first time", requests: 1, delivered: 1},
+		{name: "5xx then 200", statuses: []int{500, 503}, requests: 3, delivered: 1},
+		{name: "retries exhausted", statuses: []int{500, 500, 500, 500}, maxRetries: 2, requests: 3},
+		{name: "retries disabled", statuses: []int{500}, maxRetries: -1, requests: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := newReceiver(t, tt.statuses...)
+
+			wh, err := NewWebhook(WebhookCfg{
+				Name:       "test",
+				URL:        rc.URL,
+				BatchSize:  1,
+				MaxRetries: tt.maxRetries,
+				Backoff:    time.Millisecond,
+			}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wh.Send(&Alert{Rule: "rule"})
+			rc.waitRequests(t, tt.requests)
+			// no further attempts
+			time.Sleep(50 * time.Millisecond)
+			wh.Close()
+
+			requests, sizes := rc.counts()
+			if requests != tt.requests {
+				t.Errorf("%d requests, want %d", requests, tt.requests)
+			}
+			if len(sizes) != tt.delivered {
+				t.Errorf("%d batches delivered, want %d", len(sizes), tt.delivered)
+			}
+		})
+	}
+}
+
+func TestWebhookCloseDuringBackoff(t *testing.T) {
+	rc := newReceiver(t, http.StatusInternalServerError)
+
+	wh, err := NewWebhook(WebhookCfg{
+		Name:      "test",
+		URL:       rc.URL,
+		BatchSize: 1,
+		Backoff:   time.Hour,
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first batch fails and waits an hour to be retried
+	wh.Send(&Alert{Rule: "failed"})
+	rc.waitRequests(t, 1)
+
+	// later alerts are still delivered
+	wh.Send(&Alert{Rule: "delivered"})
+	rc.waitRequests(t, 2)
+
+	closed := make(chan struct{})
+	go func() {
+		wh.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close waited for the retry backoff")
+	}
+
+	requests, sizes := rc.counts()
+	if requests != 2 || len(sizes) != 1 {
+		t.Errorf("%d requests and %d batches delivered, want 2 and 1", requests, len(sizes))
+	}
+}
+
+func TestWebhookCloseSendsPendingBatchOnce(t *testing.T) {
+	rc := newReceiver(t, http.StatusInternalServerError)
+
+	wh, err := NewWebhook(WebhookCfg{
+		Name:          "test",
+		URL:           rc.URL,
+		BatchInterval: time.Hour,
+		Backoff:       time.Hour,
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wh.Send(&Alert{Rule: "pending"})
+
+	start := time.Now()
+	wh.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close took %s", elapsed)
+	}
+
+	if requests, _ := rc.counts(); requests != 1 {
+		t.Errorf("%d requests, want the pending batch sent once", requests)
+	}
+}
+
+// alerts returns the accepted alerts in delivery order
+func (rc *receiver) alerts() []received {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	alerts := make([]received, 0)
+	for _, b := range rc.batches {
+		alerts = append(alerts, b...)
+	}
+	return alerts
+}
@@ -0,0 +1,227 @@
+package dash
+
+import (
+	"embed"
+	"io/fs"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/txn2/n2proxy/admin"
+	"github.com/txn2/n2proxy/evt"
+	"github.com/txn2/n2proxy/rweng"
+)
+
+//go:embed ui
+var ui embed.FS
+
+// trendMinutes is the span of the per-rule hit trends
+const trendMinutes = 60
+
+// Request is a proxied request as shown in the live traffic view
+type Request struct {
+	Time      time.Time `json:"timestamp"`
+	RequestID string    `json:"request_id"`
+	Listener  string    `json:"listener"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	Path      string    `json:"path"`
+	Action    string    `json:"action"`
+	Rules     []string  `json:"rules"`
+}
+
+// Traffic keeps the most recent requests in memory
+type Traffic struct {
+	mu       sync.RWMutex
+	requests []Request
+	next     int
+	full     bool
+}
+
+// NewTraffic instances a ring holding up to size requests
+func NewTraffic(size int) *Traffic {
+	if size < 1 {
+		size = 1000
+	}
+	return &Traffic{requests: make([]Request, size)}
+}
+
+// Record adds a request received on listener with its rule verdict,
+// host and path as sent by the client. Record on a nil Traffic is a
+// no-op.
+func (t *Traffic) Record(r *http.Request, requestID string, listener string, host string, path string, v *rweng.Verdict) {
+	if t == nil {
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	req := Request{
+		Time:      time.Now().UTC(),
+		RequestID: requestID,
+		Listener:  listener,
+		ClientIP:  ip,
+		Method:    r.Method,
+		Host:      host,
+		Path:      path,
+		Action:    v.Action,
+		Rules:     v.Rules,
+	}
+
+	t.mu.Lock()
+	t.requests[t.next] = req
+	t.next = (t.next + 1) % len(t.requests)
+	if t.next == 0 {
+		t.full = true
+	}
+	t.mu.Unlock()
+}
+
+// Recent returns up to n requests, newest first
+func (t *Traffic) Recent(n int) []Request {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	count := t.next
+	if t.full {
+		count = len(t.requests)
+	}
+	if n < 1 || n > count {
+		n = count
+	}
+
+	recent := make([]Request, 0, n)
+	for i := 1; i <= n; i++ {
+		recent = append(recent, t.requests[(t.next-i+len(t.requests))%len(t.requests)])
+	}
+
+	return recent
+}
+
+// Count is a named counter in a summary
+type Count struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// Summary aggregates the recent security events
+type Summary struct {
+	Events   int              `json:"events"`
+	Blocked  int              `json:"blocked"`
+	TopIPs   []Count          `json:"top_ips"`
+	TopRules []Count          `json:"top_rules"`
+	Trends   map[string][]int `json:"trends"` // hits per minute, oldest first
+}
+
+// Dashboard serves the web UI and its data API
+type Dashboard struct {
+	events  *evt.Ring
+	traffic *Traffic
+}
+
+// NewDashboard instances a Dashboard over an event ring and traffic ring
+func NewDashboard(events *evt.Ring, traffic *Traffic) *Dashboard {
+	return &Dashboard{events: events, traffic: traffic}
+}
+
+// Register mounts the UI at /ui/ and the data API under /api/dash/
+func (d *Dashboard) Register(srv *admin.Server) error {
+	static, err := fs.Sub(ui, "ui")
+	if err != nil {
+		return err
+	}
+
+	srv.HandlePublic("/ui/", http.StripPrefix("/ui/", http.FileServer(http.FS(static))))
+	srv.HandlePublic("/{$}", http.RedirectHandler("/ui/", http.StatusFound))
+	srv.Handle("GET /api/dash/traffic", http.HandlerFunc(d.getTraffic))
+	srv.Handle("GET /api/dash/events", http.HandlerFunc(d.getEvents))
+	srv.Handle("GET /api/dash/summary", http.HandlerFunc(d.getSummary))
+
+	return nil
+}
+
+// limit reads the n query parameter
+func limit(r *http.Request) int {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n < 1 {
+		return 100
+	}
+	return n
+}
+
+func (d *Dashboard) getTraffic(w http.ResponseWriter, r *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, d.traffic.Recent(limit(r)))
+}
+
+func (d *Dashboard) getEvents(w http.ResponseWriter, r *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, d.events.Recent(limit(r)))
+}
+
+func (d *Dashboard) getSummary(w http.ResponseWriter, r *http.Request) {
+	admin.WriteJSON(w, http.StatusOK, summarize(d.events.Recent(0), time.Now(), 10))
+}
+
+// summarize aggregates events into top offenders and per-rule trends
+func summarize(events []*evt.Event, now time.Time, top int) Summary {
+	ips := make(map[string]int, 0)
+	rules := make(map[string]int, 0)
+	trends := make(map[string][]int, 0)
+	blocked := 0
+
+	for _, e := range events {
+		if e.Action == evt.ActionBypass {
+			continue
+		}
+
+		if e.Action == evt.ActionBlock || e.Action == evt.ActionDropBody {
+			blocked++
+		}
+
+		ips[e.Client.IP]++
+		rules[e.Rule.ID]++
+
+		age := int(now.Sub(e.Time) / time.Minute)
+		if age < 0 || age >= trendMinutes {
+			continue
+		}
+		if _, ok := trends[e.Rule.ID]; !ok {
+			trends[e.Rule.ID] = make([]int, trendMinutes)
+		}
+		trends[e.Rule.ID][trendMinutes-1-age]++
+	}
+
+	return Summary{
+		Events:   len(events),
+		Blocked:  blocked,
+		TopIPs:   topCounts(ips, top),
+		TopRules: topCounts(rules, top),
+		Trends:   trends,
+	}
+}
+
+func topCounts(m map[string]int, n int) []Count {
+	counts := make([]Count, 0, len(m))
+	for k, c := range m {
+		counts = append(counts, Count{Key: k, Count: c})
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count == counts[j].Count {
+			return counts[i].Key < counts[j].Key
+		}
+		return counts[i].Count > counts[j].Count
+	})
+
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+
+	return counts
+}
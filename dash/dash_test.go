@@ -0,0 +1,104 @@
+package dash
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/txn2/n2proxy/evt"
+	"github.com/txn2/n2proxy/rweng"
+)
+
+func TestTopCounts(t *testing.T) {
+	m := map[string]int{"a": 1, "b": 3, "c": 3, "d": 2}
+
+	tests := []struct {
+		name string
+		n    int
+		want []Count
+	}{
+		{name: "ties by key", n: 10, want: []Count{{"b", 3}, {"c", 3}, {"d", 2}, {"a", 1}}},
+		{name: "limited", n: 2, want: []Count{{"b", 3}, {"c", 3}}},
+		{name: "none", n: 0, want: []Count{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := topCounts(m, tt.n); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("topCounts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	event := func(rule string, ip string, action string, age time.Duration) *evt.Event {
+		return &evt.Event{
+			Time:   now.Add(-age),
+			Rule:   evt.Rule{ID: rule},
+			Client: evt.Client{IP: ip},
+			Action: action,
+		}
+	}
+
+	events := []*evt.Event{
+		event("urlBan-1", "10.0.0.1", evt.ActionRewrite, 0),
+		event("urlBan-1", "10.0.0.1", evt.ActionBlock, 30*time.Second),
+		event("urlBan-1", "10.0.0.2", evt.ActionDropBody, 5*time.Minute),
+		event("postBan-2", "10.0.0.1", evt.ActionFilter, 2*time.Hour),
+		// whitelisted requests are not offenders
+		event("urlWhiteList-1", "10.0.0.3", evt.ActionBypass, 0),
+	}
+
+	s := summarize(events, now, 10)
+
+	if s.Events != 5 || s.Blocked != 2 {
+		t.Errorf("events %d blocked %d, want 5 and 2", s.Events, s.Blocked)
+	}
+	if want := []Count{{"10.0.0.1", 3}, {"10.0.0.2", 1}}; !reflect.DeepEqual(s.TopIPs, want) {
+		t.Errorf("top ips %v, want %v", s.TopIPs, want)
+	}
+	if want := []Count{{"urlBan-1", 3}, {"postBan-2", 1}}; !reflect.DeepEqual(s.TopRules, want) {
+		t.Errorf("top rules %v, want %v", s.TopRules, want)
+	}
+
+	// events older than the trend span only count toward the totals
+	if _, ok := s.Trends["postBan-2"]; ok {
+		t.Error("trend for an event older than an hour")
+	}
+	trend := s.Trends["urlBan-1"]
+	if len(trend) != trendMinutes {
+		t.Fatalf("trend of %d minutes, want %d", len(trend), trendMinutes)
+	}
+	if trend[trendMinutes-1] != 2 || trend[trendMinutes-6] != 1 {
+		t.Errorf("trend ends with %v", trend[trendMinutes-6:])
+	}
+}
+
+func TestTrafficRecent(t *testing.T) {
+	tr := NewTraffic(3)
+	for _, path := range []string{"/1", "/2", "/3", "/4"} {
+		r := httptest.NewRequest("GET", path, nil)
+		tr.Record(r, "id", "main", "example.com", path, &rweng.Verdict{})
+	}
+
+	paths := func(reqs []Request) []string {
+		p := make([]string, 0, len(reqs))
+		for _, r := range reqs {
+			p = append(p, r.Path)
+		}
+		return p
+	}
+
+	if got := paths(tr.Recent(0)); !reflect.DeepEqual(got, []string{"/4", "/3", "/2"}) {
+		t.Errorf("recent %v, want the newest three", got)
+	}
+	if got := paths(tr.Recent(2)); !reflect.DeepEqual(got, []string{"/4", "/3"}) {
+		t.Errorf("recent 2 %v", got)
+	}
+
+	var none *Traffic
+	none.Record(httptest.NewRequest("GET", "/", nil), "id", "main", "example.com", "/", &rweng.Verdict{})
+}
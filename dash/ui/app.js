@@ -0,0 +1,163 @@
+// n2proxy dashboard. Event fragments and request data are attacker
+// controlled, so everything is rendered with textContent.
+(function () {
+  'use strict';
+
+  var token = sessionStorage.getItem('n2proxy.token') || '';
+  var timer = null;
+
+  function $(id) { return document.getElementById(id); }
+
+  function api(method, path, body) {
+    return fetch(path, {
+      method: method,
+      headers: { 'Authorization': 'Bearer ' + token, 'Content-Type': 'application/json' },
+      body: body ? JSON.stringify(body) : undefined
+    }).then(function (res) {
+      if (res.status === 401) {
+        stop('unauthorized');
+        throw new Error('unauthorized');
+      }
+      if (res.status === 204) { return null; }
+      return res.json().then(function (data) {
+        if (!res.ok) { throw new Error(data.error || res.statusText); }
+        return data;
+      });
+    });
+  }
+
+  function el(tag, text, cls) {
+    var e = document.createElement(tag);
+    if (text !== undefined && text !== null) { e.textContent = String(text); }
+    if (cls) { e.className = cls; }
+    return e;
+  }
+
+  function row(cells) {
+    var tr = el('tr');
+    cells.forEach(function (c) {
+      if (c instanceof Node) {
+        var td = el('td');
+        td.appendChild(c);
+        tr.appendChild(td);
+        return;
+      }
+      tr.appendChild(c && c.td ? c.td : el('td', c));
+    });
+    return tr;
+  }
+
+  function fill(id, rows) {
+    var body = $(id);
+    body.textContent = '';
+    rows.forEach(function (r) { body.appendChild(r); });
+  }
+
+  function time(ts) { return new Date(ts).toLocaleTimeString(); }
+
+  function action(a) { return { td: el('td', a || 'clean', a) }; }
+
+  function button(label, fn) {
+    var b = el('button', label, 'small');
+    b.addEventListener('click', fn);
+    return b;
+  }
+
+  function sparkline(points) {
+    var ns = 'http://www.w3.org/2000/svg';
+    var svg = document.createElementNS(ns, 'svg');
+    svg.setAttribute('class', 'trend');
+    svg.setAttribute('viewBox', '0 0 ' + (points.length - 1) + ' 20');
+    svg.setAttribute('preserveAspectRatio', 'none');
+    var max = Math.max.apply(null, points.concat([1]));
+    var line = document.createElementNS(ns, 'polyline');
+    line.setAttribute('points', points.map(function (p, i) {
+      return i + ',' + (20 - (p / max) * 19);
+    }).join(' '));
+    svg.appendChild(line);
+    return svg;
+  }
+
+  function escapeRegexp(s) { return s.replace(/[.*+?^${}()|[\]\\]/g, '\\$&'); }
+
+  // exclude skips the rule for the exact path of the request that hit it
+  function exclude(e) {
+    var path = e.request.uri.split('?')[0];
+    var pattern = '^' + escapeRegexp(path) + '$';
+    if (!confirm('Exclude rule ' + e.rule.id + ' for ' + pattern + '?')) { return; }
+    api('POST', '/api/exclusions', { rule: e.rule.id, path: pattern })
+      .then(function (ex) { status('added exclusion ' + ex.id); })
+      .catch(function (err) { status(err.message); });
+  }
+
+  function block(ip) {
+    var ttl = prompt('Block ' + ip + ' for (e.g. 1h, empty for permanent):', '1h');
+    if (ttl === null) { return; }
+    api('POST', '/api/blocks', { ip: ip, reason: 'dashboard', ttl: ttl })
+      .then(function () { status('blocked ' + ip); })
+      .catch(function (err) { status(err.message); });
+  }
+
+  function status(msg) { $('status').textContent = msg; }
+
+  function refresh() {
+    api('GET', '/api/stats').then(function (s) {
+      $('requests').textContent = s.proxy ? s.proxy.requests : '-';
+    }).catch(function () {});
+
+    api('GET', '/api/dash/summary').then(function (s) {
+      $('events').textContent = s.events;
+      $('blocked').textContent = s.blocked;
+      fill('topIPs', s.top_ips.map(function (c) {
+        return row([c.key, c.count, button('Block', function () { block(c.key); })]);
+      }));
+      fill('topRules', s.top_rules.map(function (c) {
+        var trend = s.trends[c.key];
+        return row([c.key, c.count, trend ? sparkline(trend) : '']);
+      }));
+    }).catch(function () {});
+
+    api('GET', '/api/dash/events?n=50').then(function (events) {
+      fill('eventList', events.map(function (e) {
+        return row([
+          time(e.timestamp), action(e.action), e.rule.id + ' (' + e.rule.group + ')',
+          e.client.ip, e.request.method + ' ' + e.request.host + e.request.uri,
+          { td: el('td', e.fragment, 'frag') },
+          button('Exclude', function () { exclude(e); })
+        ]);
+      }));
+    }).catch(function () {});
+
+    api('GET', '/api/dash/traffic?n=50').then(function (reqs) {
+      fill('traffic', reqs.map(function (r) {
+        return row([time(r.timestamp), r.listener, r.client_ip, r.method, r.host, r.path,
+          action(r.action), (r.rules || []).join(', ')]);
+      }));
+    }).catch(function () {});
+  }
+
+  function start() {
+    $('dash').hidden = false;
+    status('');
+    refresh();
+    timer = setInterval(refresh, 2000);
+  }
+
+  function stop(msg) {
+    clearInterval(timer);
+    sessionStorage.removeItem('n2proxy.token');
+    $('dash').hidden = true;
+    status(msg);
+  }
+
+  $('login').addEventListener('submit', function (ev) {
+    ev.preventDefault();
+    token = $('token').value;
+    $('token').value = '';
+    sessionStorage.setItem('n2proxy.token', token);
+    clearInterval(timer);
+    start();
+  });
+
+  if (token) { start(); }
+})();
@@ -0,0 +1,315 @@
+package evt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// Severity of a security event.
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+	SeverityCritical
+)
+
+var severityNames = map[Severity]string{
+	SeverityInfo:     "info",
+	SeverityLow:      "low",
+	SeverityMedium:   "medium",
+	SeverityHigh:     "high",
+	SeverityCritical: "critical",
+}
+
+// String returns the lower case name of the severity.
+func (s Severity) String() string {
+	if name, ok := severityNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseSeverity maps a severity name to a Severity.
+func ParseSeverity(name string) (Severity, error) {
+	for s, n := range severityNames {
+		if strings.ToLower(name) == n {
+			return s, nil
+		}
+	}
+	return SeverityInfo, fmt.Errorf("unknown severity: %s", name)
+}
+
+// MarshalJSON encodes the severity by name.
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + s.String() + `"`), nil
+}
+
+// UnmarshalYAML decodes a severity by name.
+func (s *Severity) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err != nil {
+		return err
+	}
+
+	sev, err := ParseSeverity(name)
+	if err != nil {
+		return err
+	}
+
+	*s = sev
+	return nil
+}
+
+// Actions taken by the rule engine.
+const (
+	ActionBypass   = "bypass"
+	ActionRewrite  = "rewrite"
+	ActionDropBody = "drop_body"
+	ActionFilter   = "filter"
+	ActionBlock    = "block"
+)
+
+// Targets inspected by the rule engine.
+const (
+	TargetURI         = "uri"
+	TargetQuery       = "query"
+	TargetBody        = "body"
+	TargetClient      = "client"
+	TargetIdentity    = "identity"
+	TargetFingerprint = "fingerprint"
+)
+
+// Rule describes the rule that produced an event.
+type Rule struct {
+	ID       string   `json:"id"`
+	Group    string   `json:"group"`
+	Pattern  string   `json:"pattern"`
+	Severity Severity `json:"severity"`
+}
+
+// Client describes the client that sent the offending request.
+type Client struct {
+	IP        string `json:"ip"`
+	Port      string `json:"port,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Identity  string `json:"identity,omitempty"` // verified client certificate identity
+	JA3       string `json:"ja3,omitempty"`      // TLS client fingerprint hash
+	JA4       string `json:"ja4,omitempty"`
+}
+
+// Request describes the offending request.
+type Request struct {
+	Method string `json:"method"`
+	Host   string `json:"host"`
+	URI    string `json:"uri"`
+}
+
+// Event is a security event. The field set is the stable schema
+// written to every sink.
+type Event struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"timestamp"`
+	RequestID string    `json:"request_id"`
+	Rule      Rule      `json:"rule"`
+	Target    string    `json:"target"`
+	Fragment  string    `json:"fragment"`
+	Client    Client    `json:"client"`
+	Request   Request   `json:"request"`
+	Action    string    `json:"action"`
+}
+
+// NewID returns a random event id.
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Sink receives security events.
+type Sink interface {
+	Write(e *Event) error
+	Close() error
+}
+
+// SinkCfg defines a single sink
+type SinkCfg struct {
+	Type       string `yaml:"type"`
+	Format     string `yaml:"format"`
+	Path       string `yaml:"path"`
+	MaxSizeMB  int    `yaml:"maxSizeMB"`
+	MaxBackups int    `yaml:"maxBackups"`
+	Network    string `yaml:"network"`
+	Address    string `yaml:"address"`
+	Facility   int    `yaml:"facility"`
+	AppName    string `yaml:"appName"`
+}
+
+// Cfg defines the security event stream configuration
+type Cfg struct {
+	Buffer int       `yaml:"buffer"`
+	Sinks  []SinkCfg `yaml:"sinks"`
+}
+
+// Stream fans security events out to sinks. Events are queued and
+// written by a single goroutine so slow sinks do not hold requests.
+type Stream struct {
+	dropped uint64 // first for 64-bit atomic alignment on arm
+	sinks   []Sink
+	queue   chan *Event
+	done    chan struct{}
+	once    sync.Once
+	mu      sync.RWMutex // guards closed and sends on queue
+	closed  bool
+	logger  *zap.Logger
+}
+
+// NewStream instances a stream writing to sinks.
+func NewStream(sinks []Sink, buffer int, logger *zap.Logger) *Stream {
+	if buffer < 1 {
+		buffer = 1024
+	}
+
+	s := &Stream{
+		sinks:  sinks,
+		queue:  make(chan *Event, buffer),
+		done:   make(chan struct{}),
+		logger: logger,
+	}
+
+	go s.run()
+
+	return s
+}
+
+// Emit queues an event for all sinks. Emit on a nil or closed Stream
+// is a no-op.
+func (s *Stream) Emit(e *Event) {
+	if s == nil {
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+
+	if e.ID == "" {
+		e.ID = NewID()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	select {
+	case s.queue <- e:
+	default:
+		dropped := atomic.AddUint64(&s.dropped, 1)
+		s.logger.Warn("Security event dropped, queue full.", zap.String("EventID", e.ID), zap.Uint64("Dropped", dropped))
+	}
+}
+
+// AddSink attaches a sink to the stream. It must be called before
+// events are emitted.
+func (s *Stream) AddSink(sink Sink) {
+	s.sinks = append(s.sinks, sink)
+}
+
+// Close flushes queued events and closes all sinks.
+func (s *Stream) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	var err error
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		close(s.queue)
+		s.mu.Unlock()
+
+		<-s.done
+		for _, sink := range s.sinks {
+			if cerr := sink.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	})
+
+	return err
+}
+
+func (s *Stream) run() {
+	defer close(s.done)
+	for e := range s.queue {
+		for _, sink := range s.sinks {
+			if err := sink.Write(e); err != nil {
+				s.logger.Error("Security event sink failure: "+err.Error(), zap.String("EventID", e.ID))
+			}
+		}
+	}
+}
+
+// NewSink creates a sink from configuration
+func NewSink(cfg SinkCfg, version string) (Sink, error) {
+	f, err := NewFormatter(cfg.Format, version)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Type {
+	case "file":
+		return NewFileSink(cfg.Path, cfg.MaxSizeMB, cfg.MaxBackups, f)
+	case "syslog":
+		return NewSyslogSink(cfg.Network, cfg.Address, cfg.Facility, cfg.AppName, f)
+	}
+
+	return nil, fmt.Errorf("unknown sink type: %s", cfg.Type)
+}
+
+// NewStreamFromYaml loads a security event stream from yaml data
+func NewStreamFromYaml(filename string, version string, logger *zap.Logger) (*Stream, error) {
+
+	ymlData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Cfg{}
+
+	err = yaml.Unmarshal([]byte(ymlData), &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	sinks := make([]Sink, 0)
+	for _, sinkCfg := range cfg.Sinks {
+		sink, err := NewSink(sinkCfg, version)
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Info("Adding security event sink",
+			zap.String("Type", sinkCfg.Type),
+			zap.String("Format", sinkCfg.Format),
+		)
+
+		sinks = append(sinks, sink)
+	}
+
+	return NewStream(sinks, cfg.Buffer, logger), nil
+}
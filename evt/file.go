@@ -0,0 +1,132 @@
+package evt
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FileSink writes one formatted event per line to a file, rotating
+// the file when it grows past maxSize.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	format     Formatter
+	mu         sync.Mutex
+	file       *os.File // nil after a failed rotation, reopened on write
+	size       int64
+}
+
+// NewFileSink opens (or creates) path for appending. A maxSizeMB of 0
+// disables rotation.
+func NewFileSink(path string, maxSizeMB int, maxBackups int, format Formatter) (*FileSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file sink requires a path")
+	}
+
+	fs := &FileSink{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+		format:     format,
+	}
+
+	if err := fs.open(); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+func (fs *FileSink) open() error {
+	f, err := os.OpenFile(fs.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	fs.file = f
+	fs.size = info.Size()
+
+	return nil
+}
+
+// rotate shifts path.N-1 to path.N ... path to path.1 and reopens path.
+func (fs *FileSink) rotate() error {
+	err := fs.file.Close()
+	fs.file = nil
+	if err != nil {
+		return err
+	}
+
+	if fs.maxBackups < 1 {
+		if err := os.Remove(fs.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return fs.open()
+	}
+
+	for i := fs.maxBackups - 1; i > 0; i-- {
+		src := fmt.Sprintf("%s.%d", fs.path, i)
+		if _, err := os.Stat(src); err == nil {
+			os.Rename(src, fmt.Sprintf("%s.%d", fs.path, i+1))
+		}
+	}
+
+	if err := os.Rename(fs.path, fs.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return fs.open()
+}
+
+// Write implements Sink
+func (fs *FileSink) Write(e *Event) error {
+	line, err := fs.format.Format(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.file == nil {
+		if err := fs.open(); err != nil {
+			return err
+		}
+	}
+
+	if fs.maxSize > 0 && fs.size+int64(len(line)) > fs.maxSize && fs.size > 0 {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := fs.file.Write(line)
+	fs.size += int64(n)
+
+	return err
+}
+
+// Close implements Sink
+func (fs *FileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.file == nil {
+		return nil
+	}
+
+	if err := fs.file.Sync(); err != nil {
+		return err
+	}
+
+	return fs.file.Close()
+}
@@ -0,0 +1,100 @@
+package evt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSinkRotate(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		writes     int
+		files      []string
+	}{
+		{name: "no backups", maxBackups: 0, writes: 3, files: []string{"ev.log"}},
+		{name: "one backup", maxBackups: 1, writes: 3, files: []string{"ev.log", "ev.log.1"}},
+		{name: "shifted backups", maxBackups: 2, writes: 4, files: []string{"ev.log", "ev.log.1", "ev.log.2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fs, err := NewFileSink(filepath.Join(dir, "ev.log"), 1, tt.maxBackups, JSONFormatter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fs.Close()
+
+			// one event per file
+			fs.maxSize = 10
+
+			for i := 0; i < tt.writes; i++ {
+				if err := fs.Write(&Event{ID: "e"}); err != nil {
+					t.Fatalf("write %d: %s", i, err.Error())
+				}
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(tt.files) {
+				t.Fatalf("got %d files, want %v", len(entries), tt.files)
+			}
+			for _, f := range tt.files {
+				data, err := os.ReadFile(filepath.Join(dir, f))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Count(data, []byte("\n")) != 1 {
+					t.Errorf("%s: got %q, want one event", f, data)
+				}
+			}
+		})
+	}
+}
+
+func TestFileSinkReopenAfterFailedRotate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "events")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "ev.log")
+
+	fs, err := NewFileSink(path, 1, 1, JSONFormatter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	fs.maxSize = 10
+
+	if err := fs.Write(&Event{ID: "first"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the reopen after rotation fails while the directory is gone
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Write(&Event{ID: "lost"}); err == nil {
+		t.Fatal("expected the rotation to fail")
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Write(&Event{ID: "after"}); err != nil {
+		t.Fatalf("write after the directory returned: %s", err.Error())
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"id":"after"`)) {
+		t.Errorf("got %q, want the event written after the failure", data)
+	}
+}
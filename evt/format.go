@@ -0,0 +1,176 @@
+package evt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	vendor  = "txn2"
+	product = "n2proxy"
+)
+
+// Formatter renders an event as a single line.
+type Formatter interface {
+	Format(e *Event) ([]byte, error)
+}
+
+// NewFormatter returns a formatter by name: json (default), cef or leef.
+func NewFormatter(name string, version string) (Formatter, error) {
+	switch strings.ToLower(name) {
+	case "", "json":
+		return JSONFormatter{}, nil
+	case "cef":
+		return CEFFormatter{Version: version}, nil
+	case "leef":
+		return LEEFFormatter{Version: version}, nil
+	}
+
+	return nil, fmt.Errorf("unknown event format: %s", name)
+}
+
+// JSONFormatter renders events as JSON objects.
+type JSONFormatter struct{}
+
+// Format implements Formatter
+func (JSONFormatter) Format(e *Event) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// CEFFormatter renders events in ArcSight Common Event Format.
+type CEFFormatter struct {
+	Version string
+}
+
+// cefSeverity maps a Severity to the CEF 0-10 scale.
+func cefSeverity(s Severity) int {
+	switch s {
+	case SeverityLow:
+		return 3
+	case SeverityMedium:
+		return 5
+	case SeverityHigh:
+		return 8
+	case SeverityCritical:
+		return 10
+	}
+	return 1
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtEscaper    = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+// Format implements Formatter
+func (f CEFFormatter) Format(e *Event) ([]byte, error) {
+	ext := [][2]string{
+		{"externalId", e.ID},
+		{"rt", strconv.FormatInt(e.Time.UnixNano()/1e6, 10)},
+		{"src", e.Client.IP},
+		{"spt", e.Client.Port},
+		{"requestMethod", e.Request.Method},
+		{"request", e.Request.URI},
+		{"dhost", e.Request.Host},
+		{"requestClientApplication", e.Client.UserAgent},
+		{"suser", e.Client.Identity},
+		{"act", e.Action},
+		{"cs1Label", "ruleGroup"},
+		{"cs1", e.Rule.Group},
+		{"cs2Label", "rulePattern"},
+		{"cs2", e.Rule.Pattern},
+		{"cs3Label", "target"},
+		{"cs3", e.Target},
+		{"cs4Label", "fragment"},
+		{"cs4", e.Fragment},
+		{"cs5Label", "requestId"},
+		{"cs5", e.RequestID},
+		{"cs6Label", "ja4"},
+		{"cs6", e.Client.JA4},
+		{"flexString1Label", "ja3"},
+		{"flexString1", e.Client.JA3},
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+		vendor,
+		product,
+		cefHeaderEscaper.Replace(f.Version),
+		cefHeaderEscaper.Replace(e.Rule.ID),
+		cefHeaderEscaper.Replace(e.Rule.Group+" "+e.Action),
+		cefSeverity(e.Rule.Severity),
+	)
+
+	first := true
+	for _, kv := range ext {
+		if kv[1] == "" {
+			continue
+		}
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		b.WriteString(kv[0] + "=" + cefExtEscaper.Replace(kv[1]))
+	}
+
+	return []byte(b.String()), nil
+}
+
+// LEEFFormatter renders events in IBM QRadar Log Event Extended Format 1.0.
+type LEEFFormatter struct {
+	Version string
+}
+
+var (
+	leefHeaderEscaper = strings.NewReplacer(`|`, `\|`)
+	leefAttrEscaper   = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+)
+
+// Format implements Formatter
+func (f LEEFFormatter) Format(e *Event) ([]byte, error) {
+	attrs := [][2]string{
+		{"devTime", e.Time.Format("Jan 02 2006 15:04:05.000")},
+		{"devTimeFormat", "MMM dd yyyy HH:mm:ss.SSS"},
+		{"eventId", e.ID},
+		{"requestId", e.RequestID},
+		{"sev", strconv.Itoa(cefSeverity(e.Rule.Severity))},
+		{"cat", e.Rule.Group},
+		{"src", e.Client.IP},
+		{"srcPort", e.Client.Port},
+		{"userAgent", e.Client.UserAgent},
+		{"usrName", e.Client.Identity},
+		{"ja3", e.Client.JA3},
+		{"ja4", e.Client.JA4},
+		{"method", e.Request.Method},
+		{"url", e.Request.URI},
+		{"dstHost", e.Request.Host},
+		{"action", e.Action},
+		{"target", e.Target},
+		{"pattern", e.Rule.Pattern},
+		{"fragment", e.Fragment},
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:1.0|%s|%s|%s|%s|",
+		vendor,
+		product,
+		leefHeaderEscaper.Replace(f.Version),
+		leefHeaderEscaper.Replace(e.Rule.ID),
+	)
+
+	first := true
+	for _, kv := range attrs {
+		if kv[1] == "" {
+			continue
+		}
+		if !first {
+			b.WriteByte('\t')
+		}
+		first = false
+		b.WriteString(kv[0] + "=" + leefAttrEscaper.Replace(kv[1]))
+	}
+
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,59 @@
+package evt
+
+import "sync"
+
+// Ring keeps the most recent events in memory. It implements Sink.
+type Ring struct {
+	mu     sync.RWMutex
+	events []*Event
+	next   int
+	full   bool
+}
+
+// NewRing instances a ring holding up to size events
+func NewRing(size int) *Ring {
+	if size < 1 {
+		size = 1000
+	}
+	return &Ring{events: make([]*Event, size)}
+}
+
+// Write implements Sink
+func (r *Ring) Write(e *Event) error {
+	r.mu.Lock()
+	r.events[r.next] = e
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Close implements Sink
+func (r *Ring) Close() error {
+	return nil
+}
+
+// Recent returns up to n events, newest first. n < 1 returns all.
+func (r *Ring) Recent(n int) []*Event {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	count := r.next
+	if r.full {
+		count = len(r.events)
+	}
+	if n < 1 || n > count {
+		n = count
+	}
+
+	recent := make([]*Event, 0, n)
+	for i := 1; i <= n; i++ {
+		idx := (r.next - i + len(r.events)) % len(r.events)
+		recent = append(recent, r.events[idx])
+	}
+
+	return recent
+}
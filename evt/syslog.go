@@ -0,0 +1,162 @@
+package evt
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// facility local0
+const defaultFacility = 16
+
+// SyslogSink writes RFC 5424 messages over udp, tcp or a unix socket.
+// Stream transports (tcp, unix) use RFC 6587 octet counting framing.
+type SyslogSink struct {
+	network  string
+	address  string
+	facility int
+	appName  string
+	hostname string
+	format   Formatter
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+// NewSyslogSink dials a syslog receiver. network is one of udp, tcp,
+// unix (stream) or unixgram.
+func NewSyslogSink(network string, address string, facility int, appName string, format Formatter) (*SyslogSink, error) {
+	switch network {
+	case "":
+		network = "udp"
+	case "udp", "tcp", "unix", "unixgram":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network: %s", network)
+	}
+
+	if address == "" {
+		return nil, fmt.Errorf("syslog sink requires an address")
+	}
+
+	if facility == 0 {
+		facility = defaultFacility
+	}
+	if facility < 0 || facility > 23 {
+		return nil, fmt.Errorf("syslog facility out of range: %d", facility)
+	}
+
+	if appName == "" {
+		appName = product
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	ss := &SyslogSink{
+		network:  network,
+		address:  address,
+		facility: facility,
+		appName:  appName,
+		hostname: hostname,
+		format:   format,
+	}
+
+	if err := ss.dial(); err != nil {
+		return nil, err
+	}
+
+	return ss, nil
+}
+
+func (ss *SyslogSink) dial() error {
+	conn, err := net.DialTimeout(ss.network, ss.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	ss.conn = conn
+	return nil
+}
+
+// syslogSeverity maps a Severity to a RFC 5424 severity code.
+func syslogSeverity(s Severity) int {
+	switch s {
+	case SeverityCritical:
+		return 2
+	case SeverityHigh:
+		return 3
+	case SeverityMedium:
+		return 4
+	case SeverityLow:
+		return 5
+	}
+	return 6
+}
+
+// message renders a RFC 5424 message.
+func (ss *SyslogSink) message(e *Event, body []byte) []byte {
+	pri := ss.facility*8 + syslogSeverity(e.Rule.Severity)
+	header := fmt.Sprintf("<%d>1 %s %s %s %d %s - ",
+		pri,
+		e.Time.Format(time.RFC3339Nano),
+		ss.hostname,
+		ss.appName,
+		os.Getpid(),
+		e.Rule.Group,
+	)
+
+	return append([]byte(header), body...)
+}
+
+// Write implements Sink
+func (ss *SyslogSink) Write(e *Event) error {
+	body, err := ss.format.Format(e)
+	if err != nil {
+		return err
+	}
+
+	msg := ss.message(e, body)
+	if ss.network == "tcp" || ss.network == "unix" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	// retry once on a fresh connection
+	for attempt := 0; attempt < 2; attempt++ {
+		if ss.conn == nil {
+			if err = ss.dial(); err != nil {
+				continue
+			}
+		}
+
+		ss.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err = ss.conn.Write(msg); err == nil {
+			return nil
+		}
+
+		ss.conn.Close()
+		ss.conn = nil
+	}
+
+	return err
+}
+
+// Close implements Sink
+func (ss *SyslogSink) Close() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if ss.conn == nil {
+		return nil
+	}
+
+	err := ss.conn.Close()
+	ss.conn = nil
+
+	return err
+}
@@ -0,0 +1,104 @@
+package evt
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSyslogSinkFraming(t *testing.T) {
+	octetCounted := regexp.MustCompile(`^\d+ <`)
+
+	tests := []struct {
+		network string
+		counted bool
+	}{
+		{network: "udp", counted: false},
+		{network: "unixgram", counted: false},
+		{network: "tcp", counted: true},
+		{network: "unix", counted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			address, read := syslogReceiver(t, tt.network)
+
+			ss, err := NewSyslogSink(tt.network, address, 0, "", JSONFormatter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ss.Close()
+
+			if err := ss.Write(&Event{ID: "e", Time: time.Now(), Rule: Rule{Group: "urlBan", Severity: SeverityHigh}}); err != nil {
+				t.Fatal(err)
+			}
+
+			msg := read()
+			if got := octetCounted.Match(msg); got != tt.counted {
+				t.Errorf("octet counted %t, want %t: %q", got, tt.counted, msg)
+			}
+			// local0 and error severity
+			if !bytes.Contains(msg, []byte("<131>1 ")) {
+				t.Errorf("got %q, want priority 131", msg)
+			}
+		})
+	}
+}
+
+// syslogReceiver listens on network and returns its address and a
+// function reading the first message
+func syslogReceiver(t *testing.T, network string) (string, func() []byte) {
+	t.Helper()
+
+	buf := make([]byte, 4096)
+	deadline := time.Now().Add(5 * time.Second)
+
+	switch network {
+	case "udp", "unixgram":
+		address := "127.0.0.1:0"
+		if network == "unixgram" {
+			address = filepath.Join(t.TempDir(), "log.sock")
+		}
+		pc, err := net.ListenPacket(network, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+
+		return pc.LocalAddr().String(), func() []byte {
+			pc.SetReadDeadline(deadline)
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return buf[:n]
+		}
+	}
+
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(t.TempDir(), "log.sock")
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	return ln.Addr().String(), func() []byte {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(deadline)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/txn2/n2proxy/sec"
+)
+
+// gencert implements the gencert subcommand, writing a development CA
+// and a certificate signed by it
+func gencert(args []string) int {
+	fs := flag.NewFlagSet("gencert", flag.ExitOnError)
+	dir := fs.String("dir", getEnv("CERT_DIR", "./certs"), "directory the CA and certificate are written to.")
+	hosts := fs.String("hosts", getEnv("CERT_HOSTS", strings.Join(sec.DefaultSelfSignedHosts, ",")), "comma separated DNS names and IP addresses of the certificate.")
+	validity := fs.Duration("validity", 397*24*time.Hour, "certificate validity, the CA lasts ten times as long.")
+	fs.Parse(args)
+
+	generated, err := sec.GenerateSelfSigned(sec.SelfSignedCfg{
+		Dir:      *dir,
+		Hosts:    splitHosts(*hosts),
+		Validity: *validity,
+	})
+	if err != nil {
+		fmt.Printf("Error generating certificate: %s\n", err.Error())
+		return 1
+	}
+
+	fmt.Printf("CA:          %s\n", generated.CA)
+	fmt.Printf("Certificate: %s\n", generated.Cert)
+	fmt.Printf("Key:         %s\n", generated.Key)
+	if generated.RenewedCA {
+		fmt.Printf("The CA was about to expire and was replaced, clients must trust %s again.\n", generated.CA)
+	}
+	fmt.Printf("Run: n2proxy --tls --crt=%s --key=%s\n", generated.Cert, generated.Key)
+
+	return 0
+}
+
+// splitHosts parses a comma separated host list
+func splitHosts(hosts string) []string {
+	var list []string
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			list = append(list, host)
+		}
+	}
+	return list
+}
@@ -0,0 +1,189 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CheckCfg defines an active HTTP health check against a backend
+type CheckCfg struct {
+	Path               string        `yaml:"path"`
+	Host               string        `yaml:"host"` // Host header, default the backend host
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	HealthyThreshold   int           `yaml:"healthyThreshold"`
+	UnhealthyThreshold int           `yaml:"unhealthyThreshold"`
+}
+
+// Checker polls a backend and tracks whether it is healthy. The first
+// check sets the initial state; after that HealthyThreshold consecutive
+// passes or UnhealthyThreshold consecutive failures change it.
+type Checker struct {
+	cfg     CheckCfg
+	url     string
+	client  *http.Client
+	logger  *zap.Logger
+	mu      sync.RWMutex
+	checked bool
+	healthy bool
+	lastErr error
+	streak  int // consecutive results disagreeing with the current state
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewChecker instances a Checker for the backend at target. A nil
+// transport uses http.DefaultTransport.
+func NewChecker(target *url.URL, cfg CheckCfg, transport http.RoundTripper, logger *zap.Logger) *Checker {
+	if cfg.Path == "" {
+		cfg.Path = "/"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.HealthyThreshold < 1 {
+		cfg.HealthyThreshold = 2
+	}
+	if cfg.UnhealthyThreshold < 1 {
+		cfg.UnhealthyThreshold = 3
+	}
+
+	checkURL := *target
+	checkURL.Path = cfg.Path
+	checkURL.RawQuery = ""
+
+	return &Checker{
+		cfg: cfg,
+		url: checkURL.String(),
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   cfg.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		logger: logger.With(zap.String("Backend", target.String())),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start runs the first check and polls in the background until Stop
+func (c *Checker) Start() {
+	c.record(c.probe())
+
+	go func() {
+		defer close(c.done)
+
+		ticker := time.NewTicker(c.cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.record(c.probe())
+			}
+		}
+	}()
+}
+
+// Stop ends polling
+func (c *Checker) Stop() {
+	close(c.stop)
+	<-c.done
+}
+
+// Healthy reports the current state
+func (c *Checker) Healthy() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.healthy
+}
+
+// Check returns nil when healthy, otherwise the most recent failure. It
+// is suitable for Health.AddCheck.
+func (c *Checker) Check() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.healthy {
+		return nil
+	}
+	if c.lastErr != nil {
+		return c.lastErr
+	}
+	return fmt.Errorf("backend unhealthy")
+}
+
+// probe requests the health check path, 2xx and 3xx pass
+func (c *Checker) probe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+	if c.cfg.Host != "" {
+		req.Host = c.cfg.Host
+	}
+	req.Header.Set("User-Agent", "n2proxy-health-check")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// record applies a check result to the state
+func (c *Checker) record(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastErr = err
+	passed := err == nil
+
+	if !c.checked {
+		c.checked = true
+		c.healthy = passed
+		if !passed {
+			c.logger.Warn("Backend unhealthy: " + err.Error())
+		}
+		return
+	}
+
+	if passed == c.healthy {
+		c.streak = 0
+		return
+	}
+
+	c.streak++
+
+	if passed && c.streak >= c.cfg.HealthyThreshold {
+		c.healthy, c.streak = true, 0
+		c.logger.Info("Backend healthy")
+	}
+
+	if !passed && c.streak >= c.cfg.UnhealthyThreshold {
+		c.healthy, c.streak = false, 0
+		c.logger.Warn("Backend unhealthy: " + err.Error())
+	}
+}
@@ -0,0 +1,118 @@
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestCheckerThresholds(t *testing.T) {
+	failed := errors.New("failed")
+
+	// a result is a check outcome followed by the expected state
+	type result struct {
+		pass    bool
+		healthy bool
+	}
+
+	tests := []struct {
+		name    string
+		results []result
+	}{
+		{
+			name:    "first pass is healthy",
+			results: []result{{pass: true, healthy: true}},
+		},
+		{
+			name:    "first failure is unhealthy",
+			results: []result{{pass: false, healthy: false}},
+		},
+		{
+			name: "unhealthy after the threshold of failures",
+			results: []result{
+				{pass: true, healthy: true},
+				{pass: false, healthy: true},
+				{pass: false, healthy: true},
+				{pass: false, healthy: false},
+			},
+		},
+		{
+			name: "healthy after the threshold of passes",
+			results: []result{
+				{pass: false, healthy: false},
+				{pass: true, healthy: false},
+				{pass: true, healthy: true},
+			},
+		},
+		{
+			name: "an agreeing result resets the streak",
+			results: []result{
+				{pass: true, healthy: true},
+				{pass: false, healthy: true},
+				{pass: false, healthy: true},
+				{pass: true, healthy: true},
+				{pass: false, healthy: true},
+				{pass: false, healthy: true},
+				{pass: false, healthy: false},
+				{pass: true, healthy: false},
+				{pass: false, healthy: false},
+				{pass: true, healthy: false},
+				{pass: true, healthy: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewChecker(&url.URL{Scheme: "http", Host: "backend"}, CheckCfg{}, nil, zap.NewNop())
+
+			for i, r := range tt.results {
+				var err error
+				if !r.pass {
+					err = failed
+				}
+				c.record(err)
+
+				if got := c.Healthy(); got != r.healthy {
+					t.Fatalf("result %d: healthy %t, want %t", i, got, r.healthy)
+				}
+				if got := c.Check(); (got == nil) != r.healthy {
+					t.Fatalf("result %d: Check returned %v", i, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckerProbe(t *testing.T) {
+	var status int32 = http.StatusInternalServerError
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || r.URL.RawQuery != "" {
+			t.Errorf("checked %s", r.URL)
+		}
+		if r.Host != "app.example.com" {
+			t.Errorf("Host %q, want app.example.com", r.Host)
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer backend.Close()
+
+	target, _ := url.Parse(backend.URL + "/api?x=1")
+	c := NewChecker(target, CheckCfg{Path: "/health", Host: "app.example.com", HealthyThreshold: 1}, nil, zap.NewNop())
+
+	c.record(c.probe())
+	if err := c.Check(); err == nil || err.Error() != "health check returned 500 Internal Server Error" {
+		t.Errorf("Check returned %v", err)
+	}
+
+	atomic.StoreInt32(&status, http.StatusNoContent)
+	c.record(c.probe())
+	if err := c.Check(); err != nil {
+		t.Errorf("Check returned %v after a 204", err)
+	}
+}
@@ -0,0 +1,112 @@
+package health
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Default endpoint paths
+const (
+	DefaultLiveness  = "/healthz"
+	DefaultReadiness = "/readyz"
+)
+
+// Cfg defines the health endpoints and the active backend check
+type Cfg struct {
+	Liveness  string    `yaml:"liveness"`
+	Readiness string    `yaml:"readiness"`
+	Backend   *CheckCfg `yaml:"backend"` // nil disables backend checks
+}
+
+type check struct {
+	name string
+	fn   func() error
+}
+
+// Health serves liveness and readiness. Liveness only reports that the
+// process is serving; readiness runs every registered check.
+type Health struct {
+	mu     sync.RWMutex
+	checks []check
+}
+
+// New instances a Health with no readiness checks
+func New() *Health {
+	return &Health{checks: make([]check, 0)}
+}
+
+// AddCheck registers a readiness check, fn returns nil when ready
+func (h *Health) AddCheck(name string, fn func() error) {
+	h.mu.Lock()
+	h.checks = append(h.checks, check{name: name, fn: fn})
+	h.mu.Unlock()
+}
+
+// Live handles liveness probes
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, "ok", nil)
+}
+
+// Ready handles readiness probes, 503 when any check fails
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	status := http.StatusOK
+	results := make(map[string]string, len(h.checks))
+
+	for _, c := range h.checks {
+		if err := c.fn(); err != nil {
+			status = http.StatusServiceUnavailable
+			results[c.name] = err.Error()
+			continue
+		}
+		results[c.name] = "ok"
+	}
+
+	if status != http.StatusOK {
+		writeStatus(w, status, "unavailable", results)
+		return
+	}
+
+	writeStatus(w, status, "ok", results)
+}
+
+func writeStatus(w http.ResponseWriter, code int, status string, checks map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks,omitempty"`
+	}{status, checks})
+}
+
+// NewCfgFromYaml loads health configuration from yaml data
+func NewCfgFromYaml(filename string) (*Cfg, error) {
+
+	ymlData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Cfg{}
+
+	err = yaml.Unmarshal([]byte(ymlData), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Liveness == "" {
+		cfg.Liveness = DefaultLiveness
+	}
+	if cfg.Readiness == "" {
+		cfg.Readiness = DefaultReadiness
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/txn2/n2proxy/sec"
+)
+
+// http3Server serves HTTP/3 on its own QUIC transport, so connection
+// contexts exist before the TLS handshake as with http.Server.ConnContext
+type http3Server struct {
+	*http3.Server
+	fingerprint bool
+	tr          *quic.Transport
+	ln          *quic.EarlyListener
+}
+
+// newHTTP3Server instances a QUIC listener sharing the TLS listener
+// configuration and handler. With fingerprint, connections carry their
+// ClientHello fingerprint like TCP connections.
+func newHTTP3Server(addr string, tlsCfg *tls.Config, handler http.Handler, fingerprint bool) (*http3Server, error) {
+	if tlsCfg.MaxVersion != 0 && tlsCfg.MaxVersion < tls.VersionTLS13 {
+		return nil, errors.New("HTTP/3 requires TLS 1.3, raise the TLS max version")
+	}
+
+	return &http3Server{
+		Server: &http3.Server{
+			Addr:      addr,
+			Handler:   handler,
+			TLSConfig: tlsCfg,
+			// 0-RTT requests could be replayed past the rules, keep them off
+			QUICConfig: &quic.Config{Allow0RTT: false},
+		},
+		fingerprint: fingerprint,
+	}, nil
+}
+
+// listen binds the UDP address
+func (s *http3Server) listen() error {
+	addr, err := net.ResolveUDPAddr("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	s.tr = &quic.Transport{Conn: conn}
+	if s.fingerprint {
+		s.tr.ConnContext = func(ctx context.Context, _ *quic.ClientInfo) (context.Context, error) {
+			return sec.NewFingerprintContext(ctx), nil
+		}
+	}
+
+	s.ln, err = s.tr.ListenEarly(http3.ConfigureTLSConfig(s.TLSConfig), s.QUICConfig)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	return nil
+}
+
+// serve accepts QUIC connections until the server shuts down
+func (s *http3Server) serve() error {
+	return s.ServeListener(s.ln)
+}
+
+// Shutdown drains connections, then releases the UDP socket
+func (s *http3Server) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+	if s.tr != nil {
+		s.tr.Close()
+		s.tr.Conn.Close()
+	}
+	return err
+}
+
+// altSvc advertises the HTTP/3 listener on TCP responses
+func altSvc(h3 *http3Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/txn2/n2proxy/sec"
+)
+
+// testTLS returns a listener configuration for a generated localhost
+// certificate and a pool trusting its CA
+func testTLS(t *testing.T) (*tls.Config, *x509.CertPool) {
+	t.Helper()
+
+	generated, err := sec.GenerateSelfSigned(sec.SelfSignedCfg{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(generated.Cert, generated.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := ioutil.ReadFile(generated.CA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, roots
+}
+
+func TestNewHTTP3ServerRequiresTLS13(t *testing.T) {
+	tlsCfg, _ := testTLS(t)
+	tlsCfg.MaxVersion = tls.VersionTLS12
+
+	if _, err := newHTTP3Server("127.0.0.1:0", tlsCfg, http.NotFoundHandler(), false); err == nil {
+		t.Error("HTTP/3 server created with TLS 1.2 max version")
+	}
+}
+
+func TestAltSvc(t *testing.T) {
+	tlsCfg, roots := testTLS(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+
+	h3, err := newHTTP3Server("127.0.0.1:0", tlsCfg, handler, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is advertised before the QUIC listener serves
+	rec := httptest.NewRecorder()
+	altSvc(h3, handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := rec.Header().Get("Alt-Svc"); got != "" {
+		t.Errorf("Alt-Svc %q before serving", got)
+	}
+	if rec.Body.String() != "HTTP/1.1" {
+		t.Errorf("handler wrote %q", rec.Body.String())
+	}
+
+	if err := h3.listen(); err != nil {
+		t.Skipf("no UDP listener: %v", err)
+	}
+	go h3.serve()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		h3.Shutdown(ctx)
+	}()
+
+	_, port, _ := net.SplitHostPort(h3.ln.Addr().String())
+	want := fmt.Sprintf(`h3=":%s"; ma=2592000`, port)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec = httptest.NewRecorder()
+		altSvc(h3, handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := rec.Header().Get("Alt-Svc"); got == want {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Alt-Svc %q, want %q", got, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the advertised port answers HTTP/3
+	tr := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	defer tr.Close()
+
+	resp, err := (&http.Client{Transport: tr, Timeout: 5 * time.Second}).Get("https://127.0.0.1:" + port + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "HTTP/3.0" {
+		t.Errorf("served over %s, want HTTP/3.0", body)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/txn2/n2proxy/proxyproto"
+	"github.com/txn2/n2proxy/rweng"
+	"github.com/txn2/n2proxy/sec"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// unixPrefix marks a unix socket listener address
+const unixPrefix = "unix:"
+
+// ListenCfg lists the listeners served by one process
+type ListenCfg struct {
+	Listeners []ListenerCfg `yaml:"listeners"`
+}
+
+// ListenerCfg defines a listener
+type ListenerCfg struct {
+	Name string `yaml:"name"`
+	// Address is host:port, [ipv6]:port, :port or unix:/path/to.sock
+	Address string `yaml:"address"`
+	// SocketMode sets unix socket permissions, e.g. 0660
+	SocketMode os.FileMode `yaml:"socketMode"`
+	// TLS serves HTTPS, configured by TLSCfg or --tlsCfg, --crt and --key
+	TLS    bool   `yaml:"tls"`
+	TLSCfg string `yaml:"tlsCfg"`
+	// Rules is the rule configuration, defaults to --cfg
+	Rules string `yaml:"rules"`
+	// Redirect answers requests, other than health checks, with a
+	// redirect to HTTPS on RedirectPort, default 443
+	Redirect     bool   `yaml:"redirect"`
+	RedirectPort string `yaml:"redirectPort"`
+	// HTTP3 serves QUIC on HTTP3Port, defaults to the listener port
+	HTTP3     bool   `yaml:"http3"`
+	HTTP3Port string `yaml:"http3Port"`
+	// ProxyProtocol reads client addresses from PROXY protocol headers
+	// sent by trusted load balancers
+	ProxyProtocol *proxyproto.Cfg `yaml:"proxyProtocol"`
+}
+
+// unix reports whether the listener is a unix socket
+func (lc ListenerCfg) unix() bool {
+	return strings.HasPrefix(lc.Address, unixPrefix)
+}
+
+// validate checks a listener for conflicting options
+func (lc ListenerCfg) validate() error {
+	if lc.Address == "" {
+		return errors.New("address is required")
+	}
+	if !lc.unix() {
+		if _, port, err := net.SplitHostPort(lc.Address); err != nil || port == "" {
+			return fmt.Errorf("address %s: expected host:port or %s/path", lc.Address, unixPrefix)
+		}
+	}
+	if lc.Redirect && lc.TLS {
+		return errors.New("redirect applies to plain HTTP listeners")
+	}
+	if lc.Redirect && lc.Rules != "" {
+		return errors.New("redirect listeners do not apply rules")
+	}
+	if lc.HTTP3 && !lc.TLS {
+		return errors.New("http3 requires tls")
+	}
+	if lc.HTTP3 && lc.unix() {
+		return errors.New("http3 requires a UDP address")
+	}
+	if lc.ProxyProtocol != nil {
+		if len(lc.ProxyProtocol.Trusted) == 0 && !lc.unix() {
+			return errors.New("proxyProtocol requires trusted sources")
+		}
+		if err := lc.ProxyProtocol.Validate(); err != nil {
+			return fmt.Errorf("proxyProtocol: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// NewListenCfgFromYaml loads listener configuration, listeners without
+// a name are numbered
+func NewListenCfgFromYaml(filename string) (*ListenCfg, error) {
+	ymlData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &ListenCfg{}
+	err = yaml.Unmarshal(ymlData, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Listeners) == 0 {
+		return nil, fmt.Errorf("no listeners in %s", filename)
+	}
+
+	names := make(map[string]bool, len(cfg.Listeners))
+	for i := range cfg.Listeners {
+		lc := &cfg.Listeners[i]
+		if lc.Name == "" {
+			lc.Name = "listener-" + strconv.Itoa(i+1)
+		}
+		if names[lc.Name] {
+			return nil, fmt.Errorf("duplicate listener name %s", lc.Name)
+		}
+		names[lc.Name] = true
+
+		if err := lc.validate(); err != nil {
+			return nil, fmt.Errorf("listener %s: %s", lc.Name, err.Error())
+		}
+	}
+
+	return cfg, nil
+}
+
+// listenerTLS is the TLS state of a listener, shared by listeners with
+// the same TLS configuration
+type listenerTLS struct {
+	cfg        *tls.Config
+	clientAuth *sec.ClientAuth
+	certs      *sec.Certificates
+	tickets    *sec.SessionTickets
+}
+
+// loadListenerTLS builds a TLS configuration from a tls.yml, or the
+// generic one when tlsCfgFile is empty, serving certCfgs unless the
+// file lists certificates
+func loadListenerTLS(tlsCfgFile string, certCfgs []sec.CertCfg, certOpts sec.CertOptions, fingerprint bool, logger *zap.Logger) (*listenerTLS, error) {
+	lt := &listenerTLS{cfg: sec.GenericTLSConfig()}
+
+	if tlsCfgFile == "" {
+		logger.Warn("No TLS configuration specified, using default.")
+	}
+
+	if tlsCfgFile != "" {
+		logger.Info("Loading TLS configuration from " + tlsCfgFile)
+		tlsPreferences, err := sec.NewTLSPreferencesFromYaml(tlsCfgFile)
+		if err != nil {
+			return nil, err
+		}
+		lt.cfg, err = tlsPreferences.Config(logger)
+		if err != nil {
+			return nil, err
+		}
+
+		if tlsPreferences.ClientAuth != nil {
+			lt.clientAuth, err = sec.NewClientAuth(*tlsPreferences.ClientAuth, logger)
+			if err != nil {
+				return nil, fmt.Errorf("client certificates: %s", err.Error())
+			}
+			lt.clientAuth.Apply(lt.cfg)
+		}
+
+		if tlsPreferences.SessionTickets != nil {
+			lt.tickets, err = sec.NewSessionTickets(*tlsPreferences.SessionTickets, lt.cfg, logger)
+			if err != nil {
+				return nil, fmt.Errorf("session tickets: %s", err.Error())
+			}
+		}
+
+		if len(tlsPreferences.Certificates) > 0 {
+			certCfgs = tlsPreferences.Certificates
+		}
+		certOpts.Reload = tlsPreferences.CertReload
+		certOpts.ExpiryWarning = tlsPreferences.ExpiryWarning
+		certOpts.OCSPStapling = tlsPreferences.OCSPStapling
+	}
+
+	certs, err := sec.NewCertificates(certCfgs, certOpts, logger)
+	if err != nil {
+		return nil, fmt.Errorf("certificates: %s", err.Error())
+	}
+	lt.certs = certs
+	lt.cfg.GetCertificate = certs.GetCertificate
+
+	if fingerprint {
+		lt.cfg.GetConfigForClient = sec.FingerprintClientHello
+	}
+
+	return lt, nil
+}
+
+// Start begins certificate, CRL and session ticket key reloads
+func (lt *listenerTLS) Start() {
+	lt.certs.Start()
+	if lt.clientAuth != nil {
+		lt.clientAuth.Start()
+	}
+	if lt.tickets != nil {
+		lt.tickets.Start()
+	}
+}
+
+// Stop ends certificate, CRL and session ticket key reloads
+func (lt *listenerTLS) Stop() {
+	lt.certs.Stop()
+	if lt.clientAuth != nil {
+		lt.clientAuth.Stop()
+	}
+	if lt.tickets != nil {
+		lt.tickets.Stop()
+	}
+}
+
+// listener is a configured listener and its servers
+type listener struct {
+	cfg ListenerCfg
+	eng *rweng.Eng   // rules, nil for redirect listeners
+	tls *listenerTLS // nil without TLS
+	srv *http.Server
+	h3  *http3Server
+	ln  net.Listener
+}
+
+// clientAuth returns the listener's client certificate identities, nil
+// when it does not verify client certificates
+func (l *listener) clientAuth() *sec.ClientAuth {
+	if l.tls == nil {
+		return nil
+	}
+	return l.tls.clientAuth
+}
+
+// listen binds the listener address and reads PROXY protocol headers
+// when configured
+func (l *listener) listen(logger *zap.Logger) error {
+	ln, err := l.bind()
+	if err != nil {
+		return err
+	}
+
+	if l.h3 != nil {
+		if err := l.h3.listen(); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	if l.cfg.ProxyProtocol != nil {
+		ln, err = proxyproto.NewListener(ln, *l.cfg.ProxyProtocol, logger)
+		if err != nil {
+			return err
+		}
+	}
+	l.ln = ln
+
+	return nil
+}
+
+// bind listens on the address, replacing a stale unix socket
+func (l *listener) bind() (net.Listener, error) {
+	if !l.cfg.unix() {
+		return net.Listen("tcp", l.cfg.Address)
+	}
+
+	path := strings.TrimPrefix(l.cfg.Address, unixPrefix)
+
+	// a socket left by a process that did not shut down cleanly
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s is in use", path)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if l.cfg.SocketMode != 0 {
+		if err := os.Chmod(path, l.cfg.SocketMode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	return ln, nil
+}
+
+// serve accepts connections until the server shuts down
+func (l *listener) serve() error {
+	if l.tls == nil {
+		return l.srv.Serve(l.ln)
+	}
+	// certificates come from tls.Config.GetCertificate
+	return l.srv.ServeTLS(l.ln, "", "")
+}
+
+// shutdown drains the TCP and QUIC servers together
+func (l *listener) shutdown(ctx context.Context) error {
+	h3Done := make(chan error, 1)
+	if l.h3 != nil {
+		// QUIC connections of departed clients only close on idle
+		// timeout, drain them alongside the TCP listener
+		go func() {
+			h3Done <- l.h3.Shutdown(ctx)
+		}()
+	}
+
+	err := l.srv.Shutdown(ctx)
+	if err != nil {
+		l.srv.Close()
+	}
+
+	if l.h3 != nil {
+		if h3Err := <-h3Done; h3Err != nil && err == nil {
+			err = h3Err
+		}
+	}
+
+	return err
+}
+
+// redirectHTTPS sends clients to the same host and path over HTTPS
+func redirectHTTPS(port string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		// 308 keeps the method and body of non-GET requests
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	}
+}
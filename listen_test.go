@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/txn2/n2proxy/proxyproto"
+)
+
+func TestListenerCfgValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   ListenerCfg
+		valid bool
+	}{
+		{name: "tcp", cfg: ListenerCfg{Address: ":8080"}, valid: true},
+		{name: "ipv6", cfg: ListenerCfg{Address: "[::]:8443", TLS: true, HTTP3: true}, valid: true},
+		{name: "unix", cfg: ListenerCfg{Address: "unix:/run/n2proxy.sock"}, valid: true},
+		{name: "redirect", cfg: ListenerCfg{Address: ":80", Redirect: true}, valid: true},
+		{name: "no address", cfg: ListenerCfg{}},
+		{name: "no port", cfg: ListenerCfg{Address: "localhost"}},
+		{name: "redirect with tls", cfg: ListenerCfg{Address: ":443", Redirect: true, TLS: true}},
+		{name: "redirect with rules", cfg: ListenerCfg{Address: ":80", Redirect: true, Rules: "cfg.yml"}},
+		{name: "http3 without tls", cfg: ListenerCfg{Address: ":8080", HTTP3: true}},
+		{name: "http3 on a unix socket", cfg: ListenerCfg{Address: "unix:/run/n2proxy.sock", TLS: true, HTTP3: true}},
+		{name: "proxy protocol without trusted sources", cfg: ListenerCfg{Address: ":8080", ProxyProtocol: &proxyproto.Cfg{}}},
+		{name: "proxy protocol on a unix socket", cfg: ListenerCfg{Address: "unix:/run/n2proxy.sock", ProxyProtocol: &proxyproto.Cfg{}}, valid: true},
+		{name: "proxy protocol with an invalid source", cfg: ListenerCfg{Address: ":8080", ProxyProtocol: &proxyproto.Cfg{Trusted: []string{"lb"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, want valid %t", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestBindUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "n2.sock")
+
+	// a socket left behind by a process that did not shut down cleanly
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+
+	l := &listener{cfg: ListenerCfg{Address: unixPrefix + path, SocketMode: 0660}}
+	ln, err := l.bind()
+	if err != nil {
+		t.Fatalf("bind over a stale socket: %v", err)
+	}
+	defer ln.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0660 {
+		t.Errorf("socket mode %o, want 660", mode)
+	}
+
+	// a socket in use is left alone
+	if other, err := l.bind(); err == nil {
+		other.Close()
+		t.Error("bind replaced a socket in use")
+	}
+}
+
+func TestBindKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "n2.sock")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &listener{cfg: ListenerCfg{Address: unixPrefix + path}}
+	if ln, err := l.bind(); err == nil {
+		ln.Close()
+		t.Fatal("bind replaced a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	tests := []struct {
+		name   string
+		port   string
+		host   string
+		target string
+		want   string
+		status int
+	}{
+		{name: "default port", host: "example.com", target: "/a/b?c=d", want: "https://example.com/a/b?c=d"},
+		{name: "port 443", port: "443", host: "example.com:80", target: "/", want: "https://example.com/"},
+		{name: "other port", port: "8443", host: "example.com:8080", target: "/x", want: "https://example.com:8443/x"},
+		{name: "ipv6", host: "[::1]:80", target: "/", want: "https://[::1]/"},
+		{name: "ipv6 other port", port: "8443", host: "[::1]:80", target: "/", want: "https://[::1]:8443/"},
+		{name: "no host", host: "", target: "/", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.target, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+
+			redirectHTTPS(tt.port)(w, r)
+
+			status := tt.status
+			if status == 0 {
+				status = http.StatusPermanentRedirect
+			}
+			if w.Code != status {
+				t.Fatalf("status %d, want %d", w.Code, status)
+			}
+			if got := w.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
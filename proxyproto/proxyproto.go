@@ -0,0 +1,327 @@
+// Package proxyproto accepts PROXY protocol v1 and v2 headers from
+// trusted load balancers, so connections report the client address
+// instead of the load balancer's.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// v2Signature starts every PROXY protocol v2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLen is the longest v1 header including CRLF
+const v1MaxLen = 107
+
+// ErrNoHeader is returned when a trusted source sends no header and
+// headers are required
+var ErrNoHeader = errors.New("missing PROXY protocol header")
+
+// Cfg configures PROXY protocol on a listener
+type Cfg struct {
+	// Trusted lists the load balancer addresses or CIDRs whose headers
+	// are accepted, other sources keep their own address
+	Trusted []string `yaml:"trusted"`
+	// Optional accepts trusted connections without a header
+	Optional bool `yaml:"optional"`
+	// Timeout for reading the header, default 5s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Listener parses PROXY protocol headers on accepted connections
+type Listener struct {
+	net.Listener
+	trusted  []*net.IPNet
+	optional bool
+	timeout  time.Duration
+	logger   *zap.Logger
+}
+
+// NewListener wraps ln. Connections without an IP source, such as unix
+// sockets, are trusted.
+func NewListener(ln net.Listener, cfg Cfg, logger *zap.Logger) (*Listener, error) {
+	trusted, err := parseTrusted(cfg.Trusted)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+
+	return &Listener{
+		Listener: ln,
+		trusted:  trusted,
+		optional: cfg.Optional,
+		timeout:  cfg.Timeout,
+		logger:   logger,
+	}, nil
+}
+
+// Validate checks the trusted sources
+func (cfg Cfg) Validate() error {
+	_, err := parseTrusted(cfg.Trusted)
+	return err
+}
+
+// parseTrusted accepts CIDRs and single addresses
+func parseTrusted(trusted []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(trusted))
+	for _, t := range trusted {
+		if !strings.Contains(t, "/") {
+			ip := net.ParseIP(t)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted address %s", t)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted CIDR %s", t)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// trusts reports whether a source may send a header
+func (l *Listener) trusts(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, n := range l.trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept returns the next connection, its header is read on first use
+// so slow clients do not hold up the listener
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.trusts(c.RemoteAddr()) {
+		return c, nil
+	}
+
+	return &Conn{
+		Conn:     c,
+		br:       bufio.NewReaderSize(c, 256),
+		optional: l.optional,
+		timeout:  l.timeout,
+		logger:   l.logger,
+	}, nil
+}
+
+// Conn is a connection from a trusted source, reporting the addresses
+// in its PROXY protocol header
+type Conn struct {
+	net.Conn
+	once     sync.Once
+	br       *bufio.Reader
+	src      net.Addr
+	dst      net.Addr
+	err      error
+	optional bool
+	timeout  time.Duration
+	logger   *zap.Logger
+}
+
+// init reads the header once
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.src, c.dst, c.err = readHeader(c.br, c.optional)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		if c.err != nil {
+			c.logger.Warn("PROXY protocol header rejected",
+				zap.String("RemoteAddr", c.Conn.RemoteAddr().String()),
+				zap.Error(c.err),
+			)
+		}
+	})
+}
+
+// Read returns data after the header
+func (c *Conn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	// bytes read past the header are in the buffer
+	if c.br.Buffered() > 0 {
+		return c.br.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr is the client address from the header
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr is the address the client connected to from the header
+func (c *Conn) LocalAddr() net.Addr {
+	c.init()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half closes TCP connections, see net.TCPConn
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// readHeader parses a v1 or v2 header. Nil addresses keep the
+// connection's own, as for v2 LOCAL and v1 UNKNOWN health checks.
+func readHeader(br *bufio.Reader, optional bool) (net.Addr, net.Addr, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch first[0] {
+	case 'P':
+		if prefix, err := br.Peek(6); err == nil && string(prefix) == "PROXY " {
+			return readV1(br)
+		}
+	case '\r':
+		if sig, err := br.Peek(len(v2Signature)); err == nil && bytes.Equal(sig, v2Signature) {
+			return readV2(br)
+		}
+	}
+
+	if optional {
+		return nil, nil, nil
+	}
+	return nil, nil, ErrNoHeader
+}
+
+// readV1 parses "PROXY TCP4 src dst sport dport\r\n"
+func readV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	line, err := br.ReadSlice('\n')
+	if err != nil || len(line) > v1MaxLen {
+		return nil, nil, errors.New("PROXY v1 header too long")
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("PROXY v1 header must end with CRLF")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+
+	src, err := tcpAddr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := tcpAddr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+func tcpAddr(host string, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return nil, fmt.Errorf("invalid PROXY v1 address %s", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 port %s", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 parses the binary header, TLVs are skipped
+func readV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	command := hdr[12] & 0x0f
+	family := hdr[13]
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL is sent by the load balancer itself, e.g. health checks
+	if command == 0x0 {
+		return nil, nil, nil
+	}
+	if command != 0x1 {
+		return nil, nil, fmt.Errorf("unsupported PROXY v2 command %d", command)
+	}
+
+	var size int
+	switch family {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		// UDP, unix and unspecified sources have no TCP client address
+		return nil, nil, nil
+	}
+
+	if len(body) < 2*size+4 {
+		return nil, nil, errors.New("PROXY v2 address block too short")
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, body[:size]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*size:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, body[size:2*size]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*size+2:])),
+	}
+
+	return src, dst, nil
+}
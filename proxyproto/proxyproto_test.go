@@ -0,0 +1,341 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// v2Header builds a v2 header, addrs holds the address block
+func v2Header(command byte, family byte, addrs []byte) []byte {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(b[14:16], uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func v4Addrs() []byte {
+	return []byte{
+		192, 0, 2, 10, // source
+		198, 51, 100, 1, // destination
+		0x30, 0x39, // 12345
+		0x01, 0xbb, // 443
+	}
+}
+
+func v6Addrs() []byte {
+	b := make([]byte, 36)
+	copy(b, net.ParseIP("2001:db8::10"))
+	copy(b[16:], net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(b[32:], 12345)
+	binary.BigEndian.PutUint16(b[34:], 443)
+	return b
+}
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []byte
+		optional bool
+		src      string // empty for nil
+		dst      string
+		err      bool
+		rest     string // data after the header
+	}{
+		{
+			name:  "v1 tcp4",
+			input: []byte("PROXY TCP4 192.0.2.10 198.51.100.1 12345 443\r\nGET / HTTP/1.1\r\n"),
+			src:   "192.0.2.10:12345",
+			dst:   "198.51.100.1:443",
+			rest:  "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:  "v1 tcp6",
+			input: []byte("PROXY TCP6 2001:db8::10 2001:db8::1 12345 443\r\n"),
+			src:   "[2001:db8::10]:12345",
+			dst:   "[2001:db8::1]:443",
+		},
+		{
+			name:  "v1 unknown",
+			input: []byte("PROXY UNKNOWN\r\nGET"),
+			rest:  "GET",
+		},
+		{
+			name:  "v1 at the length limit",
+			input: []byte("PROXY UNKNOWN " + strings.Repeat("x", v1MaxLen-len("PROXY UNKNOWN ")-2) + "\r\n"),
+		},
+		{
+			name:  "v1 over the length limit",
+			input: []byte("PROXY UNKNOWN " + strings.Repeat("x", v1MaxLen-len("PROXY UNKNOWN ")-1) + "\r\n"),
+			err:   true,
+		},
+		{
+			name:  "v1 without a line end",
+			input: []byte("PROXY TCP4 192.0.2.10 198.51.100.1 12345 443"),
+			err:   true,
+		},
+		{
+			name:  "v1 without CR",
+			input: []byte("PROXY TCP4 192.0.2.10 198.51.100.1 12345 443\n"),
+			err:   true,
+		},
+		{
+			name:  "v1 missing fields",
+			input: []byte("PROXY TCP4 192.0.2.10 198.51.100.1 12345\r\n"),
+			err:   true,
+		},
+		{
+			name:  "v1 family mismatch",
+			input: []byte("PROXY TCP4 2001:db8::10 198.51.100.1 12345 443\r\n"),
+			err:   true,
+		},
+		{
+			name:  "v1 port out of range",
+			input: []byte("PROXY TCP4 192.0.2.10 198.51.100.1 65536 443\r\n"),
+			err:   true,
+		},
+		{
+			name:  "v2 tcp4",
+			input: append(v2Header(0x1, 0x11, v4Addrs()), "GET"...),
+			src:   "192.0.2.10:12345",
+			dst:   "198.51.100.1:443",
+			rest:  "GET",
+		},
+		{
+			name:  "v2 tcp6",
+			input: v2Header(0x1, 0x21, v6Addrs()),
+			src:   "[2001:db8::10]:12345",
+			dst:   "[2001:db8::1]:443",
+		},
+		{
+			name:  "v2 tlvs skipped",
+			input: append(v2Header(0x1, 0x11, append(v4Addrs(), 0x04, 0x00, 0x01, 0xff)), "GET"...),
+			src:   "192.0.2.10:12345",
+			dst:   "198.51.100.1:443",
+			rest:  "GET",
+		},
+		{
+			name:  "v2 local",
+			input: append(v2Header(0x0, 0x00, nil), "GET"...),
+			rest:  "GET",
+		},
+		{
+			name:  "v2 unix family keeps the connection address",
+			input: v2Header(0x1, 0x31, make([]byte, 216)),
+		},
+		{
+			name:  "v2 address block too short",
+			input: v2Header(0x1, 0x11, v4Addrs()[:11]),
+			err:   true,
+		},
+		{
+			name:  "v2 length past the data",
+			input: v2Header(0x1, 0x11, v4Addrs())[:20],
+			err:   true,
+		},
+		{
+			name:  "v2 truncated fixed header",
+			input: v2Header(0x1, 0x11, v4Addrs())[:14],
+			err:   true,
+		},
+		{
+			name: "v2 unsupported version",
+			input: func() []byte {
+				b := v2Header(0x1, 0x11, v4Addrs())
+				b[12] = 0x31
+				return b
+			}(),
+			err: true,
+		},
+		{
+			name:  "v2 unsupported command",
+			input: v2Header(0x2, 0x11, v4Addrs()),
+			err:   true,
+		},
+		{
+			name:  "no header",
+			input: []byte("GET / HTTP/1.1\r\n"),
+			err:   true,
+		},
+		{
+			name:     "no header optional",
+			input:    []byte("GET / HTTP/1.1\r\n"),
+			optional: true,
+			rest:     "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:     "partial signature optional",
+			input:    []byte("\r\n\r\nGET"),
+			optional: true,
+			rest:     "\r\n\r\nGET",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReaderSize(bytes.NewReader(tt.input), 256)
+			src, dst, err := readHeader(br, tt.optional)
+
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %v %v, want an error", src, dst)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := addrString(src); got != tt.src {
+				t.Errorf("source %s, want %s", got, tt.src)
+			}
+			if got := addrString(dst); got != tt.dst {
+				t.Errorf("destination %s, want %s", got, tt.dst)
+			}
+
+			rest, _ := io.ReadAll(br)
+			if string(rest) != tt.rest {
+				t.Errorf("remaining data %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestParseTrusted(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		addr    string
+		want    bool
+		err     bool
+	}{
+		{name: "single ipv4", trusted: []string{"10.0.0.1"}, addr: "10.0.0.1", want: true},
+		{name: "other ipv4", trusted: []string{"10.0.0.1"}, addr: "10.0.0.2", want: false},
+		{name: "cidr", trusted: []string{"10.0.0.0/8"}, addr: "10.1.2.3", want: true},
+		{name: "single ipv6", trusted: []string{"2001:db8::1"}, addr: "2001:db8::1", want: true},
+		{name: "ipv6 cidr", trusted: []string{"2001:db8::/32"}, addr: "2001:db8:1::1", want: true},
+		{name: "invalid address", trusted: []string{"10.0.0"}, err: true},
+		{name: "invalid cidr", trusted: []string{"10.0.0.0/33"}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := NewListener(nil, Cfg{Trusted: tt.trusted}, zap.NewNop())
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			addr := &net.TCPAddr{IP: net.ParseIP(tt.addr), Port: 1234}
+			if got := ln.trusts(addr); got != tt.want {
+				t.Errorf("trusts(%s) = %t, want %t", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConn(t *testing.T) {
+	tests := []struct {
+		name     string
+		trusted  []string
+		optional bool
+		send     string
+		remote   string // empty keeps the connection address
+		readErr  bool
+	}{
+		{
+			name:    "trusted with header",
+			trusted: []string{"127.0.0.1"},
+			send:    "PROXY TCP4 192.0.2.10 198.51.100.1 12345 443\r\nping",
+			remote:  "192.0.2.10:12345",
+		},
+		{
+			name:    "untrusted header is data",
+			trusted: []string{"192.0.2.1"},
+			send:    "PROXY TCP4 192.0.2.10 198.51.100.1 12345 443\r\nping",
+		},
+		{
+			name:    "trusted without header",
+			trusted: []string{"127.0.0.1"},
+			send:    "ping",
+			readErr: true,
+		},
+		{
+			name:     "trusted without header optional",
+			trusted:  []string{"127.0.0.1"},
+			optional: true,
+			send:     "ping",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln, err := NewListener(inner, Cfg{Trusted: tt.trusted, Optional: tt.optional, Timeout: time.Second}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if _, err := client.Write([]byte(tt.send)); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			want := tt.remote
+			if want == "" {
+				want = client.LocalAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != want {
+				t.Errorf("remote address %s, want %s", got, want)
+			}
+
+			buf := make([]byte, 256)
+			n, err := conn.Read(buf)
+			if tt.readErr {
+				if err == nil {
+					t.Errorf("read %q, want an error", buf[:n])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf[:n]); !strings.HasSuffix(got, "ping") {
+				t.Errorf("read %q, want the data after the header", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const mask = "****"
+
+var (
+	// DefaultFields are masked by name when no fields are configured
+	DefaultFields = []string{
+		"password",
+		"passwd",
+		"secret",
+		"token",
+		"access_token",
+		"refresh_token",
+		"api_key",
+		"apikey",
+		"authorization",
+		"cookie",
+	}
+
+	// Detectors are the named patterns available to detect
+	Detectors = []string{"creditCard", "ssn", "email"}
+
+	creditCardRgx = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+	ssnRgx        = regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)
+	emailRgx      = regexp.MustCompile(`([a-zA-Z0-9._%+\-]+)@([a-zA-Z0-9.\-]+\.[a-zA-Z]{2,})`)
+)
+
+// Cfg defines redaction applied to anything logged from a request
+type Cfg struct {
+	// MaxFragment truncates logged fragments, 0 uses the default of 128
+	MaxFragment int `yaml:"maxFragment"`
+	// Fields are masked by name in query strings, form and JSON bodies
+	Fields []string `yaml:"fields"`
+	// Detect lists the patterns to mask: creditCard, ssn, email
+	Detect []string `yaml:"detect"`
+	// LogBodies logs full (masked) bodies, for debugging only
+	LogBodies bool `yaml:"logBodies"`
+}
+
+// Redactor masks sensitive data before it is logged
+type Redactor struct {
+	maxFragment int
+	logBodies   bool
+	fieldRgx    *regexp.Regexp
+	creditCard  bool
+	ssn         bool
+	email       bool
+}
+
+// New instances a Redactor. Unset fields and detectors fall back to
+// DefaultFields and all Detectors.
+func New(cfg Cfg) (*Redactor, error) {
+	rd := &Redactor{
+		maxFragment: cfg.MaxFragment,
+		logBodies:   cfg.LogBodies,
+	}
+
+	if rd.maxFragment == 0 {
+		rd.maxFragment = 128
+	}
+
+	fields := cfg.Fields
+	if fields == nil {
+		fields = DefaultFields
+	}
+
+	if len(fields) > 0 {
+		quoted := make([]string, 0, len(fields))
+		for _, f := range fields {
+			quoted = append(quoted, regexp.QuoteMeta(f))
+		}
+
+		// name=value, "name": "value", name: value
+		rgx, err := regexp.Compile(`(?i)("?\b(?:` + strings.Join(quoted, "|") + `)\b"?\s*[:=]\s*"?)((?:(?:bearer|basic|digest)\s+)?[^"&\s,;}]+)`)
+		if err != nil {
+			return nil, err
+		}
+		rd.fieldRgx = rgx
+	}
+
+	detect := cfg.Detect
+	if detect == nil {
+		detect = Detectors
+	}
+
+	for _, d := range detect {
+		switch d {
+		case "creditCard":
+			rd.creditCard = true
+		case "ssn":
+			rd.ssn = true
+		case "email":
+			rd.email = true
+		default:
+			return nil, fmt.Errorf("unknown redaction detector: %s", d)
+		}
+	}
+
+	return rd, nil
+}
+
+// Mask masks configured fields and detected patterns in b.
+func (rd *Redactor) Mask(b []byte) []byte {
+	if rd.fieldRgx != nil {
+		b = rd.fieldRgx.ReplaceAll(b, []byte("${1}"+mask))
+	}
+
+	if rd.creditCard {
+		b = creditCardRgx.ReplaceAllFunc(b, maskCard)
+	}
+
+	if rd.ssn {
+		b = ssnRgx.ReplaceAll(b, []byte("***-**-****"))
+	}
+
+	if rd.email {
+		b = emailRgx.ReplaceAll(b, []byte(mask+"@${2}"))
+	}
+
+	return b
+}
+
+// Fragment masks and truncates a matched fragment for logging.
+func (rd *Redactor) Fragment(b []byte) string {
+	return rd.truncate(rd.Mask(b))
+}
+
+// URI masks a request URI, query values of configured fields and
+// detected patterns, without truncating it.
+func (rd *Redactor) URI(uri string) string {
+	return string(rd.Mask([]byte(uri)))
+}
+
+// Body returns a loggable representation of a request body. Unless
+// LogBodies is enabled only the length is reported.
+func (rd *Redactor) Body(b []byte) string {
+	if !rd.logBodies {
+		return fmt.Sprintf("[%d bytes redacted]", len(b))
+	}
+
+	return string(rd.Mask(b))
+}
+
+func (rd *Redactor) truncate(b []byte) string {
+	if rd.maxFragment < 0 || len(b) <= rd.maxFragment {
+		return string(b)
+	}
+
+	return string(b[:rd.maxFragment]) + "...[truncated]"
+}
+
+// maskCard masks a card number keeping the last four digits. Digit runs
+// that fail the Luhn check are left as is.
+func maskCard(b []byte) []byte {
+	digits := make([]byte, 0, len(b))
+	for _, c := range b {
+		if c >= '0' && c <= '9' {
+			digits = append(digits, c)
+		}
+	}
+
+	if len(digits) < 13 || len(digits) > 19 || !luhn(digits) {
+		return b
+	}
+
+	return []byte(strings.Repeat("*", len(digits)-4) + string(digits[len(digits)-4:]))
+}
+
+func luhn(digits []byte) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+
+	return sum%10 == 0
+}
@@ -0,0 +1,154 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMask(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Cfg
+		in   string
+		want string
+	}{
+		{
+			name: "query fields",
+			in:   "/login?user=bob&password=hunter2&token=abc",
+			want: "/login?user=bob&password=****&token=****",
+		},
+		{
+			name: "json fields",
+			in:   `{"user":"bob","api_key": "k-123","secret":"s"}`,
+			want: `{"user":"bob","api_key": "****","secret":"****"}`,
+		},
+		{
+			name: "authorization scheme",
+			in:   "Authorization: Bearer eyJhbGciOi",
+			want: "Authorization: ****",
+		},
+		{
+			name: "field names ignore case",
+			in:   "PassWord=x",
+			want: "PassWord=****",
+		},
+		{
+			name: "field names match whole words",
+			in:   "tokenizer=on",
+			want: "tokenizer=on",
+		},
+		{
+			name: "configured fields replace the defaults",
+			cfg:  Cfg{Fields: []string{"pin"}},
+			in:   "pin=1234&password=x",
+			want: "pin=****&password=x",
+		},
+		{
+			name: "credit card keeps the last four digits",
+			in:   "card 4111 1111 1111 1111 ok",
+			want: "card ************1111 ok",
+		},
+		{
+			name: "digits failing luhn are kept",
+			in:   "order 4111111111111112",
+			want: "order 4111111111111112",
+		},
+		{
+			name: "ssn",
+			in:   "ssn 078-05-1120",
+			want: "ssn ***-**-****",
+		},
+		{
+			name: "email keeps the domain",
+			in:   "from jane.doe@example.com",
+			want: "from ****@example.com",
+		},
+		{
+			name: "detectors off",
+			cfg:  Cfg{Fields: []string{}, Detect: []string{}},
+			in:   "password=x 078-05-1120 jane@example.com",
+			want: "password=x 078-05-1120 jane@example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd, err := New(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(rd.Mask([]byte(tt.in))); got != tt.want {
+				t.Errorf("Mask(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewUnknownDetector(t *testing.T) {
+	if _, err := New(Cfg{Detect: []string{"iban"}}); err == nil {
+		t.Error("expected an error for an unknown detector")
+	}
+}
+
+func TestFragment(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxFragment int
+		in          string
+		want        string
+	}{
+		{name: "short", maxFragment: 8, in: "abc", want: "abc"},
+		{name: "truncated", maxFragment: 8, in: "abcdefghij", want: "abcdefgh...[truncated]"},
+		{name: "masked before truncating", maxFragment: 14, in: "password=hunter2", want: "password=****"},
+		{name: "unlimited", maxFragment: -1, in: strings.Repeat("a", 200), want: strings.Repeat("a", 200)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd, err := New(Cfg{MaxFragment: tt.maxFragment})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rd.Fragment([]byte(tt.in)); got != tt.want {
+				t.Errorf("Fragment(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestURINotTruncated(t *testing.T) {
+	rd, err := New(Cfg{MaxFragment: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri := "/search?q=" + strings.Repeat("x", 50) + "&access_token=abc"
+	want := "/search?q=" + strings.Repeat("x", 50) + "&access_token=****"
+	if got := rd.URI(uri); got != want {
+		t.Errorf("URI(%q) = %q, want %q", uri, got, want)
+	}
+}
+
+func TestBody(t *testing.T) {
+	tests := []struct {
+		name      string
+		logBodies bool
+		in        string
+		want      string
+	}{
+		{name: "length only", in: "password=x", want: "[10 bytes redacted]"},
+		{name: "masked body", logBodies: true, in: "password=x", want: "password=****"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd, err := New(Cfg{LogBodies: tt.logBodies})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rd.Body([]byte(tt.in)); got != tt.want {
+				t.Errorf("Body(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package reqid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// DefaultHeader carries the request id to the backend and the client
+const DefaultHeader = "X-Request-Id"
+
+// maxLen bounds accepted request ids
+const maxLen = 128
+
+type ctxKey struct{}
+
+// New returns a random request id
+func New() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Valid reports whether an id received from a client is safe to accept
+// and log: at most 128 characters of [A-Za-z0-9._:-].
+func Valid(id string) bool {
+	if len(id) == 0 || len(id) > maxLen {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// NewContext returns a context carrying id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext returns the request id in ctx or an empty string
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
@@ -0,0 +1,59 @@
+package reqid
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want bool
+	}{
+		{name: "generated", id: New(), want: true},
+		{name: "uuid", id: "0f8fad5b-d9cb-469f-a165-70867728950e", want: true},
+		{name: "allowed punctuation", id: "lb-1.zone_a:42", want: true},
+		{name: "max length", id: strings.Repeat("a", 128), want: true},
+		{name: "empty", id: "", want: false},
+		{name: "too long", id: strings.Repeat("a", 129), want: false},
+		{name: "space", id: "abc def", want: false},
+		{name: "log injection", id: "abc\nlevel=error", want: false},
+		{name: "quote", id: `abc"`, want: false},
+		{name: "non ascii", id: "abcé", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Valid(tt.id); got != tt.want {
+				t.Errorf("Valid(%q) = %t, want %t", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := New()
+		if len(id) != 32 {
+			t.Fatalf("New() = %q, want 32 hex characters", id)
+		}
+		if seen[id] {
+			t.Fatalf("New() repeated %q", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestContext(t *testing.T) {
+	if got := FromContext(context.Background()); got != "" {
+		t.Errorf("FromContext without an id = %q, want empty", got)
+	}
+
+	ctx := NewContext(context.Background(), "abc")
+	if got := FromContext(ctx); got != "abc" {
+		t.Errorf("FromContext = %q, want abc", got)
+	}
+}
@@ -0,0 +1,116 @@
+package rweng
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Block denies all requests from a client IP
+type Block struct {
+	IP      string     `json:"ip"`
+	Reason  string     `json:"reason"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Blocks is a set of blocked client IPs
+type Blocks struct {
+	mu     sync.RWMutex
+	blocks map[string]Block
+}
+
+// NewBlocks instances an empty block list
+func NewBlocks() *Blocks {
+	return &Blocks{blocks: make(map[string]Block, 0)}
+}
+
+// Add blocks ip for ttl, or until cleared when ttl is 0
+func (b *Blocks) Add(ip string, reason string, ttl time.Duration) (Block, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return Block{}, &net.ParseError{Type: "IP address", Text: ip}
+	}
+
+	blk := Block{
+		IP:      parsed.String(),
+		Reason:  reason,
+		Created: time.Now().UTC(),
+	}
+
+	if ttl > 0 {
+		exp := blk.Created.Add(ttl)
+		blk.Expires = &exp
+	}
+
+	b.mu.Lock()
+	b.blocks[blk.IP] = blk
+	b.mu.Unlock()
+
+	return blk, nil
+}
+
+// Blocked returns the block for ip if one is in effect
+func (b *Blocks) Blocked(ip string) (Block, bool) {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+
+	b.mu.RLock()
+	blk, ok := b.blocks[ip]
+	b.mu.RUnlock()
+
+	if ok && blk.Expires != nil && time.Now().After(*blk.Expires) {
+		b.Remove(ip)
+		return Block{}, false
+	}
+
+	return blk, ok
+}
+
+// Remove clears the block on ip, reporting whether one existed
+func (b *Blocks) Remove(ip string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.blocks[ip]
+	delete(b.blocks, ip)
+
+	return ok
+}
+
+// Clear removes all blocks and returns how many were removed
+func (b *Blocks) Clear() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := len(b.blocks)
+	b.blocks = make(map[string]Block, 0)
+
+	return n
+}
+
+// List returns the blocks in effect ordered by IP
+func (b *Blocks) List() []Block {
+	now := time.Now()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	list := make([]Block, 0, len(b.blocks))
+	for _, blk := range b.blocks {
+		if blk.Expires != nil && now.After(*blk.Expires) {
+			continue
+		}
+		list = append(list, blk)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+
+	return list
+}
@@ -0,0 +1,139 @@
+package rweng
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// ErrExclusionNotFound is returned for an unknown or configured exclusion id
+var ErrExclusionNotFound = errors.New("exclusion not found")
+
+// ExclusionCfg skips a rule for requests whose path matches Path
+type ExclusionCfg struct {
+	// Rule is a rule id, or a group name to exclude every rule in it
+	Rule string `yaml:"rule" json:"rule"`
+	// Path is a regular expression matched against the request path
+	Path string `yaml:"path" json:"path"`
+}
+
+// Exclusion is a compiled ExclusionCfg
+type Exclusion struct {
+	ID      string    `json:"id"`
+	Rule    string    `json:"rule"`
+	Path    string    `json:"path"`
+	Runtime bool      `json:"runtime"`
+	Created time.Time `json:"created"`
+	rgx     *regexp.Regexp
+}
+
+// applies reports whether the exclusion skips rl for path
+func (ex *Exclusion) applies(rl *Rule, path string) bool {
+	return (ex.Rule == rl.ID || ex.Rule == rl.Group) && ex.rgx.MatchString(path)
+}
+
+func compileExclusion(id string, cfg ExclusionCfg) (*Exclusion, error) {
+	if cfg.Rule == "" || cfg.Path == "" {
+		return nil, errors.New("exclusions require a rule and a path")
+	}
+
+	rgx, err := regexp.Compile(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Exclusion{
+		ID:      id,
+		Rule:    cfg.Rule,
+		Path:    cfg.Path,
+		Created: time.Now().UTC(),
+		rgx:     rgx,
+	}, nil
+}
+
+// compileExclusions compiles the exclusions in a configuration file
+func compileExclusions(cfgs []ExclusionCfg) ([]*Exclusion, error) {
+	exclusions := make([]*Exclusion, 0)
+
+	for i, cfg := range cfgs {
+		ex, err := compileExclusion("exclusion-"+strconv.Itoa(i), cfg)
+		if err != nil {
+			return nil, err
+		}
+		exclusions = append(exclusions, ex)
+	}
+
+	return exclusions, nil
+}
+
+// excluded reports whether rl is skipped for path
+func (rs *ruleSet) excluded(rl *Rule, path string) bool {
+	for _, ex := range rs.exclusions {
+		if ex.applies(rl, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Exclusions returns the exclusions in effect
+func (e *Eng) Exclusions() []Exclusion {
+	rs := e.ruleSet()
+
+	list := make([]Exclusion, 0, len(rs.exclusions))
+	for _, ex := range rs.exclusions {
+		list = append(list, *ex)
+	}
+
+	return list
+}
+
+// AddExclusion adds a runtime exclusion. Runtime exclusions survive
+// configuration reloads; add them to the configuration file to keep
+// them across restarts.
+func (e *Eng) AddExclusion(cfg ExclusionCfg) (Exclusion, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.rules.find(cfg.Rule) == nil && e.rules.group(cfg.Rule) == nil && cfg.Rule != GroupFilter {
+		return Exclusion{}, ErrRuleNotFound
+	}
+
+	e.exclusionSeq++
+	ex, err := compileExclusion("runtime-"+strconv.Itoa(e.exclusionSeq), cfg)
+	if err != nil {
+		return Exclusion{}, err
+	}
+	ex.Runtime = true
+
+	rs := e.rules.clone()
+	rs.exclusions = append(rs.exclusions, ex)
+	e.rules = rs
+
+	return *ex, nil
+}
+
+// RemoveExclusion removes a runtime exclusion by id
+func (e *Eng) RemoveExclusion(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rs := e.rules.clone()
+	kept := make([]*Exclusion, 0, len(rs.exclusions))
+	for _, ex := range rs.exclusions {
+		if ex.ID == id && ex.Runtime {
+			continue
+		}
+		kept = append(kept, ex)
+	}
+
+	if len(kept) == len(rs.exclusions) {
+		return ErrExclusionNotFound
+	}
+
+	rs.exclusions = kept
+	e.rules = rs
+
+	return nil
+}
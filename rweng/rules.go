@@ -0,0 +1,217 @@
+package rweng
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/txn2/n2proxy/evt"
+)
+
+// Rule groups
+const (
+	GroupUrlWhiteList     = "urlWhiteList"
+	GroupPostBan          = "postBan"
+	GroupUrlBan           = "urlBan"
+	GroupQueryBan         = "queryBan"
+	GroupFilter           = "postFilter"
+	GroupClientBlock      = "clientBlock"
+	GroupIdentityBan      = "identityBan"
+	GroupFingerprintBan   = "fingerprintBan"
+	GroupFingerprintAllow = "fingerprintAllow"
+)
+
+// groupSeverity is the severity of events produced by each rule group
+var groupSeverity = map[string]evt.Severity{
+	GroupUrlWhiteList:     evt.SeverityLow,
+	GroupPostBan:          evt.SeverityHigh,
+	GroupUrlBan:           evt.SeverityHigh,
+	GroupQueryBan:         evt.SeverityHigh,
+	GroupFilter:           evt.SeverityMedium,
+	GroupClientBlock:      evt.SeverityMedium,
+	GroupIdentityBan:      evt.SeverityHigh,
+	GroupFingerprintBan:   evt.SeverityHigh,
+	GroupFingerprintAllow: evt.SeverityLow,
+}
+
+var (
+	// ErrRuleNotFound is returned for an unknown rule id
+	ErrRuleNotFound = errors.New("rule not found")
+	// ErrRuleGroup is returned when a rule can not be added to a group
+	ErrRuleGroup = errors.New("temporary rules must be in urlWhiteList, postBan, urlBan, queryBan, identityBan, fingerprintBan or fingerprintAllow")
+)
+
+// Rule is a compiled rule and its metadata
+type Rule struct {
+	hits     uint64 // first for 64-bit atomic alignment on arm
+	disabled int32
+	ID       string
+	Group    string
+	Pattern  string
+	Severity evt.Severity
+	Expires  time.Time // zero for rules loaded from configuration
+	rgx      *regexp.Regexp
+}
+
+// Meta returns the event metadata for a rule
+func (rl *Rule) Meta() evt.Rule {
+	return evt.Rule{
+		ID:       rl.ID,
+		Group:    rl.Group,
+		Pattern:  rl.Pattern,
+		Severity: rl.Severity,
+	}
+}
+
+// active reports whether the rule is enabled and not expired
+func (rl *Rule) active(now time.Time) bool {
+	if atomic.LoadInt32(&rl.disabled) == 1 {
+		return false
+	}
+	return rl.Expires.IsZero() || now.Before(rl.Expires)
+}
+
+// match reports whether an active rule matches b and counts the hit
+func (rl *Rule) match(b []byte, now time.Time) bool {
+	if !rl.active(now) || !rl.rgx.Match(b) {
+		return false
+	}
+	atomic.AddUint64(&rl.hits, 1)
+	return true
+}
+
+// RuleStatus is the runtime state of a rule
+type RuleStatus struct {
+	ID        string       `json:"id"`
+	Group     string       `json:"group"`
+	Pattern   string       `json:"pattern"`
+	Severity  evt.Severity `json:"severity"`
+	Enabled   bool         `json:"enabled"`
+	Temporary bool         `json:"temporary"`
+	Expires   *time.Time   `json:"expires,omitempty"`
+	Hits      uint64       `json:"hits"`
+}
+
+// Status returns the runtime state of the rule
+func (rl *Rule) Status() RuleStatus {
+	st := RuleStatus{
+		ID:       rl.ID,
+		Group:    rl.Group,
+		Pattern:  rl.Pattern,
+		Severity: rl.Severity,
+		Enabled:  atomic.LoadInt32(&rl.disabled) == 0,
+		Hits:     atomic.LoadUint64(&rl.hits),
+	}
+
+	if !rl.Expires.IsZero() {
+		exp := rl.Expires
+		st.Temporary = true
+		st.Expires = &exp
+	}
+
+	return st
+}
+
+// regexpCompile compiles a rule group
+func regexpCompile(group string, rrxp []string) ([]*Rule, error) {
+	rules := make([]*Rule, 0)
+
+	for i, r := range rrxp {
+		rxp, err := regexp.Compile("(?i)" + strings.ToLower(r))
+		if err != nil {
+			return rules, err
+		}
+		rules = append(rules, &Rule{
+			ID:       group + "-" + strconv.Itoa(i),
+			Group:    group,
+			Pattern:  r,
+			Severity: groupSeverity[group],
+			rgx:      rxp,
+		})
+	}
+
+	return rules, nil
+}
+
+// Rules returns the runtime state of every loaded rule
+func (e *Eng) Rules() []RuleStatus {
+	rs := e.ruleSet()
+
+	status := make([]RuleStatus, 0)
+	for _, rl := range rs.all() {
+		status = append(status, rl.Status())
+	}
+
+	return status
+}
+
+// SetRuleEnabled enables or disables a rule by id
+func (e *Eng) SetRuleEnabled(id string, enabled bool) error {
+	rl := e.ruleSet().find(id)
+	if rl == nil {
+		return ErrRuleNotFound
+	}
+
+	var disabled int32 = 1
+	if enabled {
+		disabled = 0
+	}
+	atomic.StoreInt32(&rl.disabled, disabled)
+
+	return nil
+}
+
+// AddTempRule adds a rule to a group that expires after ttl. Temporary
+// rules survive configuration reloads until they expire.
+func (e *Eng) AddTempRule(group string, pattern string, ttl time.Duration) (RuleStatus, error) {
+	switch group {
+	case GroupUrlWhiteList, GroupPostBan, GroupUrlBan, GroupQueryBan, GroupIdentityBan, GroupFingerprintBan, GroupFingerprintAllow:
+	default:
+		return RuleStatus{}, ErrRuleGroup
+	}
+
+	rxp, err := regexp.Compile("(?i)" + strings.ToLower(pattern))
+	if err != nil {
+		return RuleStatus{}, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.tempSeq++
+	rl := &Rule{
+		ID:       "temp-" + strconv.Itoa(e.tempSeq),
+		Group:    group,
+		Pattern:  pattern,
+		Severity: groupSeverity[group],
+		Expires:  time.Now().Add(ttl),
+		rgx:      rxp,
+	}
+
+	rs := e.rules.clone()
+	rs.pruneExpired(time.Now())
+	rs.add(rl)
+	e.rules = rs
+
+	return rl.Status(), nil
+}
+
+// RemoveTempRule removes a temporary rule by id
+func (e *Eng) RemoveTempRule(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rl := e.rules.find(id)
+	if rl == nil || rl.Expires.IsZero() {
+		return ErrRuleNotFound
+	}
+
+	rs := e.rules.clone()
+	rs.remove(rl)
+	e.rules = rs
+
+	return nil
+}
@@ -2,16 +2,24 @@ package rweng
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
-
-	"os"
+	"time"
 
 	"github.com/Masterminds/sprig"
+	"github.com/txn2/n2proxy/evt"
+	"github.com/txn2/n2proxy/redact"
+	"github.com/txn2/n2proxy/reqid"
+	"github.com/txn2/n2proxy/sec"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
 )
@@ -26,62 +34,354 @@ type FilterTemplate struct {
 	Name     string
 	Match    string
 	Template *template.Template
+	Rule     *Rule
 }
 
 // EngCfg defines an engine configuration
 type EngCfg struct {
-	UrlWhiteList []string    `yaml:"urlWhiteList"`
-	PostBan      []string    `yaml:"postBan"`
-	UrlBan       []string    `yaml:"urlBan"`
-	QueryBan     []string    `yaml:"queryBan"`
-	Filter       []FilterCfg `yaml:"postFilter"`
+	UrlWhiteList []string `yaml:"urlWhiteList"`
+	PostBan      []string `yaml:"postBan"`
+	UrlBan       []string `yaml:"urlBan"`
+	QueryBan     []string `yaml:"queryBan"`
+	IdentityBan  []string `yaml:"identityBan"` // client certificate identities
+	// TLS client JA3 hashes or JA4 fingerprints
+	FingerprintBan   []string       `yaml:"fingerprintBan"`
+	FingerprintAllow []string       `yaml:"fingerprintAllow"`
+	Filter           []FilterCfg    `yaml:"postFilter"`
+	Exclusions       []ExclusionCfg `yaml:"exclusions"`
+	Redact           redact.Cfg     `yaml:"redact"`
+}
+
+// ruleSet is an immutable set of compiled rules. Changes are made to a
+// clone which then replaces the engine's set.
+type ruleSet struct {
+	cfg              EngCfg
+	urlWhiteList     []*Rule
+	postBan          []*Rule
+	urlBan           []*Rule
+	queryBan         []*Rule
+	identityBan      []*Rule
+	fingerprintBan   []*Rule
+	fingerprintAllow []*Rule
+	filter           map[*regexp.Regexp]FilterTemplate
+	exclusions       []*Exclusion
+	redactor         *redact.Redactor
+}
+
+func (rs *ruleSet) clone() *ruleSet {
+	c := *rs
+	c.urlWhiteList = append([]*Rule{}, rs.urlWhiteList...)
+	c.postBan = append([]*Rule{}, rs.postBan...)
+	c.urlBan = append([]*Rule{}, rs.urlBan...)
+	c.queryBan = append([]*Rule{}, rs.queryBan...)
+	c.identityBan = append([]*Rule{}, rs.identityBan...)
+	c.fingerprintBan = append([]*Rule{}, rs.fingerprintBan...)
+	c.fingerprintAllow = append([]*Rule{}, rs.fingerprintAllow...)
+	c.exclusions = append([]*Exclusion{}, rs.exclusions...)
+	return &c
+}
+
+// match reports whether rl is in effect for the request path and
+// matches b, counting the hit
+func (rs *ruleSet) match(rl *Rule, path string, b []byte, now time.Time) bool {
+	if rs.excluded(rl, path) {
+		return false
+	}
+	return rl.match(b, now)
+}
+
+// matchFingerprint returns the first rule matching the JA3 hash or the
+// JA4 fingerprint, and the matched value
+func (rs *ruleSet) matchFingerprint(rules []*Rule, path string, fp sec.Fingerprint, now time.Time) (*Rule, string) {
+	if fp.JA3Hash == "" {
+		return nil, ""
+	}
+
+	for _, rl := range rules {
+		for _, value := range []string{fp.JA3Hash, fp.JA4} {
+			if rs.match(rl, path, []byte(value), now) {
+				return rl, value
+			}
+		}
+	}
+
+	return nil, ""
+}
+
+// group returns the rule slice for a group name
+func (rs *ruleSet) group(name string) *[]*Rule {
+	switch name {
+	case GroupUrlWhiteList:
+		return &rs.urlWhiteList
+	case GroupPostBan:
+		return &rs.postBan
+	case GroupUrlBan:
+		return &rs.urlBan
+	case GroupQueryBan:
+		return &rs.queryBan
+	case GroupIdentityBan:
+		return &rs.identityBan
+	case GroupFingerprintBan:
+		return &rs.fingerprintBan
+	case GroupFingerprintAllow:
+		return &rs.fingerprintAllow
+	}
+	return nil
+}
+
+// all returns every rule, filters last ordered by id
+func (rs *ruleSet) all() []*Rule {
+	all := make([]*Rule, 0)
+	all = append(all, rs.urlWhiteList...)
+	all = append(all, rs.postBan...)
+	all = append(all, rs.urlBan...)
+	all = append(all, rs.queryBan...)
+	all = append(all, rs.identityBan...)
+	all = append(all, rs.fingerprintBan...)
+	all = append(all, rs.fingerprintAllow...)
+
+	filters := make([]*Rule, 0, len(rs.filter))
+	for _, ft := range rs.filter {
+		filters = append(filters, ft.Rule)
+	}
+	sort.Slice(filters, func(i, j int) bool { return filters[i].ID < filters[j].ID })
+
+	return append(all, filters...)
+}
+
+func (rs *ruleSet) find(id string) *Rule {
+	for _, rl := range rs.all() {
+		if rl.ID == id {
+			return rl
+		}
+	}
+	return nil
+}
+
+func (rs *ruleSet) add(rl *Rule) {
+	g := rs.group(rl.Group)
+	*g = append(*g, rl)
+}
+
+func (rs *ruleSet) remove(rl *Rule) {
+	g := rs.group(rl.Group)
+	if g == nil {
+		return
+	}
+
+	kept := make([]*Rule, 0, len(*g))
+	for _, r := range *g {
+		if r != rl {
+			kept = append(kept, r)
+		}
+	}
+	*g = kept
+}
+
+// pruneExpired drops temporary rules past their expiry
+func (rs *ruleSet) pruneExpired(now time.Time) {
+	for _, rl := range rs.all() {
+		if !rl.Expires.IsZero() && !now.Before(rl.Expires) {
+			rs.remove(rl)
+		}
+	}
 }
 
 // Eng http.Request rule engine.
 type Eng struct {
-	cfg          EngCfg
-	urlWhiteList []*regexp.Regexp
-	postBan      []*regexp.Regexp
-	urlBan       []*regexp.Regexp
-	queryBan     []*regexp.Regexp
-	filter       map[*regexp.Regexp]FilterTemplate
+	mu           sync.RWMutex
+	filename     string
+	rules        *ruleSet
+	tempSeq      int
+	exclusionSeq int
+	blocks       *Blocks
+	events       *evt.Stream
 	logger       *zap.Logger
 }
 
+// actionRank orders actions from least to most severe
+var actionRank = map[string]int{
+	evt.ActionBypass:   1,
+	evt.ActionFilter:   2,
+	evt.ActionRewrite:  3,
+	evt.ActionDropBody: 4,
+	evt.ActionBlock:    5,
+}
+
+// Verdict summarizes the rules matched while processing a request
+type Verdict struct {
+	Action string   // most severe action taken, empty if no rule matched
+	Rules  []string // ids of the matched rules
+	Events []string // ids of the emitted security events
+	Err    error    // the body could not be read, the request must not be proxied
+}
+
+func (v *Verdict) add(rl *Rule, action string, eventID string) {
+	if actionRank[action] > actionRank[v.Action] {
+		v.Action = action
+	}
+	v.Rules = append(v.Rules, rl.ID)
+	v.Events = append(v.Events, eventID)
+}
+
+// Blocked reports whether the request must be denied
+func (v *Verdict) Blocked() bool {
+	return v.Action == evt.ActionBlock
+}
+
+// clientIP returns the IP and port of the request remote address
+func clientIP(r *http.Request) (string, string) {
+	ip, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr, ""
+	}
+	return ip, port
+}
+
+// emit sends a security event for a rule hit, records it in the
+// verdict and returns the event id
+func (e *Eng) emit(r *http.Request, rs *ruleSet, v *Verdict, rl *Rule, target string, fragment []byte, action string) string {
+	ip, port := clientIP(r)
+	fp := sec.FingerprintFromContext(r.Context())
+
+	event := &evt.Event{
+		ID:        evt.NewID(),
+		RequestID: reqid.FromContext(r.Context()),
+		Rule:      rl.Meta(),
+		Target:    target,
+		Fragment:  rs.redactor.Fragment(fragment),
+		Client: evt.Client{
+			IP:        ip,
+			Port:      port,
+			UserAgent: r.UserAgent(),
+			Identity:  sec.IdentityFromContext(r.Context()),
+			JA3:       fp.JA3Hash,
+			JA4:       fp.JA4,
+		},
+		Request: evt.Request{
+			Method: r.Method,
+			Host:   r.Host,
+			URI:    rs.redactor.URI(r.RequestURI),
+		},
+		Action: action,
+	}
+
+	e.events.Emit(event)
+	v.add(rl, action, event.ID)
+
+	return event.ID
+}
+
+// ruleSet returns the current rule set
+func (e *Eng) ruleSet() *ruleSet {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.rules
+}
+
+// Blocks returns the engine's client block list
+func (e *Eng) Blocks() *Blocks {
+	return e.blocks
+}
+
+// ShareBlocks replaces the engine's block list with one shared by other
+// engines, call it before processing requests
+func (e *Eng) ShareBlocks(b *Blocks) {
+	e.blocks = b
+}
+
 // ProcessRequest performs any rules on matching requests
-func (e *Eng) ProcessRequest(w http.ResponseWriter, r *http.Request) {
+func (e *Eng) ProcessRequest(w http.ResponseWriter, r *http.Request) *Verdict {
+
+	v := &Verdict{}
+	logger := e.logger.With(zap.String("RequestID", reqid.FromContext(r.Context())))
+	rs := e.ruleSet()
+	now := time.Now()
+	path := r.URL.Path
+
+	// deny blocked clients outright
+	ip, _ := clientIP(r)
+	if blk, ok := e.blocks.Blocked(ip); ok {
+		rl := &Rule{ID: GroupClientBlock, Group: GroupClientBlock, Pattern: blk.IP, Severity: groupSeverity[GroupClientBlock]}
+		id := e.emit(r, rs, v, rl, evt.TargetClient, []byte(blk.Reason), evt.ActionBlock)
+		logger.Warn("Blocked client.", zap.String("EventID", id), zap.String("IP", blk.IP), zap.String("Reason", blk.Reason))
+		return v
+	}
+
+	// deny banned client certificate identities
+	if identity := sec.IdentityFromContext(r.Context()); identity != "" {
+		for _, rl := range rs.identityBan {
+			if rs.match(rl, path, []byte(identity), now) {
+				id := e.emit(r, rs, v, rl, evt.TargetIdentity, []byte(identity), evt.ActionBlock)
+				logger.Warn("Banned client identity.", zap.String("EventID", id), zap.String("Rule", rl.ID), zap.String("Regexp", rl.Pattern), zap.String("Identity", identity))
+				return v
+			}
+		}
+	}
+
+	// deny banned TLS client fingerprints
+	fp := sec.FingerprintFromContext(r.Context())
+	if rl, value := rs.matchFingerprint(rs.fingerprintBan, path, fp, now); rl != nil {
+		id := e.emit(r, rs, v, rl, evt.TargetFingerprint, []byte(value), evt.ActionBlock)
+		logger.Warn("Banned TLS fingerprint.", zap.String("EventID", id), zap.String("Rule", rl.ID), zap.String("Regexp", rl.Pattern), zap.String("Fingerprint", value))
+		return v
+	}
 
-	b, _ := ioutil.ReadAll(r.Body)
+	b, err := ioutil.ReadAll(r.Body)
 	r.Body.Close()
+	if err != nil {
+		logger.Warn("Request body read failed.", zap.Error(err))
+		v.Err = err
+		return v
+	}
 
 	// bypass on urlWhitelist
-	for _, rgx := range e.urlWhiteList {
+	for _, rl := range rs.urlWhiteList {
 		buri := bytes.ToLower([]byte(r.RequestURI))
-		if rgx.Match(buri) {
-			e.logger.Warn("Bypassing: Whitelisted URL found.", zap.String("Regexp", rgx.String()), zap.ByteString("URI", buri))
+		if rs.match(rl, path, buri, now) {
+			id := e.emit(r, rs, v, rl, evt.TargetURI, rl.rgx.Find(buri), evt.ActionBypass)
+			logger.Warn("Bypassing: Whitelisted URL found.", zap.String("EventID", id), zap.String("Rule", rl.ID), zap.String("Regexp", rl.Pattern), zap.String("URI", rs.redactor.Fragment(buri)))
 			body := ioutil.NopCloser(bytes.NewReader(b))
 
 			r.Body = body
 			r.ContentLength = int64(len(b))
 			r.Header.Set("Content-Length", strconv.Itoa(len(b)))
 
-			return
+			return v
 		}
 	}
 
+	// bypass on fingerprintAllow
+	if rl, value := rs.matchFingerprint(rs.fingerprintAllow, path, fp, now); rl != nil {
+		id := e.emit(r, rs, v, rl, evt.TargetFingerprint, []byte(value), evt.ActionBypass)
+		logger.Warn("Bypassing: Allowed TLS fingerprint found.", zap.String("EventID", id), zap.String("Rule", rl.ID), zap.String("Regexp", rl.Pattern), zap.String("Fingerprint", value))
+		body := ioutil.NopCloser(bytes.NewReader(b))
+
+		r.Body = body
+		r.ContentLength = int64(len(b))
+		r.Header.Set("Content-Length", strconv.Itoa(len(b)))
+
+		return v
+	}
+
 	// run filter if there is a body
 	if len(b) > 0 {
-		for rgx, filter := range e.filter {
+		for rgx, filter := range rs.filter {
+			if !filter.Rule.active(now) || rs.excluded(filter.Rule, path) {
+				continue
+			}
 
 			// find the match first and populate data structure
 			matches := rgx.FindAll(bytes.ToLower(b), len(b))
 			for _, match := range matches {
+				atomic.AddUint64(&filter.Rule.hits, 1)
 				filter.Match = string(match)
+				e.emit(r, rs, v, filter.Rule, evt.TargetBody, match, evt.ActionFilter)
 				// send the match to the template
 				var tplReturn bytes.Buffer
 				if err := filter.Template.Execute(&tplReturn, filter); err != nil {
 					// something bad happened
-					e.logger.Error("Filter failed: " + err.Error())
+					logger.Error("Filter failed: " + err.Error())
 					continue
 				}
 
@@ -91,10 +391,11 @@ func (e *Eng) ProcessRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// search for url path contraband
-	for _, rgx := range e.urlBan {
+	for _, rl := range rs.urlBan {
 		buri := bytes.ToLower([]byte(r.RequestURI))
-		if rgx.Match(buri) {
-			e.logger.Warn("URL contraband found.", zap.String("Regexp", rgx.String()), zap.ByteString("URI", buri))
+		if rs.match(rl, path, buri, now) {
+			id := e.emit(r, rs, v, rl, evt.TargetURI, rl.rgx.Find(buri), evt.ActionRewrite)
+			logger.Warn("URL contraband found.", zap.String("EventID", id), zap.String("Rule", rl.ID), zap.String("Regexp", rl.Pattern), zap.String("URI", rs.redactor.Fragment(buri)))
 			r.URL.Path = "/"
 			r.URL.RawQuery = ""
 			break
@@ -103,10 +404,11 @@ func (e *Eng) ProcessRequest(w http.ResponseWriter, r *http.Request) {
 
 	if len(r.URL.RawQuery) > 0 {
 		// search for url path contraband
-		for _, rgx := range e.queryBan {
+		for _, rl := range rs.queryBan {
 			bq := bytes.ToLower([]byte(r.URL.RawQuery))
-			if rgx.Match(bq) {
-				e.logger.Warn("QUERY STRING contraband found.", zap.String("Regexp", rgx.String()), zap.ByteString("QUERY", bq))
+			if rs.match(rl, path, bq, now) {
+				id := e.emit(r, rs, v, rl, evt.TargetQuery, rl.rgx.Find(bq), evt.ActionRewrite)
+				logger.Warn("QUERY STRING contraband found.", zap.String("EventID", id), zap.String("Rule", rl.ID), zap.String("Regexp", rl.Pattern), zap.String("QUERY", rs.redactor.Fragment(bq)))
 				r.URL.Path = "/"
 				r.URL.RawQuery = ""
 				break
@@ -115,9 +417,11 @@ func (e *Eng) ProcessRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// search for posted contraband
-	for _, rgx := range e.postBan {
-		if rgx.Match(bytes.ToLower(b)) {
-			e.logger.Warn("Posted contraband found.", zap.String("Regexp", rgx.String()), zap.ByteString("PostBody", b))
+	for _, rl := range rs.postBan {
+		lb := bytes.ToLower(b)
+		if rs.match(rl, path, lb, now) {
+			id := e.emit(r, rs, v, rl, evt.TargetBody, rl.rgx.Find(lb), evt.ActionDropBody)
+			logger.Warn("Posted contraband found.", zap.String("EventID", id), zap.String("Rule", rl.ID), zap.String("Regexp", rl.Pattern), zap.String("PostBody", rs.redactor.Body(b)))
 			b = []byte{}
 			break
 		}
@@ -129,90 +433,176 @@ func (e *Eng) ProcessRequest(w http.ResponseWriter, r *http.Request) {
 	r.ContentLength = int64(len(b))
 	r.Header.Set("Content-Length", strconv.Itoa(len(b)))
 
+	return v
 }
 
-// regexpCompile
-func regexpCompile(rrxp []string) ([]*regexp.Regexp, error) {
-	crxp := make([]*regexp.Regexp, 0)
+// Reload re-reads the engine configuration file. Hit counts and the
+// enabled state of unchanged rules, and unexpired temporary rules, are
+// carried over. On error the current rules stay in effect.
+func (e *Eng) Reload() error {
+	rs, err := loadRuleSet(e.filename)
+	if err != nil {
+		return err
+	}
 
-	for _, r := range rrxp {
-		rxp, err := regexp.Compile("(?i)" + strings.ToLower(r))
-		if err != nil {
-			return crxp, err
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	for _, rl := range rs.all() {
+		if old := e.rules.find(rl.ID); old != nil && old.Pattern == rl.Pattern {
+			atomic.StoreUint64(&rl.hits, atomic.LoadUint64(&old.hits))
+			atomic.StoreInt32(&rl.disabled, atomic.LoadInt32(&old.disabled))
 		}
-		crxp = append(crxp, rxp)
 	}
 
-	return crxp, nil
-}
+	for _, rl := range e.rules.all() {
+		if !rl.Expires.IsZero() && now.Before(rl.Expires) {
+			rs.add(rl)
+		}
+	}
 
-// NewEngFromYml loads an engine from yaml data
-func NewEngFromYml(filename string, logger *zap.Logger) (*Eng, error) {
+	for _, ex := range e.rules.exclusions {
+		if ex.Runtime {
+			rs.exclusions = append(rs.exclusions, ex)
+		}
+	}
+
+	e.rules = rs
 
+	e.logger.Info("Reloaded rule configuration from " + e.filename)
+
+	return nil
+}
+
+// NewEngCfgFromYml reads an engine configuration file
+func NewEngCfgFromYml(filename string) (*EngCfg, error) {
 	ymlData, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	engCfg := EngCfg{}
+	engCfg := &EngCfg{}
 
-	err = yaml.Unmarshal([]byte(ymlData), &engCfg)
+	err = yaml.Unmarshal([]byte(ymlData), engCfg)
 	if err != nil {
 		return nil, err
 	}
 
-	urlWhileList, err := regexpCompile(engCfg.UrlWhiteList)
+	return engCfg, nil
+}
+
+// loadRuleSet compiles the rules in an engine configuration file
+func loadRuleSet(filename string) (*ruleSet, error) {
+
+	engCfg, err := NewEngCfgFromYml(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	urlWhileList, err := regexpCompile(GroupUrlWhiteList, engCfg.UrlWhiteList)
+	if err != nil {
+		return nil, fmt.Errorf("error in urlWhiteList regex compile: %s", err.Error())
+	}
+
+	postBan, err := regexpCompile(GroupPostBan, engCfg.PostBan)
+	if err != nil {
+		return nil, fmt.Errorf("error in postBan regex compile: %s", err.Error())
+	}
+
+	urlBan, err := regexpCompile(GroupUrlBan, engCfg.UrlBan)
+	if err != nil {
+		return nil, fmt.Errorf("error in urlBan regex compile: %s", err.Error())
+	}
+
+	queryBan, err := regexpCompile(GroupQueryBan, engCfg.QueryBan)
+	if err != nil {
+		return nil, fmt.Errorf("error in queryBan regex compile: %s", err.Error())
+	}
+
+	identityBan, err := regexpCompile(GroupIdentityBan, engCfg.IdentityBan)
 	if err != nil {
-		logger.Error("Error in urlWhileList regex compile: " + err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("error in identityBan regex compile: %s", err.Error())
 	}
 
-	postBan, err := regexpCompile(engCfg.PostBan)
+	fingerprintBan, err := regexpCompile(GroupFingerprintBan, engCfg.FingerprintBan)
 	if err != nil {
-		logger.Error("Error in postBan regex compile: " + err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("error in fingerprintBan regex compile: %s", err.Error())
 	}
 
-	urlBan, err := regexpCompile(engCfg.UrlBan)
+	fingerprintAllow, err := regexpCompile(GroupFingerprintAllow, engCfg.FingerprintAllow)
 	if err != nil {
-		logger.Error("Error in urlBan regex compile: " + err.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("error in fingerprintAllow regex compile: %s", err.Error())
 	}
 
-	queryBan, err := regexpCompile(engCfg.QueryBan)
+	redactor, err := redact.New(engCfg.Redact)
 	if err != nil {
-		logger.Error("Error in queryBan regex compile: " + err.Error())
-		os.Exit(1)
+		return nil, err
 	}
 
 	filter := make(map[*regexp.Regexp]FilterTemplate, 0)
 
-	for _, filterCfg := range engCfg.Filter {
+	for i, filterCfg := range engCfg.Filter {
 		rxp, err := regexp.Compile(strings.ToLower(filterCfg.Match))
 		if err != nil {
-			logger.Error("Error in filterCfg regex compile: " + err.Error())
-			os.Exit(1)
+			return nil, fmt.Errorf("error in filterCfg regex compile: %s", err.Error())
 		}
 
 		tmpl, err := template.New(filterCfg.Name).Funcs(sprig.TxtFuncMap()).Parse(filterCfg.Template)
 		if err != nil {
-			logger.Error("Template parsing error: " + err.Error())
+			return nil, fmt.Errorf("template parsing error: %s", err.Error())
 		}
 
 		filter[rxp] = FilterTemplate{
 			Name:     filterCfg.Name,
 			Template: tmpl,
+			Rule: &Rule{
+				ID:       GroupFilter + "-" + strconv.Itoa(i),
+				Group:    GroupFilter,
+				Pattern:  filterCfg.Match,
+				Severity: groupSeverity[GroupFilter],
+				rgx:      rxp,
+			},
 		}
 	}
 
+	exclusions, err := compileExclusions(engCfg.Exclusions)
+	if err != nil {
+		return nil, fmt.Errorf("error in exclusions: %s", err.Error())
+	}
+
+	rs := &ruleSet{
+		cfg:              *engCfg,
+		urlWhiteList:     urlWhileList,
+		postBan:          postBan,
+		urlBan:           urlBan,
+		queryBan:         queryBan,
+		identityBan:      identityBan,
+		fingerprintBan:   fingerprintBan,
+		fingerprintAllow: fingerprintAllow,
+		filter:           filter,
+		exclusions:       exclusions,
+		redactor:         redactor,
+	}
+
+	return rs, nil
+}
+
+// NewEngFromYml loads an engine from yaml data. Rule hits are emitted
+// to events, which may be nil.
+func NewEngFromYml(filename string, events *evt.Stream, logger *zap.Logger) (*Eng, error) {
+
+	rs, err := loadRuleSet(filename)
+	if err != nil {
+		return nil, err
+	}
+
 	eng := &Eng{
-		cfg:          engCfg,
-		urlWhiteList: urlWhileList,
-		postBan:      postBan,
-		urlBan:       urlBan,
-		queryBan:     queryBan,
-		filter:       filter,
-		logger:       logger,
+		filename: filename,
+		rules:    rs,
+		blocks:   NewBlocks(),
+		events:   events,
+		logger:   logger,
 	}
 
 	return eng, nil
@@ -0,0 +1,473 @@
+package sec
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+// CertCfg is a certificate and key pair served on the listener
+type CertCfg struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Names are the SNI names served, exact or *.example.com; defaults to
+	// the certificate DNS names, or its common name without any
+	Names []string `yaml:"names"`
+	// Default is served when no name matches, the first pair otherwise
+	Default bool `yaml:"default"`
+	// OCSP is a DER OCSP response file stapled instead of asking the
+	// responder, reloaded when it changes
+	OCSP string `yaml:"ocsp"`
+	// Issuer is a PEM issuer certificate for OCSP when the chain in Cert
+	// does not include it
+	Issuer string `yaml:"issuer"`
+}
+
+// CertOptions tune certificate reloading and lifecycle checks
+type CertOptions struct {
+	Reload        time.Duration // how often files are checked, default 30s
+	ExpiryWarning time.Duration // warn this long before expiry, default 30 days
+	AllowExpired  bool          // serve expired certificates instead of refusing them
+	OCSPStapling  bool          // staple responses fetched from the certificate's responder
+}
+
+// CertStatus reports a served certificate
+type CertStatus struct {
+	Cert           string    `json:"cert"`
+	Names          []string  `json:"names"`
+	NotAfter       time.Time `json:"not_after"`
+	ExpiresIn      int64     `json:"expires_in_seconds"`
+	OCSP           string    `json:"ocsp,omitempty"` // good, revoked, unknown or expired when stapling
+	OCSPNextUpdate string    `json:"ocsp_next_update,omitempty"`
+}
+
+// certEntry is a loaded pair and its lifecycle state. Entries are
+// copied, never changed, once published.
+type certEntry struct {
+	cfg            CertCfg
+	cert           *tls.Certificate
+	issuer         *x509.Certificate
+	names          []string
+	certMod        time.Time
+	keyMod         time.Time
+	ocspMod        time.Time // of the OCSP file last read
+	ocspRefresh    time.Time // when the responder is asked again
+	ocspStatus     string
+	ocspNextUpdate time.Time
+	warned         time.Time // last expiry warning
+}
+
+// Certificates selects listener certificates by SNI, reloads them when
+// their files change, staples OCSP responses and warns before expiry
+type Certificates struct {
+	mu       sync.RWMutex
+	entries  []*certEntry
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	opts     CertOptions
+	done     chan struct{}
+	logger   *zap.Logger
+}
+
+// NewCertificates loads every pair. Expired certificates are refused
+// unless opts.AllowExpired is set. Files are checked for changes every
+// opts.Reload once started.
+func NewCertificates(cfgs []CertCfg, opts CertOptions, logger *zap.Logger) (*Certificates, error) {
+	if len(cfgs) == 0 {
+		return nil, fmt.Errorf("no certificates configured")
+	}
+	if opts.Reload <= 0 {
+		opts.Reload = 30 * time.Second
+	}
+	if opts.ExpiryWarning <= 0 {
+		opts.ExpiryWarning = 30 * 24 * time.Hour
+	}
+
+	cs := &Certificates{
+		entries: make([]*certEntry, 0, len(cfgs)),
+		opts:    opts,
+		done:    make(chan struct{}),
+		logger:  logger,
+	}
+
+	for _, cfg := range cfgs {
+		entry, err := cs.load(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cs.entries = append(cs.entries, entry)
+
+		logger.Info("Loaded certificate",
+			zap.String("Cert", cfg.Cert),
+			zap.Strings("Names", entry.names),
+			zap.Time("NotAfter", entry.cert.Leaf.NotAfter),
+		)
+	}
+
+	cs.index()
+
+	// staple before the first handshake
+	cs.check(time.Now())
+
+	return cs, nil
+}
+
+// load reads a pair, refusing expired certificates unless allowed
+func (cs *Certificates) load(cfg CertCfg) (*certEntry, error) {
+	entry := &certEntry{cfg: cfg}
+	if err := entry.load(); err != nil {
+		return nil, err
+	}
+
+	notAfter := entry.cert.Leaf.NotAfter
+	if time.Now().After(notAfter) {
+		if !cs.opts.AllowExpired {
+			return nil, fmt.Errorf("certificate %s expired on %s", cfg.Cert, notAfter.UTC().Format(time.RFC3339))
+		}
+		cs.logger.Warn("Serving expired certificate", zap.String("Cert", cfg.Cert), zap.Time("NotAfter", notAfter))
+	}
+
+	return entry, nil
+}
+
+// load reads the pair and records the file modification times
+func (e *certEntry) load() error {
+	certMod, keyMod, err := e.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(e.cfg.Cert, e.cfg.Key)
+	if err != nil {
+		return fmt.Errorf("certificate %s: %s", e.cfg.Cert, err.Error())
+	}
+
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("certificate %s: %s", e.cfg.Cert, err.Error())
+		}
+	}
+
+	// the issuer is only needed for OCSP
+	if e.cfg.Issuer != "" {
+		data, err := ioutil.ReadFile(e.cfg.Issuer)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("no certificate found in issuer %s", e.cfg.Issuer)
+		}
+		e.issuer, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("issuer %s: %s", e.cfg.Issuer, err.Error())
+		}
+	} else if len(cert.Certificate) > 1 {
+		e.issuer, _ = x509.ParseCertificate(cert.Certificate[1])
+	}
+
+	names := e.cfg.Names
+	if len(names) == 0 {
+		names = cert.Leaf.DNSNames
+	}
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+
+	e.cert = &cert
+	e.names = names
+	e.certMod, e.keyMod = certMod, keyMod
+
+	return nil
+}
+
+// modTimes stats both files, following symlinks as used by mounted
+// secrets
+func (e *certEntry) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(e.cfg.Cert)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(e.cfg.Key)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// index rebuilds the name lookup, callers hold the write lock or own cs
+func (cs *Certificates) index() {
+	byName := make(map[string]*tls.Certificate, 0)
+	fallback := cs.entries[0].cert
+
+	for _, entry := range cs.entries {
+		for _, name := range entry.names {
+			name = strings.ToLower(name)
+			if _, ok := byName[name]; !ok {
+				byName[name] = entry.cert
+			}
+		}
+		if entry.cfg.Default {
+			fallback = entry.cert
+		}
+	}
+
+	cs.byName = byName
+	cs.fallback = fallback
+}
+
+// GetCertificate implements tls.Config.GetCertificate. An exact name
+// wins over a wildcard; the default pair is served when none match.
+func (cs *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	if cert, ok := cs.byName[name]; ok {
+		return cert, nil
+	}
+
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := cs.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+
+	return cs.fallback, nil
+}
+
+// Status reports every served certificate
+func (cs *Certificates) Status() []CertStatus {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	now := time.Now()
+	status := make([]CertStatus, 0, len(cs.entries))
+	for _, entry := range cs.entries {
+		s := CertStatus{
+			Cert:      entry.cfg.Cert,
+			Names:     entry.names,
+			NotAfter:  entry.cert.Leaf.NotAfter.UTC(),
+			ExpiresIn: int64(entry.cert.Leaf.NotAfter.Sub(now) / time.Second),
+			OCSP:      entry.ocspStatus,
+		}
+		if !entry.ocspNextUpdate.IsZero() {
+			s.OCSPNextUpdate = entry.ocspNextUpdate.UTC().Format(time.RFC3339)
+		}
+		status = append(status, s)
+	}
+
+	return status
+}
+
+// Start checks certificate files, staples and expiry until Stop
+func (cs *Certificates) Start() {
+	go func() {
+		ticker := time.NewTicker(cs.opts.Reload)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-cs.done:
+				return
+			case now := <-ticker.C:
+				cs.check(now)
+			}
+		}
+	}()
+}
+
+// Stop ends the checks
+func (cs *Certificates) Stop() {
+	close(cs.done)
+}
+
+// Reload runs the file, staple and expiry checks now
+func (cs *Certificates) Reload() {
+	cs.check(time.Now())
+}
+
+// check reloads pairs whose files changed, refreshes due staples and
+// warns about expiring certificates. A pair that fails to load, e.g.
+// while only one of the files has been replaced, keeps serving the
+// previous certificate and is retried on the next check.
+func (cs *Certificates) check(now time.Time) {
+	cs.mu.RLock()
+	entries := cs.entries
+	cs.mu.RUnlock()
+
+	next := make([]*certEntry, len(entries))
+	changed := false
+
+	for i, entry := range entries {
+		e := *entry
+		next[i] = &e
+
+		if cs.reload(&e) {
+			changed = true
+		}
+		if cs.staple(&e, now) {
+			changed = true
+		}
+		if cs.warnExpiry(&e, now) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	cs.mu.Lock()
+	cs.entries = next
+	cs.index()
+	cs.mu.Unlock()
+}
+
+// reload replaces the pair when its files changed
+func (cs *Certificates) reload(e *certEntry) bool {
+	certMod, keyMod, err := e.modTimes()
+	if err != nil {
+		cs.logger.Warn("Certificate check failed", zap.String("Cert", e.cfg.Cert), zap.Error(err))
+		return false
+	}
+	if certMod.Equal(e.certMod) && keyMod.Equal(e.keyMod) {
+		return false
+	}
+
+	fresh, err := cs.load(e.cfg)
+	if err != nil {
+		cs.logger.Warn("Certificate reload failed", zap.String("Cert", e.cfg.Cert), zap.Error(err))
+		return false
+	}
+
+	cs.logger.Info("Reloaded certificate",
+		zap.String("Cert", e.cfg.Cert),
+		zap.Strings("Names", fresh.names),
+		zap.Time("NotAfter", fresh.cert.Leaf.NotAfter),
+	)
+
+	*e = *fresh
+	return true
+}
+
+// staple loads a changed OCSP file or asks the responder when due.
+// Failures are retried after five minutes, or when the file changes;
+// the previous staple is served meanwhile until its next update.
+func (cs *Certificates) staple(e *certEntry, now time.Time) bool {
+	changed := cs.expireStaple(e, now)
+
+	var der []byte
+	var resp *ocsp.Response
+	var err error
+
+	switch {
+	case e.cfg.OCSP != "":
+		info, statErr := os.Stat(e.cfg.OCSP)
+		if statErr != nil || info.ModTime().Equal(e.ocspMod) {
+			return changed
+		}
+		e.ocspMod = info.ModTime()
+		der, resp, err = readOCSP(e.cfg.OCSP, e.cert.Leaf, e.issuer)
+	case cs.opts.OCSPStapling && len(e.cert.Leaf.OCSPServer) > 0:
+		if now.Before(e.ocspRefresh) {
+			return changed
+		}
+		der, resp, err = fetchOCSP(e.cert.Leaf, e.issuer)
+	default:
+		return changed
+	}
+
+	e.ocspRefresh = now.Add(5 * time.Minute)
+
+	if err == nil && !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate) {
+		err = fmt.Errorf("OCSP response expired on %s", resp.NextUpdate.UTC().Format(time.RFC3339))
+	}
+	if err != nil {
+		cs.logger.Warn("OCSP staple update failed", zap.String("Cert", e.cfg.Cert), zap.Error(err))
+		return true
+	}
+
+	e.ocspStatus = ocspStatus(resp.Status)
+	e.ocspNextUpdate = resp.NextUpdate
+
+	// a revoked or unknown status is not worth stapling, and an earlier
+	// good staple must not outlive it
+	if resp.Status != ocsp.Good {
+		cs.logger.Error("OCSP responder reports certificate not good",
+			zap.String("Cert", e.cfg.Cert),
+			zap.String("Status", e.ocspStatus),
+		)
+		if e.cert.OCSPStaple != nil {
+			cert := *e.cert
+			cert.OCSPStaple = nil
+			e.cert = &cert
+		}
+		return true
+	}
+
+	if refresh := ocspRefreshAt(resp); refresh.After(e.ocspRefresh) {
+		e.ocspRefresh = refresh
+	}
+
+	cert := *e.cert
+	cert.OCSPStaple = der
+	e.cert = &cert
+
+	cs.logger.Info("Updated OCSP staple",
+		zap.String("Cert", e.cfg.Cert),
+		zap.Time("NextUpdate", resp.NextUpdate),
+	)
+
+	return true
+}
+
+// expireStaple drops a staple past its next update, strict clients
+// fail the handshake over it
+func (cs *Certificates) expireStaple(e *certEntry, now time.Time) bool {
+	if e.cert.OCSPStaple == nil || e.ocspNextUpdate.IsZero() || !now.After(e.ocspNextUpdate) {
+		return false
+	}
+
+	cs.logger.Error("OCSP staple expired without a fresh response",
+		zap.String("Cert", e.cfg.Cert),
+		zap.Time("NextUpdate", e.ocspNextUpdate),
+	)
+
+	cert := *e.cert
+	cert.OCSPStaple = nil
+	e.cert = &cert
+	e.ocspStatus = "expired"
+
+	return true
+}
+
+// warnExpiry logs certificates within ExpiryWarning of expiry, daily
+func (cs *Certificates) warnExpiry(e *certEntry, now time.Time) bool {
+	notAfter := e.cert.Leaf.NotAfter
+	if notAfter.Sub(now) > cs.opts.ExpiryWarning || now.Sub(e.warned) < 24*time.Hour {
+		return false
+	}
+
+	cs.logger.Warn("Certificate expires soon",
+		zap.String("Cert", e.cfg.Cert),
+		zap.Time("NotAfter", notAfter),
+		zap.Duration("ExpiresIn", notAfter.Sub(now).Round(time.Second)),
+	)
+
+	e.warned = now
+	return true
+}
@@ -0,0 +1,160 @@
+package sec
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// testPair writes a self-signed certificate for a common name and DNS
+// names in dir
+func testPair(t *testing.T, dir string, cn string, dnsNames ...string) CertCfg {
+	t.Helper()
+
+	cert, key := testIssue(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: dnsNames,
+	}, nil, nil)
+
+	certFile, keyFile := writeTestPair(t, dir, cn, cert, key)
+	return CertCfg{Cert: certFile, Key: keyFile}
+}
+
+// served returns the common name of the certificate served for name
+func served(t *testing.T, cs *Certificates, name string) string {
+	t.Helper()
+
+	cert, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertificatesSNI(t *testing.T) {
+	dir := t.TempDir()
+
+	api := testPair(t, dir, "api", "api.example.com")
+	wildcard := testPair(t, dir, "wildcard", "*.example.com", "example.com")
+	other := testPair(t, dir, "other", "other.org")
+	named := testPair(t, dir, "named", "ignored.org")
+	named.Names = []string{"Named.org"}
+	cn := testPair(t, dir, "cn.org")
+
+	tests := []struct {
+		name       string
+		defaultPos int // index of the default pair, -1 for none
+		server     string
+		want       string
+	}{
+		{name: "exact", defaultPos: -1, server: "api.example.com", want: "api"},
+		{name: "exact before wildcard", defaultPos: -1, server: "API.Example.com.", want: "api"},
+		{name: "wildcard", defaultPos: -1, server: "www.example.com", want: "wildcard"},
+		{name: "wildcard apex by name", defaultPos: -1, server: "example.com", want: "wildcard"},
+		{name: "wildcard covers one label", defaultPos: -1, server: "a.b.example.com", want: "api"},
+		{name: "configured names", defaultPos: -1, server: "named.org", want: "named"},
+		{name: "configured names replace the certificate's", defaultPos: -1, server: "ignored.org", want: "api"},
+		{name: "common name without DNS names", defaultPos: -1, server: "cn.org", want: "cn.org"},
+		{name: "first pair without a default", defaultPos: -1, server: "unknown.net", want: "api"},
+		{name: "default pair", defaultPos: 2, server: "unknown.net", want: "other"},
+		{name: "default pair without SNI", defaultPos: 2, server: "", want: "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfgs := []CertCfg{api, wildcard, other, named, cn}
+			if tt.defaultPos >= 0 {
+				cfgs[tt.defaultPos].Default = true
+			}
+
+			cs, err := NewCertificates(cfgs, CertOptions{}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := served(t, cs, tt.server); got != tt.want {
+				t.Errorf("served %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCertificatesExpired(t *testing.T) {
+	dir := t.TempDir()
+
+	cert, key := testIssue(t, &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "expired"},
+		DNSNames:  []string{"example.com"},
+		NotBefore: time.Now().Add(-48 * time.Hour),
+		NotAfter:  time.Now().Add(-time.Hour),
+	}, nil, nil)
+	certFile, keyFile := writeTestPair(t, dir, "expired", cert, key)
+	cfgs := []CertCfg{{Cert: certFile, Key: keyFile}}
+
+	if _, err := NewCertificates(cfgs, CertOptions{}, zap.NewNop()); err == nil {
+		t.Error("expired certificate loaded")
+	}
+
+	cs, err := NewCertificates(cfgs, CertOptions{AllowExpired: true}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := served(t, cs, "example.com"); got != "expired" {
+		t.Errorf("served %s, want the expired certificate", got)
+	}
+}
+
+func TestCertificatesReload(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := testPair(t, dir, "first", "example.com")
+	cs, err := NewCertificates([]CertCfg{cfg}, CertOptions{}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replace writes the pair for cn over the configured files, dated
+	// later so the change is seen on coarse file systems
+	replace := func(cn string, certOnly bool, dnsNames ...string) {
+		t.Helper()
+
+		cert, key := testIssue(t, &x509.Certificate{Subject: pkix.Name{CommonName: cn}, DNSNames: dnsNames}, nil, nil)
+		if err := writePEM(cfg.Cert, "CERTIFICATE", cert.Raw, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !certOnly {
+			if err := writeKey(cfg.Key, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		mod := time.Now().Add(time.Minute)
+		for _, f := range []string{cfg.Cert, cfg.Key} {
+			if err := os.Chtimes(f, mod, mod); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	replace("second", false, "example.com", "www.example.com")
+	cs.Reload()
+	if got := served(t, cs, "www.example.com"); got != "second" {
+		t.Fatalf("served %s after reload, want second", got)
+	}
+	if names := cs.Status()[0].Names; len(names) != 2 {
+		t.Errorf("status names %v, want the reloaded names", names)
+	}
+
+	// a certificate replaced before its key does not match and the
+	// previous pair keeps serving
+	replace("third", true, "example.com")
+	cs.Reload()
+	if got := served(t, cs, "example.com"); got != "second" {
+		t.Errorf("served %s with a mismatched key, want second", got)
+	}
+}
@@ -0,0 +1,133 @@
+package sec
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"go.uber.org/zap"
+)
+
+// ClientTLSCfg defines TLS to a backend. The embedded parameters
+// apply to the client side of the connection.
+type ClientTLSCfg struct {
+	TLSParams `yaml:",inline"`
+	// CA is a PEM bundle trusted instead of the system roots
+	CA string `yaml:"ca"`
+	// Cert and Key are presented to backends requiring client certificates
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ServerName overrides the SNI name and the name verified in the
+	// backend certificate
+	ServerName string `yaml:"serverName"`
+	// Pins are base64 SHA-256 hashes of a SubjectPublicKeyInfo, one must
+	// match a certificate in the backend chain
+	Pins       []string `yaml:"pins"`
+	SkipVerify bool     `yaml:"skipVerify"`
+}
+
+// listenerOnly are TLSPreferences keys without meaning for a backend
+var listenerOnly = []string{"clientAuth", "certificates", "certReload", "expiryWarning", "ocspStapling", "sessionTickets"}
+
+// UnmarshalYAML refuses listener settings, which would otherwise be
+// ignored without notice
+func (c *ClientTLSCfg) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	keys := make(map[string]interface{}, 0)
+	if err := unmarshal(&keys); err != nil {
+		return err
+	}
+	for _, key := range listenerOnly {
+		if _, ok := keys[key]; ok {
+			return fmt.Errorf("backend tls: %s applies to listeners only", key)
+		}
+	}
+
+	type plain ClientTLSCfg
+	return unmarshal((*plain)(c))
+}
+
+// ErrPinMismatch is returned when no backend certificate matches a pin
+var ErrPinMismatch = errors.New("backend certificate does not match a pinned key")
+
+// SPKIHash returns the base64 SHA-256 hash of a certificate's
+// SubjectPublicKeyInfo as used in Pins
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// NewClientTLSConfig builds a tls.Config for connections to a backend
+func NewClientTLSConfig(cfg ClientTLSCfg, logger *zap.Logger) (*tls.Config, error) {
+	tlsCfg, err := cfg.TLSParams.Config(logger)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg.PreferServerCipherSuites = false
+	tlsCfg.ServerName = cfg.ServerName
+	tlsCfg.InsecureSkipVerify = cfg.SkipVerify
+
+	if cfg.CA != "" {
+		pem, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CA)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.Cert != "" || cfg.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(cfg.Pins) > 0 {
+		pins := make(map[string]bool, len(cfg.Pins))
+		for _, pin := range cfg.Pins {
+			if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %s: expected base64 SHA-256", pin)
+			}
+			pins[pin] = true
+		}
+
+		// runs after chain verification, and also when it is skipped.
+		// Pins match the verified chains, not every certificate the
+		// server sent, which could include a copy of a pinned one;
+		// without verification only the leaf can be trusted to be the
+		// server's.
+		skipVerify := cfg.SkipVerify
+		tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if skipVerify {
+				if len(cs.PeerCertificates) > 0 && pins[SPKIHash(cs.PeerCertificates[0])] {
+					return nil
+				}
+				return ErrPinMismatch
+			}
+
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					if pins[SPKIHash(cert)] {
+						return nil
+					}
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+
+	if cfg.SkipVerify {
+		logger.Warn("Backend TLS verification disabled")
+	}
+
+	return tlsCfg, nil
+}
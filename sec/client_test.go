@@ -0,0 +1,118 @@
+package sec
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+func TestClientTLSPins(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, caKey := testCA(t, "backend CA")
+	other, _ := testCA(t, "other CA")
+	leaf, leafKey := testIssue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := writePEM(caFile, "CERTIFICATE", ca.Raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{testTLSCert(leaf, leafKey, ca)}}
+	backend.StartTLS()
+	defer backend.Close()
+
+	tests := []struct {
+		name       string
+		skipVerify bool
+		pin        *x509.Certificate
+		want       error
+	}{
+		{name: "verified leaf", pin: leaf},
+		{name: "verified CA", pin: ca},
+		{name: "verified other key", pin: other, want: ErrPinMismatch},
+		{name: "unverified leaf", skipVerify: true, pin: leaf},
+		// without verification the rest of the chain proves nothing
+		{name: "unverified CA", skipVerify: true, pin: ca, want: ErrPinMismatch},
+		{name: "unverified other key", skipVerify: true, pin: other, want: ErrPinMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ClientTLSCfg{Pins: []string{SPKIHash(tt.pin)}, SkipVerify: tt.skipVerify}
+			if !tt.skipVerify {
+				cfg.CA = caFile
+				cfg.ServerName = "localhost"
+			}
+
+			tlsCfg, err := NewClientTLSConfig(cfg, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := tls.Dial("tcp", backend.Listener.Addr().String(), tlsCfg)
+			if err == nil {
+				conn.Close()
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("handshake error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientTLSInvalidPin(t *testing.T) {
+	for _, pin := range []string{"not base64!", "c2hvcnQ="} {
+		if _, err := NewClientTLSConfig(ClientTLSCfg{Pins: []string{pin}}, zap.NewNop()); err == nil {
+			t.Errorf("pin %q accepted", pin)
+		}
+	}
+}
+
+func TestClientTLSCfgYaml(t *testing.T) {
+	tests := []struct {
+		name string
+		yml  string
+		err  string
+	}{
+		{name: "shared settings", yml: "profile: modern\nserverName: backend\npins: [abc]\n"},
+		{name: "client auth", yml: "clientAuth:\n  ca: ca.pem\n", err: "clientAuth"},
+		{name: "session tickets", yml: "sessionTickets:\n  keyFile: keys\n", err: "sessionTickets"},
+		{name: "certificates", yml: "certificates:\n  - cert: a.crt\n", err: "certificates"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ClientTLSCfg{}
+			err := yaml.Unmarshal([]byte(tt.yml), &cfg)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cfg.Profile != "modern" || cfg.ServerName != "backend" || len(cfg.Pins) != 1 {
+					t.Errorf("decoded %+v", cfg)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want one naming %s", err, tt.err)
+			}
+		})
+	}
+}
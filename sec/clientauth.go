@@ -0,0 +1,348 @@
+package sec
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Client certificate modes
+var ClientAuthModes = map[string]tls.ClientAuthType{
+	"none":       tls.NoClientCert,
+	"request":    tls.RequestClientCert,
+	"requireAny": tls.RequireAnyClientCert,
+	"optional":   tls.VerifyClientCertIfGiven,
+	"require":    tls.RequireAndVerifyClientCert,
+}
+
+// DefaultClientCertHeaderPrefix starts the client certificate headers
+// sent to the backend
+const DefaultClientCertHeaderPrefix = "X-Client-Cert-"
+
+// ErrCertRevoked is returned for a client certificate listed in the CRL
+var ErrCertRevoked = errors.New("client certificate revoked")
+
+// ClientAuthCfg defines client certificate authentication on the
+// listener
+type ClientAuthCfg struct {
+	// Mode is none, request, requireAny, optional or require (default)
+	Mode string `yaml:"mode"`
+	// CA is a PEM bundle client certificates are verified against
+	CA string `yaml:"ca"`
+	// CRL is a PEM or DER revocation list signed by a CA in the bundle,
+	// reloaded when it changes
+	CRL string `yaml:"crl"`
+	// CRLReload is how often the CRL is checked for changes, default 30s
+	CRLReload time.Duration `yaml:"crlReload"`
+	// Identity selects the identity from a verified certificate: cn
+	// (default), subject, dns, email or uri; SAN types fall back to cn
+	Identity string `yaml:"identity"`
+	// ForwardHeaders sends verified certificate details to the backend
+	ForwardHeaders bool   `yaml:"forwardHeaders"`
+	HeaderPrefix   string `yaml:"headerPrefix"`
+}
+
+// revokedCert identifies a certificate, serial numbers are only unique
+// per issuer
+type revokedCert struct {
+	issuer string // raw issuer name
+	serial string
+}
+
+// ClientAuth verifies client certificates and maps them to identities
+type ClientAuth struct {
+	cfg     ClientAuthCfg
+	mode    tls.ClientAuthType
+	pool    *x509.CertPool
+	caPEM   []byte
+	mu      sync.RWMutex // guards revoked and crlMod
+	revoked map[revokedCert]bool
+	crlMod  time.Time
+	done    chan struct{}
+	logger  *zap.Logger
+}
+
+// NewClientAuth instances a ClientAuth
+func NewClientAuth(cfg ClientAuthCfg, logger *zap.Logger) (*ClientAuth, error) {
+	if cfg.Mode == "" {
+		cfg.Mode = "require"
+	}
+	if cfg.Identity == "" {
+		cfg.Identity = "cn"
+	}
+	if cfg.HeaderPrefix == "" {
+		cfg.HeaderPrefix = DefaultClientCertHeaderPrefix
+	}
+	if cfg.CRLReload <= 0 {
+		cfg.CRLReload = 30 * time.Second
+	}
+
+	mode, ok := ClientAuthModes[cfg.Mode]
+	if !ok {
+		return nil, fmt.Errorf("unknown client auth mode: %s", cfg.Mode)
+	}
+
+	switch cfg.Identity {
+	case "cn", "subject", "dns", "email", "uri":
+	default:
+		return nil, fmt.Errorf("unknown client identity: %s", cfg.Identity)
+	}
+
+	ca := &ClientAuth{
+		cfg:     cfg,
+		mode:    mode,
+		revoked: make(map[revokedCert]bool, 0),
+		done:    make(chan struct{}),
+		logger:  logger,
+	}
+
+	if mode == tls.VerifyClientCertIfGiven || mode == tls.RequireAndVerifyClientCert {
+		if cfg.CA == "" {
+			return nil, fmt.Errorf("client auth mode %s requires a ca bundle", cfg.Mode)
+		}
+
+		pemData, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		ca.pool = x509.NewCertPool()
+		if !ca.pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in client CA bundle %s", cfg.CA)
+		}
+
+		if cfg.CRL != "" {
+			ca.caPEM = pemData
+			if _, err := ca.loadCRL(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	logger.Info("Setting client certificate authentication",
+		zap.String("Mode", cfg.Mode),
+		zap.String("CA", cfg.CA),
+		zap.String("CRL", cfg.CRL),
+		zap.String("Identity", cfg.Identity),
+	)
+
+	return ca, nil
+}
+
+// loadCRL reads the revocation list when it changed since the last
+// load and checks it is signed by a CA in the bundle. The previous list
+// stays in force when the new one is invalid.
+func (ca *ClientAuth) loadCRL() (bool, error) {
+	info, err := os.Stat(ca.cfg.CRL)
+	if err != nil {
+		return false, err
+	}
+
+	ca.mu.RLock()
+	unchanged := info.ModTime().Equal(ca.crlMod)
+	ca.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(ca.cfg.CRL)
+	if err != nil {
+		return false, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return false, fmt.Errorf("crl %s: %s", ca.cfg.CRL, err.Error())
+	}
+
+	signed := false
+	for rest := ca.caPEM; len(rest) > 0; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err == nil && crl.CheckSignatureFrom(cert) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return false, fmt.Errorf("crl %s is not signed by a CA in %s", ca.cfg.CRL, ca.cfg.CA)
+	}
+
+	revoked := make(map[revokedCert]bool, len(crl.RevokedCertificateEntries))
+	for _, entry := range crl.RevokedCertificateEntries {
+		revoked[revokedCert{issuer: string(crl.RawIssuer), serial: entry.SerialNumber.String()}] = true
+	}
+
+	ca.mu.Lock()
+	ca.revoked = revoked
+	ca.crlMod = info.ModTime()
+	ca.mu.Unlock()
+
+	ca.logger.Info("Loaded client CRL", zap.String("CRL", ca.cfg.CRL), zap.Int("Revoked", len(revoked)))
+
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		ca.logger.Warn("Client CRL is past its next update", zap.String("CRL", ca.cfg.CRL), zap.Time("NextUpdate", crl.NextUpdate))
+	}
+
+	return true, nil
+}
+
+// Start checks the CRL for changes until Stop
+func (ca *ClientAuth) Start() {
+	if ca.cfg.CRL == "" || ca.caPEM == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(ca.cfg.CRLReload)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ca.done:
+				return
+			case <-ticker.C:
+				// keep the current list until the file is valid again
+				if _, err := ca.loadCRL(); err != nil {
+					ca.logger.Warn("Client CRL reload failed", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends CRL checks
+func (ca *ClientAuth) Stop() {
+	close(ca.done)
+}
+
+// Apply sets client certificate verification on a listener config.
+// Revocation is checked in VerifyConnection, which unlike
+// VerifyPeerCertificate also runs on resumed sessions.
+func (ca *ClientAuth) Apply(tlsCfg *tls.Config) {
+	tlsCfg.ClientAuth = ca.mode
+	tlsCfg.ClientCAs = ca.pool
+
+	if ca.caPEM != nil {
+		tlsCfg.VerifyConnection = ca.verifyConnection
+	}
+}
+
+// verifyConnection refuses verified chains whose leaf is in the CRL
+func (ca *ClientAuth) verifyConnection(cs tls.ConnectionState) error {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+
+	for _, chain := range cs.VerifiedChains {
+		if len(chain) == 0 {
+			continue
+		}
+		leaf := chain[0]
+		if ca.revoked[revokedCert{issuer: string(leaf.RawIssuer), serial: leaf.SerialNumber.String()}] {
+			return ErrCertRevoked
+		}
+	}
+
+	return nil
+}
+
+// Identify returns the identity of a verified client certificate, empty
+// when the client presented none or it was not verified. Identify on a
+// nil ClientAuth returns empty.
+func (ca *ClientAuth) Identify(r *http.Request) string {
+	if ca == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	switch ca.cfg.Identity {
+	case "subject":
+		return cert.Subject.String()
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	}
+
+	return cert.Subject.CommonName
+}
+
+// Forward removes client certificate headers sent by the client and,
+// when enabled, sets them from the verified certificate. On a nil
+// ClientAuth headers with the default prefix are removed, so clients
+// of listeners without client certificates cannot pose as one.
+func (ca *ClientAuth) Forward(r *http.Request, identity string) {
+	prefix := DefaultClientCertHeaderPrefix
+	if ca != nil {
+		prefix = ca.cfg.HeaderPrefix
+	}
+
+	prefix = http.CanonicalHeaderKey(prefix)
+	for name := range r.Header {
+		if strings.HasPrefix(name, prefix) {
+			r.Header.Del(name)
+		}
+	}
+
+	if ca == nil || !ca.cfg.ForwardHeaders || identity == "" {
+		return
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	r.Header.Set(prefix+"Identity", identity)
+	r.Header.Set(prefix+"Subject", cert.Subject.String())
+	r.Header.Set(prefix+"Issuer", cert.Issuer.String())
+	r.Header.Set(prefix+"Serial", cert.SerialNumber.String())
+	r.Header.Set(prefix+"Fingerprint", hex.EncodeToString(fingerprint[:]))
+	r.Header.Set(prefix+"Not-After", cert.NotAfter.UTC().Format(time.RFC3339))
+	r.Header.Set(prefix+"Pem", url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))))
+}
+
+type identityKey struct{}
+
+// NewIdentityContext returns a context carrying a client identity
+func NewIdentityContext(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the client identity, empty if none
+func IdentityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
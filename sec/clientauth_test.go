@@ -0,0 +1,247 @@
+package sec
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// writeCRL writes a PEM CRL signed by the CA listing serials
+func writeCRL(t *testing.T, filename string, number int64, ca *x509.Certificate, caKey *ecdsa.PrivateKey, serials ...*big.Int) {
+	t.Helper()
+
+	tpl := &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(24 * time.Hour),
+	}
+	for _, serial := range serials {
+		tpl.RevokedCertificateEntries = append(tpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, tpl, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writePEM(filename, "X509 CRL", der, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rewrite within the file system's timestamp resolution must
+	// still count as a change
+	mod := time.Now().Add(time.Duration(number) * time.Second)
+	if err := os.Chtimes(filename, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientAuthRevocation(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, caKey := testCA(t, "client CA")
+	other, otherKey := testCA(t, "other CA")
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := writePEM(caFile, "CERTIFICATE", ca.Raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	revoked, _ := testIssue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "revoked"}}, ca, caKey)
+	good, _ := testIssue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "good"}}, ca, caKey)
+	// same serial, different issuer
+	twin, _ := testIssue(t, &x509.Certificate{SerialNumber: revoked.SerialNumber, Subject: pkix.Name{CommonName: "twin"}}, other, otherKey)
+
+	crlFile := filepath.Join(dir, "ca.crl")
+	writeCRL(t, crlFile, 1, ca, caKey, revoked.SerialNumber)
+
+	auth, err := NewClientAuth(ClientAuthCfg{CA: caFile, CRL: crlFile}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		leaf *x509.Certificate
+		want error
+	}{
+		{name: "revoked", leaf: revoked, want: ErrCertRevoked},
+		{name: "not revoked", leaf: good},
+		{name: "same serial from another issuer", leaf: twin},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.leaf, ca}}}
+			if err := auth.verifyConnection(cs); err != tt.want {
+				t.Errorf("verifyConnection = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientAuthCRLReload(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, caKey := testCA(t, "client CA")
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := writePEM(caFile, "CERTIFICATE", ca.Raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := testIssue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}, ca, caKey)
+	cs := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf, ca}}}
+
+	crlFile := filepath.Join(dir, "ca.crl")
+	writeCRL(t, crlFile, 1, ca, caKey)
+
+	auth, err := NewClientAuth(ClientAuthCfg{CA: caFile, CRL: crlFile}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.verifyConnection(cs); err != nil {
+		t.Fatalf("before revocation: %v", err)
+	}
+
+	// unchanged file
+	if changed, err := auth.loadCRL(); changed || err != nil {
+		t.Fatalf("loadCRL = %t %v, want no change", changed, err)
+	}
+
+	writeCRL(t, crlFile, 2, ca, caKey, leaf.SerialNumber)
+	if changed, err := auth.loadCRL(); !changed || err != nil {
+		t.Fatalf("loadCRL = %t %v, want a reload", changed, err)
+	}
+	if err := auth.verifyConnection(cs); err != ErrCertRevoked {
+		t.Fatalf("after revocation: %v, want ErrCertRevoked", err)
+	}
+
+	// an invalid CRL keeps the previous list
+	if err := ioutil.WriteFile(crlFile, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mod := time.Now().Add(time.Hour)
+	os.Chtimes(crlFile, mod, mod)
+	if _, err := auth.loadCRL(); err == nil {
+		t.Fatal("loadCRL accepted an invalid CRL")
+	}
+	if err := auth.verifyConnection(cs); err != ErrCertRevoked {
+		t.Fatalf("after an invalid CRL: %v, want ErrCertRevoked", err)
+	}
+}
+
+// handshake connects client and server over loopback and reports
+// whether the session was resumed, with the server's handshake error
+func handshake(t *testing.T, serverCfg *tls.Config, clientCfg *tls.Config) (bool, error) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cconn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cconn.Close()
+	sconn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		defer sconn.Close()
+		srv := tls.Server(sconn, serverCfg)
+		if err := srv.Handshake(); err != nil {
+			serverErr <- err
+			return
+		}
+		// the client reads session tickets along with this byte
+		_, err := srv.Write([]byte{1})
+		serverErr <- err
+	}()
+
+	client := tls.Client(cconn, clientCfg)
+	resumed := false
+	if err := client.Handshake(); err == nil {
+		resumed = client.ConnectionState().DidResume
+		client.Read(make([]byte, 1))
+	}
+
+	return resumed, <-serverErr
+}
+
+func TestClientAuthRevokedResumption(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, caKey := testCA(t, "CA")
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := writePEM(caFile, "CERTIFICATE", ca.Raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	server, serverKey := testIssue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	client, clientKey := testIssue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	crlFile := filepath.Join(dir, "ca.crl")
+	writeCRL(t, crlFile, 1, ca, caKey)
+
+	auth, err := NewClientAuth(ClientAuthCfg{CA: caFile, CRL: crlFile}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCfg := &tls.Config{Certificates: []tls.Certificate{testTLSCert(server, serverKey)}}
+	auth.Apply(serverCfg)
+
+	clientCfg := &tls.Config{
+		ServerName:         "localhost",
+		RootCAs:            pool,
+		Certificates:       []tls.Certificate{testTLSCert(client, clientKey)},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+
+	if _, err := handshake(t, serverCfg, clientCfg); err != nil {
+		t.Fatalf("full handshake: %v", err)
+	}
+	resumed, err := handshake(t, serverCfg, clientCfg)
+	if err != nil {
+		t.Fatalf("resumed handshake: %v", err)
+	}
+	if !resumed {
+		t.Fatal("the session was not resumed")
+	}
+
+	writeCRL(t, crlFile, 2, ca, caKey, client.SerialNumber)
+	if _, err := auth.loadCRL(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := handshake(t, serverCfg, clientCfg); !errors.Is(err, ErrCertRevoked) {
+		t.Errorf("handshake after revocation: %v, want ErrCertRevoked", err)
+	}
+}
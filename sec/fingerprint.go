@@ -0,0 +1,255 @@
+package sec
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Headers carrying client fingerprints to the backend
+const (
+	JA3Header = "X-JA3-Fingerprint"
+	JA4Header = "X-JA4-Fingerprint"
+)
+
+// TLS extensions JA3 and JA4 treat specially
+const (
+	extServerName        = 0x0000
+	extALPN              = 0x0010
+	extSupportedVersions = 0x002b
+	extQUICTransport     = 0x0039
+)
+
+// Fingerprint identifies the TLS client software of a connection
+type Fingerprint struct {
+	JA3     string // version,ciphers,extensions,curves,point formats
+	JA3Hash string // MD5 of JA3, the value usually shared
+	JA4     string
+}
+
+type fingerprintKey struct{}
+
+// NewFingerprintContext prepares a connection context to carry the
+// fingerprint of its ClientHello, see http.Server.ConnContext
+func NewFingerprintContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fingerprintKey{}, new(atomic.Pointer[Fingerprint]))
+}
+
+// FingerprintFromContext returns the fingerprint of the connection a
+// request arrived on, empty without TLS
+func FingerprintFromContext(ctx context.Context) Fingerprint {
+	holder, _ := ctx.Value(fingerprintKey{}).(*atomic.Pointer[Fingerprint])
+	if holder == nil {
+		return Fingerprint{}
+	}
+	if fp := holder.Load(); fp != nil {
+		return *fp
+	}
+	return Fingerprint{}
+}
+
+// FingerprintClientHello records the fingerprint of a ClientHello on
+// the connection context. It is a tls.Config.GetConfigForClient that
+// keeps the original configuration.
+func FingerprintClientHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	holder, _ := hello.Context().Value(fingerprintKey{}).(*atomic.Pointer[Fingerprint])
+	if holder == nil {
+		return nil, nil
+	}
+
+	ja3 := JA3(hello)
+	sum := md5.Sum([]byte(ja3))
+
+	holder.Store(&Fingerprint{
+		JA3:     ja3,
+		JA3Hash: hex.EncodeToString(sum[:]),
+		JA4:     JA4(hello),
+	})
+
+	return nil, nil
+}
+
+// ForwardFingerprint removes fingerprint headers sent by the client and
+// sets them from the connection
+func ForwardFingerprint(r *http.Request, fp Fingerprint) {
+	r.Header.Del(JA3Header)
+	r.Header.Del(JA4Header)
+
+	if fp.JA3Hash != "" {
+		r.Header.Set(JA3Header, fp.JA3Hash)
+	}
+	if fp.JA4 != "" {
+		r.Header.Set(JA4Header, fp.JA4)
+	}
+}
+
+// grease reports RFC 8701 reserved values clients send at random
+func grease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// helloVersion is the highest version offered, the legacy version when
+// the client sends no supported_versions extension
+func helloVersion(hello *tls.ClientHelloInfo) uint16 {
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if !grease(v) && v > version {
+			version = v
+		}
+	}
+	return version
+}
+
+func hasExtension(hello *tls.ClientHelloInfo, ext uint16) bool {
+	for _, e := range hello.Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// JA3 returns the JA3 string of a ClientHello, GREASE values removed
+func JA3(hello *tls.ClientHelloInfo) string {
+	// clients offering TLS 1.3 send the 1.2 legacy version
+	version := helloVersion(hello)
+	if hasExtension(hello, extSupportedVersions) && version > tls.VersionTLS12 {
+		version = tls.VersionTLS12
+	}
+
+	curves := make([]uint16, 0, len(hello.SupportedCurves))
+	for _, c := range hello.SupportedCurves {
+		curves = append(curves, uint16(c))
+	}
+
+	points := make([]uint16, 0, len(hello.SupportedPoints))
+	for _, p := range hello.SupportedPoints {
+		points = append(points, uint16(p))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(version)),
+		joinDecimal(hello.CipherSuites),
+		joinDecimal(hello.Extensions),
+		joinDecimal(curves),
+		joinDecimal(points),
+	}, ",")
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if !grease(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// JA4 returns the JA4 fingerprint of a ClientHello
+func JA4(hello *tls.ClientHelloInfo) string {
+	// QUIC ClientHellos carry transport parameters, quic-go sets a
+	// Conn with the connection addresses
+	proto := "t"
+	if hello.Conn == nil || hasExtension(hello, extQUICTransport) {
+		proto = "q"
+	}
+
+	var version string
+	switch helloVersion(hello) {
+	case tls.VersionTLS13:
+		version = "13"
+	case tls.VersionTLS12:
+		version = "12"
+	case tls.VersionTLS11:
+		version = "11"
+	case tls.VersionTLS10:
+		version = "10"
+	case tls.VersionSSL30:
+		version = "s3"
+	default:
+		version = "00"
+	}
+
+	sni := "i"
+	if hello.ServerName != "" {
+		sni = "d"
+	}
+
+	ciphers := hexList(hello.CipherSuites, nil)
+	extensions := hexList(hello.Extensions, nil)
+
+	alpn := "00"
+	if len(hello.SupportedProtos) > 0 && hello.SupportedProtos[0] != "" {
+		alpn = alpnChars(hello.SupportedProtos[0])
+	}
+
+	a := fmt.Sprintf("%s%s%s%02d%02d%s", proto, version, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	sort.Strings(ciphers)
+	b := truncatedHash(strings.Join(ciphers, ","))
+
+	// the c part leaves out SNI and ALPN, and adds signature algorithms
+	// in the order offered
+	sorted := hexList(hello.Extensions, map[uint16]bool{extServerName: true, extALPN: true})
+	sort.Strings(sorted)
+
+	schemes := make([]uint16, 0, len(hello.SignatureSchemes))
+	for _, s := range hello.SignatureSchemes {
+		schemes = append(schemes, uint16(s))
+	}
+
+	c := strings.Join(sorted, ",")
+	if sigs := hexList(schemes, nil); len(sigs) > 0 {
+		c += "_" + strings.Join(sigs, ",")
+	}
+	if len(sorted) > 0 {
+		c = truncatedHash(c)
+	} else {
+		c = "000000000000"
+	}
+
+	return a + "_" + b + "_" + c
+}
+
+// hexList formats values as 4 digit hex without GREASE or skipped values
+func hexList(values []uint16, skip map[uint16]bool) []string {
+	list := make([]string, 0, len(values))
+	for _, v := range values {
+		if !grease(v) && !skip[v] {
+			list = append(list, fmt.Sprintf("%04x", v))
+		}
+	}
+	return list
+}
+
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// alpnChars is the first and last character of an ALPN value, or of
+// its hex form when either is not alphanumeric
+func alpnChars(alpn string) string {
+	first, last := alpn[0], alpn[len(alpn)-1]
+	if alnum(first) && alnum(last) {
+		return string([]byte{first, last})
+	}
+	h := hex.EncodeToString([]byte(alpn))
+	return string([]byte{h[0], h[len(h)-1]})
+}
+
+func alnum(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
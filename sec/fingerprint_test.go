@@ -0,0 +1,185 @@
+package sec
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+// chromeHello is the ClientHello of the JA4 technical details example,
+// with the GREASE values Chrome adds
+func chromeHello(conn net.Conn) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		Conn:       conn,
+		ServerName: "example.com",
+		CipherSuites: []uint16{
+			0x0a0a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+			0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+		},
+		Extensions: []uint16{
+			0x1a1a, 0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010,
+			0x0005, 0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x0015,
+			0x4469, 0x2a2a,
+		},
+		SupportedVersions: []uint16{0x3a3a, tls.VersionTLS13, tls.VersionTLS12},
+		SupportedProtos:   []string{"h2", "http/1.1"},
+		SignatureSchemes: []tls.SignatureScheme{
+			0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601,
+		},
+		SupportedCurves: []tls.CurveID{0x4a4a, tls.X25519, tls.CurveP256, tls.CurveP384},
+		SupportedPoints: []uint8{0},
+	}
+}
+
+func TestJA4(t *testing.T) {
+	tcp, _ := net.Pipe()
+
+	tests := []struct {
+		name  string
+		hello func() *tls.ClientHelloInfo
+		want  string
+	}{
+		{
+			name:  "published example",
+			hello: func() *tls.ClientHelloInfo { return chromeHello(tcp) },
+			want:  "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "ip address",
+			hello: func() *tls.ClientHelloInfo {
+				h := chromeHello(tcp)
+				h.ServerName = ""
+				return h
+			},
+			want: "t13i1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "tls 1.2 without alpn",
+			hello: func() *tls.ClientHelloInfo {
+				h := chromeHello(tcp)
+				h.SupportedVersions = []uint16{tls.VersionTLS12}
+				h.SupportedProtos = nil
+				return h
+			},
+			want: "t12d151600_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "non alphanumeric alpn",
+			hello: func() *tls.ClientHelloInfo {
+				h := chromeHello(tcp)
+				h.SupportedProtos = []string{"\xab"}
+				return h
+			},
+			want: "t13d1516ab_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			name: "empty hello",
+			hello: func() *tls.ClientHelloInfo {
+				return &tls.ClientHelloInfo{Conn: tcp}
+			},
+			want: "t00i000000_000000000000_000000000000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := JA4(tt.hello()); got != tt.want {
+				t.Errorf("JA4 = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJA4Transport(t *testing.T) {
+	tcp, _ := net.Pipe()
+
+	tests := []struct {
+		name  string
+		conn  net.Conn
+		quic  bool
+		proto byte
+	}{
+		{name: "tcp", conn: tcp, proto: 't'},
+		{name: "quic transport parameters", conn: tcp, quic: true, proto: 'q'},
+		{name: "quic without a conn", proto: 'q'},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := chromeHello(tt.conn)
+			if tt.quic {
+				h.Extensions = append(h.Extensions, extQUICTransport)
+			}
+			if got := JA4(h); got[0] != tt.proto {
+				t.Errorf("JA4 = %s, want it to start with %c", got, tt.proto)
+			}
+		})
+	}
+}
+
+func TestJA3(t *testing.T) {
+	tcp, _ := net.Pipe()
+
+	hello := chromeHello(tcp)
+	want := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-21-17513,29-23-24,0"
+
+	if got := JA3(hello); got != want {
+		t.Errorf("JA3 = %s, want %s", got, want)
+	}
+}
+
+func TestGrease(t *testing.T) {
+	tests := []struct {
+		v    uint16
+		want bool
+	}{
+		{0x0a0a, true},
+		{0x1a1a, true},
+		{0xfafa, true},
+		{0x0a1a, false},
+		{0x1301, false},
+		{0x0000, false},
+	}
+
+	for _, tt := range tests {
+		if got := grease(tt.v); got != tt.want {
+			t.Errorf("grease(%#04x) = %t, want %t", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestForwardFingerprint(t *testing.T) {
+	tests := []struct {
+		name    string
+		fp      Fingerprint
+		wantJA3 string
+		wantJA4 string
+	}{
+		{name: "spoofed headers removed without a fingerprint"},
+		{
+			name:    "headers set from the connection",
+			fp:      Fingerprint{JA3Hash: "abc", JA4: "t13d1516h2_x_y"},
+			wantJA3: "abc",
+			wantJA4: "t13d1516h2_x_y",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set(JA3Header, "spoofed")
+			r.Header.Set(JA4Header, "spoofed")
+
+			ForwardFingerprint(r, tt.fp)
+
+			if got := r.Header.Get(JA3Header); got != tt.wantJA3 {
+				t.Errorf("%s = %q, want %q", JA3Header, got, tt.wantJA3)
+			}
+			if got := r.Header.Get(JA4Header); got != tt.wantJA4 {
+				t.Errorf("%s = %q, want %q", JA4Header, got, tt.wantJA4)
+			}
+		})
+	}
+}
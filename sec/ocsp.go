@@ -0,0 +1,96 @@
+package sec
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ErrNoResponder is returned for certificates without an OCSP responder
+var ErrNoResponder = errors.New("certificate has no OCSP responder")
+
+// ocspClient fetches staples from responders
+var ocspClient = &http.Client{Timeout: 10 * time.Second}
+
+// fetchOCSP asks the certificate's responder for a signed status
+func fetchOCSP(leaf *x509.Certificate, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, ErrNoResponder
+	}
+	if issuer == nil {
+		return nil, nil, fmt.Errorf("OCSP requires the issuer certificate, add it to the chain or set issuer")
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := ocspClient.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder returned %s", resp.Status)
+	}
+
+	der, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return der, parsed, nil
+}
+
+// readOCSP loads a DER staple from a file, checking its signature
+// against the issuer
+func readOCSP(filename string, leaf *x509.Certificate, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	if issuer == nil {
+		return nil, nil, fmt.Errorf("OCSP staple %s requires the issuer certificate, add it to the chain or set issuer", filename)
+	}
+
+	der, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(der, leaf, issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("OCSP staple %s: %s", filename, err.Error())
+	}
+
+	return der, parsed, nil
+}
+
+// ocspStatus names an OCSP certificate status
+func ocspStatus(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	}
+	return "unknown"
+}
+
+// ocspRefreshAt is halfway through a response's validity, an hour after
+// it was produced when it has no next update
+func ocspRefreshAt(resp *ocsp.Response) time.Time {
+	if resp.NextUpdate.IsZero() {
+		return resp.ThisUpdate.Add(time.Hour)
+	}
+	return resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+}
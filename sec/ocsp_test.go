@@ -0,0 +1,225 @@
+package sec
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspResponder answers OCSP requests for certificates of its CA
+type ocspResponder struct {
+	ca         *x509.Certificate
+	caKey      *ecdsa.PrivateKey
+	status     int
+	nextUpdate time.Duration // from now, negative for expired responses
+}
+
+func (r *ocspResponder) serve(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ocspReq, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	der, err := ocspResponse(r.ca, r.caKey, ocspReq.SerialNumber.Int64(), r.status, r.nextUpdate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(der)
+}
+
+// ocspResponse signs a response for a serial, valid until nextUpdate
+// from now
+func ocspResponse(ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial int64, status int, nextUpdate time.Duration) ([]byte, error) {
+	now := time.Now()
+	tpl := ocsp.Response{
+		Status:       status,
+		SerialNumber: bigInt(serial),
+		ThisUpdate:   now.Add(nextUpdate - 2*time.Hour),
+		NextUpdate:   now.Add(nextUpdate),
+	}
+	if status == ocsp.Revoked {
+		tpl.RevokedAt = now.Add(-time.Hour)
+	}
+	return ocsp.CreateResponse(ca, ca, tpl, caKey)
+}
+
+// ocspPair writes a certificate for the responder at url, with its CA
+// in the chain unless noChain
+func ocspPair(t *testing.T, dir string, url string, noChain bool) (CertCfg, *x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	ca, caKey := testCA(t, "CA")
+	leaf, key := testIssue(t, &x509.Certificate{
+		SerialNumber: bigInt(1000),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		OCSPServer:   []string{url},
+	}, ca, caKey)
+
+	certFile, keyFile := writeTestPair(t, dir, "tls", leaf, key)
+	if !noChain {
+		chain, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, pemCert(ca)...)
+		if err := ioutil.WriteFile(certFile, chain, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return CertCfg{Cert: certFile, Key: keyFile}, ca, caKey
+}
+
+// stapled returns the staple served and the reported OCSP status
+func stapled(t *testing.T, cs *Certificates) ([]byte, string) {
+	t.Helper()
+
+	cert, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.OCSPStaple, cs.Status()[0].OCSP
+}
+
+func TestOCSPStapling(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		nextUpdate  time.Duration
+		unreachable bool
+		stapled     bool
+		want        string
+	}{
+		{name: "good", status: ocsp.Good, nextUpdate: time.Hour, stapled: true, want: "good"},
+		{name: "revoked", status: ocsp.Revoked, nextUpdate: time.Hour, want: "revoked"},
+		{name: "unknown", status: ocsp.Unknown, nextUpdate: time.Hour, want: "unknown"},
+		{name: "expired", status: ocsp.Good, nextUpdate: -time.Minute},
+		{name: "unreachable", unreachable: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			// the responder needs the CA, which needs the responder URL
+			var responder *ocspResponder
+			url := "http://127.0.0.1:1/"
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				responder.serve(w, r)
+			}))
+			if !tt.unreachable {
+				srv.Start()
+				defer srv.Close()
+				url = srv.URL
+			}
+
+			cfg, ca, caKey := ocspPair(t, dir, url, false)
+			responder = &ocspResponder{ca: ca, caKey: caKey, status: tt.status, nextUpdate: tt.nextUpdate}
+
+			cs, err := NewCertificates([]CertCfg{cfg}, CertOptions{OCSPStapling: true}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			staple, status := stapled(t, cs)
+			if (staple != nil) != tt.stapled {
+				t.Errorf("stapled %t, want %t", staple != nil, tt.stapled)
+			}
+			if status != tt.want {
+				t.Errorf("status %q, want %q", status, tt.want)
+			}
+		})
+	}
+}
+
+func TestOCSPStapleExpires(t *testing.T) {
+	dir := t.TempDir()
+
+	var responder *ocspResponder
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responder.serve(w, r)
+	}))
+	defer srv.Close()
+
+	cfg, ca, caKey := ocspPair(t, dir, srv.URL, false)
+	responder = &ocspResponder{ca: ca, caKey: caKey, status: ocsp.Good, nextUpdate: time.Hour}
+
+	cs, err := NewCertificates([]CertCfg{cfg}, CertOptions{OCSPStapling: true}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if staple, _ := stapled(t, cs); staple == nil {
+		t.Fatal("no staple from the responder")
+	}
+
+	// the responder goes away
+	srv.Close()
+
+	now := time.Now()
+	cs.check(now.Add(45 * time.Minute))
+	if staple, status := stapled(t, cs); staple == nil || status != "good" {
+		t.Errorf("before next update: stapled %t status %q, want the previous staple", staple != nil, status)
+	}
+
+	cs.check(now.Add(2 * time.Hour))
+	if staple, status := stapled(t, cs); staple != nil || status != "expired" {
+		t.Errorf("after next update: stapled %t status %q, want no staple", staple != nil, status)
+	}
+}
+
+func TestOCSPFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		noChain    bool
+		nextUpdate time.Duration
+		stapled    bool
+	}{
+		{name: "current", nextUpdate: time.Hour, stapled: true},
+		{name: "expired", nextUpdate: -time.Minute},
+		{name: "without the issuer", noChain: true, nextUpdate: time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			cfg, ca, caKey := ocspPair(t, dir, "http://127.0.0.1:1/", tt.noChain)
+			der, err := ocspResponse(ca, caKey, 1000, ocsp.Good, tt.nextUpdate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.OCSP = filepath.Join(dir, "tls.ocsp")
+			if err := ioutil.WriteFile(cfg.OCSP, der, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cs, err := NewCertificates([]CertCfg{cfg}, CertOptions{}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if staple, _ := stapled(t, cs); (staple != nil) != tt.stapled {
+				t.Errorf("stapled %t, want %t", staple != nil, tt.stapled)
+			}
+		})
+	}
+}
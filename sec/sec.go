@@ -2,7 +2,9 @@ package sec
 
 import (
 	"crypto/tls"
+	"fmt"
 	"io/ioutil"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -16,6 +18,7 @@ var (
 		"VersionTLS10": tls.VersionTLS10,
 		"VersionTLS11": tls.VersionTLS11,
 		"VersionTLS12": tls.VersionTLS12,
+		"VersionTLS13": tls.VersionTLS13,
 	}
 
 	Curves = map[string]tls.CurveID{
@@ -51,74 +54,181 @@ var (
 	}
 )
 
+// Mozilla style profiles, see https://wiki.mozilla.org/Security/Server_Side_TLS.
+// TLS 1.3 cipher suites are not configurable and always enabled.
+var Profiles = map[string]TLSParams{
+	"modern": {
+		Min:              "VersionTLS13",
+		CurvePreferences: []string{"X25519", "CurveP256", "CurveP384"},
+	},
+	"intermediate": {
+		Min:              "VersionTLS12",
+		CurvePreferences: []string{"X25519", "CurveP256", "CurveP384"},
+		Ciphers:          intermediateCiphers,
+	},
+	"old": {
+		Min:              "VersionTLS10",
+		CurvePreferences: []string{"X25519", "CurveP256", "CurveP384"},
+		Ciphers: append(append([]string{}, intermediateCiphers...),
+			"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+			"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+			"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+			"TLS_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_RSA_WITH_AES_128_CBC_SHA256",
+			"TLS_RSA_WITH_AES_128_CBC_SHA",
+			"TLS_RSA_WITH_AES_256_CBC_SHA",
+		),
+	},
+}
+
+var intermediateCiphers = []string{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+}
+
+// WeakCiphers are refused unless AllowWeakCiphers is set
+var WeakCiphers = map[string]bool{
+	"TLS_RSA_WITH_RC4_128_SHA":            true,
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":       true,
+	"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":    true,
+	"TLS_ECDHE_RSA_WITH_RC4_128_SHA":      true,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA": true,
+}
+
 type TLSPreferences struct {
+	TLSParams `yaml:",inline"`
+	// ClientAuth and the certificate settings apply to the listener only
+	ClientAuth *ClientAuthCfg `yaml:"clientAuth"`
+	// Certificates are selected by SNI, replacing --crt and --key
+	Certificates []CertCfg `yaml:"certificates"`
+	// CertReload is how often certificate files are checked for changes
+	CertReload time.Duration `yaml:"certReload"`
+	// ExpiryWarning logs certificates this close to expiry
+	ExpiryWarning time.Duration `yaml:"expiryWarning"`
+	// OCSPStapling staples responses from each certificate's responder
+	OCSPStapling bool `yaml:"ocspStapling"`
+	// SessionTickets shares ticket keys across replicas
+	SessionTickets *SessionTicketCfg `yaml:"sessionTickets"`
+}
+
+// tlsVersion looks up a version name, empty leaves the crypto/tls default
+func tlsVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+
+	version, ok := TLSVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version: %s", name)
+	}
+
+	return version, nil
+}
+
+// TLSParams are the protocol settings shared by listeners and backends
+type TLSParams struct {
+	// Profile is modern, intermediate or old; fields set alongside it
+	// override the profile
+	Profile          string   `yaml:"profile"`
 	Min              string   `yaml:"min"`
 	Max              string   `yaml:"max"`
 	CurvePreferences []string `yaml:"curvePreferences"`
 	Ciphers          []string `yaml:"ciphers"`
+	AllowWeakCiphers bool     `yaml:"allowWeakCiphers"`
 }
 
-func GenericTLSConfig() *tls.Config {
-	return &tls.Config{
-		MinVersion:               tls.VersionTLS10,
-		MaxVersion:               tls.VersionTLS12,
-		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-		PreferServerCipherSuites: true,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-		},
-	}
-}
+// Config builds a tls.Config from the parameters. Unknown names and
+// weak ciphers, unless allowed, are errors.
+func (p TLSParams) Config(logger *zap.Logger) (*tls.Config, error) {
+	if p.Profile != "" {
+		profile, ok := Profiles[p.Profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS profile: %s", p.Profile)
+		}
+		if p.Min == "" {
+			p.Min = profile.Min
+		}
+		if p.Max == "" {
+			p.Max = profile.Max
+		}
+		if len(p.CurvePreferences) == 0 {
+			p.CurvePreferences = profile.CurvePreferences
+		}
+		if len(p.Ciphers) == 0 {
+			p.Ciphers = profile.Ciphers
+		}
 
-// NewTLSCfgFromYaml
-func NewTLSCfgFromYaml(filename string, logger *zap.Logger) (*tls.Config, error) {
+		logger.Info("Setting TLS profile", zap.String("Profile", p.Profile))
+	}
 
-	ymlData, err := ioutil.ReadFile(filename)
+	minVersion, err := tlsVersion(p.Min)
 	if err != nil {
 		return nil, err
 	}
 
-	tlsPreferences := TLSPreferences{}
-
-	err = yaml.Unmarshal([]byte(ymlData), &tlsPreferences)
+	maxVersion, err := tlsVersion(p.Max)
 	if err != nil {
 		return nil, err
 	}
 
+	if maxVersion != 0 && minVersion > maxVersion {
+		return nil, fmt.Errorf("TLS min version %s is above max version %s", p.Min, p.Max)
+	}
+
 	logger.Info("Setting MIN TLS version",
-		zap.String("TLSVersionName", tlsPreferences.Min),
-		zap.Uint16("TLSVersionID", TLSVersions[tlsPreferences.Min]),
+		zap.String("TLSVersionName", p.Min),
+		zap.Uint16("TLSVersionID", minVersion),
 	)
 
 	logger.Info("Setting MAX TLS version",
-		zap.String("TLSVersionName", tlsPreferences.Max),
-		zap.Uint16("TLSVersionID", TLSVersions[tlsPreferences.Max]),
+		zap.String("TLSVersionName", p.Max),
+		zap.Uint16("TLSVersionID", maxVersion),
 	)
 
 	logger.Info("Setting Curve Preferences",
-		zap.Strings("Curves", tlsPreferences.CurvePreferences),
+		zap.Strings("Curves", p.CurvePreferences),
 	)
 
 	logger.Info("Setting Ciphers",
-		zap.Strings("Ciphers", tlsPreferences.Ciphers),
+		zap.Strings("Ciphers", p.Ciphers),
 	)
 
-	curveIDs := make([]tls.CurveID, 0)
-	for _, curveName := range tlsPreferences.CurvePreferences {
-		curveIDs = append(curveIDs, Curves[curveName])
+	// nil leaves the crypto/tls defaults in place
+	var curveIDs []tls.CurveID
+	for _, curveName := range p.CurvePreferences {
+		curveID, ok := Curves[curveName]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve: %s", curveName)
+		}
+		curveIDs = append(curveIDs, curveID)
 	}
 
-	cipher := make([]uint16, 0)
-	for _, cipherName := range tlsPreferences.Ciphers {
-		cipher = append(cipher, Ciphers[cipherName])
+	var cipher []uint16
+	for _, cipherName := range p.Ciphers {
+		cipherID, ok := Ciphers[cipherName]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher: %s", cipherName)
+		}
+		if WeakCiphers[cipherName] {
+			if !p.AllowWeakCiphers {
+				return nil, fmt.Errorf("weak cipher %s refused, set allowWeakCiphers to enable it", cipherName)
+			}
+			logger.Warn("Weak cipher enabled", zap.String("Cipher", cipherName))
+		}
+		cipher = append(cipher, cipherID)
 	}
 
 	tlsCfg := &tls.Config{
-		MinVersion:               TLSVersions[tlsPreferences.Min],
-		MaxVersion:               TLSVersions[tlsPreferences.Max],
+		MinVersion:               minVersion,
+		MaxVersion:               maxVersion,
 		CurvePreferences:         curveIDs,
 		PreferServerCipherSuites: true,
 		CipherSuites:             cipher,
@@ -126,3 +236,49 @@ func NewTLSCfgFromYaml(filename string, logger *zap.Logger) (*tls.Config, error)
 
 	return tlsCfg, nil
 }
+
+// GenericTLSConfig is the intermediate profile
+func GenericTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		CurvePreferences:         []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+		PreferServerCipherSuites: true,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+	}
+}
+
+// NewTLSPreferencesFromYaml loads TLS preferences from yaml data
+func NewTLSPreferencesFromYaml(filename string) (*TLSPreferences, error) {
+
+	ymlData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsPreferences := &TLSPreferences{}
+
+	err = yaml.Unmarshal([]byte(ymlData), tlsPreferences)
+	if err != nil {
+		return nil, err
+	}
+
+	return tlsPreferences, nil
+}
+
+// NewTLSCfgFromYaml
+func NewTLSCfgFromYaml(filename string, logger *zap.Logger) (*tls.Config, error) {
+
+	tlsPreferences, err := NewTLSPreferencesFromYaml(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return tlsPreferences.Config(logger)
+}
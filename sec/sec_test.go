@@ -0,0 +1,202 @@
+package sec
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// testCA returns a CA certificate and its key
+func testCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	return testIssue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+}
+
+// testIssue signs tpl with the CA, or self-signs it without one. The
+// serial and validity are set unless tpl has them.
+func testIssue(t *testing.T, tpl *x509.Certificate, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tpl.SerialNumber == nil {
+		tpl.SerialNumber = serialNumber()
+	}
+	if tpl.NotBefore.IsZero() {
+		tpl.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if tpl.NotAfter.IsZero() {
+		tpl.NotAfter = time.Now().Add(24 * time.Hour)
+	}
+
+	parent, parentKey := tpl, key
+	if ca != nil {
+		parent, parentKey = ca, caKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+// testTLSCert pairs a certificate, and its chain, with its key
+func testTLSCert(cert *x509.Certificate, key *ecdsa.PrivateKey, chain ...*x509.Certificate) tls.Certificate {
+	pair := tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+	for _, c := range chain {
+		pair.Certificate = append(pair.Certificate, c.Raw)
+	}
+	return pair
+}
+
+// writeTestPair writes a certificate and key as PEM files in dir
+func writeTestPair(t *testing.T, dir string, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	t.Helper()
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := writePEM(certFile, "CERTIFICATE", cert.Raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKey(keyFile, key); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func pemCert(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func bigInt(n int64) *big.Int {
+	return big.NewInt(n)
+}
+
+func TestTLSParamsConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  TLSParams
+		min     uint16
+		max     uint16
+		ciphers int
+		err     string
+	}{
+		{name: "crypto/tls defaults"},
+		{name: "modern profile", params: TLSParams{Profile: "modern"}, min: tls.VersionTLS13},
+		{name: "intermediate profile", params: TLSParams{Profile: "intermediate"}, min: tls.VersionTLS12, ciphers: 6},
+		{name: "old profile", params: TLSParams{Profile: "old"}, min: tls.VersionTLS10, ciphers: 17},
+		{
+			name:    "fields override the profile",
+			params:  TLSParams{Profile: "intermediate", Max: "VersionTLS12", Ciphers: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+			min:     tls.VersionTLS12,
+			max:     tls.VersionTLS12,
+			ciphers: 1,
+		},
+		{name: "unknown profile", params: TLSParams{Profile: "strict"}, err: "unknown TLS profile: strict"},
+		{name: "unknown version", params: TLSParams{Min: "VersionTLS14"}, err: "unknown TLS version: VersionTLS14"},
+		{
+			name:   "min above max",
+			params: TLSParams{Min: "VersionTLS13", Max: "VersionTLS12"},
+			err:    "TLS min version VersionTLS13 is above max version VersionTLS12",
+		},
+		{
+			name:   "max below the profile min",
+			params: TLSParams{Profile: "modern", Max: "VersionTLS12"},
+			err:    "TLS min version VersionTLS13 is above max version VersionTLS12",
+		},
+		{name: "unknown curve", params: TLSParams{CurvePreferences: []string{"CurveP224"}}, err: "unknown curve: CurveP224"},
+		{name: "unknown cipher", params: TLSParams{Ciphers: []string{"TLS_NULL"}}, err: "unknown cipher: TLS_NULL"},
+		{
+			name:   "weak cipher refused",
+			params: TLSParams{Ciphers: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_3DES_EDE_CBC_SHA"}},
+			err:    "weak cipher TLS_RSA_WITH_3DES_EDE_CBC_SHA refused, set allowWeakCiphers to enable it",
+		},
+		{
+			name:    "weak cipher allowed",
+			params:  TLSParams{Ciphers: []string{"TLS_RSA_WITH_3DES_EDE_CBC_SHA"}, AllowWeakCiphers: true},
+			ciphers: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.params.Config(zap.NewNop())
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.MinVersion != tt.min || cfg.MaxVersion != tt.max {
+				t.Errorf("versions %#x-%#x, want %#x-%#x", cfg.MinVersion, cfg.MaxVersion, tt.min, tt.max)
+			}
+			if len(cfg.CipherSuites) != tt.ciphers {
+				t.Errorf("%d ciphers, want %d", len(cfg.CipherSuites), tt.ciphers)
+			}
+		})
+	}
+}
+
+func TestProfileCiphersNotWeak(t *testing.T) {
+	for name, profile := range Profiles {
+		for _, cipher := range profile.Ciphers {
+			if _, ok := Ciphers[cipher]; !ok {
+				t.Errorf("%s profile: unknown cipher %s", name, cipher)
+			}
+			if WeakCiphers[cipher] {
+				t.Errorf("%s profile: weak cipher %s", name, cipher)
+			}
+		}
+	}
+}
+
+func TestModernProfileRefusesTLS12(t *testing.T) {
+	ca, caKey := testCA(t, "CA")
+	leaf, key := testIssue(t, &x509.Certificate{DNSNames: []string{"example.com"}}, ca, caKey)
+
+	serverCfg, err := TLSParams{Profile: "modern"}.Config(zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCfg.Certificates = []tls.Certificate{testTLSCert(leaf, key)}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	if _, err := handshake(t, serverCfg, &tls.Config{RootCAs: roots, ServerName: "example.com"}); err != nil {
+		t.Errorf("TLS 1.3 client refused: %v", err)
+	}
+	if _, err := handshake(t, serverCfg, &tls.Config{RootCAs: roots, ServerName: "example.com", MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Error("TLS 1.2 client accepted")
+	}
+}
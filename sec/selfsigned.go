@@ -0,0 +1,273 @@
+package sec
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File names written by GenerateSelfSigned
+const (
+	SelfSignedCA     = "ca.crt"
+	SelfSignedCAKey  = "ca.key"
+	SelfSignedCert   = "tls.crt"
+	SelfSignedKey    = "tls.key"
+	selfSignedCAName = "n2proxy development CA"
+)
+
+// selfSignedRenewBefore is how long before expiry a generated
+// certificate is replaced
+const selfSignedRenewBefore = 30 * 24 * time.Hour
+
+// DefaultSelfSignedHosts are the SANs of a generated certificate when
+// none are given
+var DefaultSelfSignedHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// SelfSignedCfg defines a generated development CA and certificate
+type SelfSignedCfg struct {
+	Dir      string        // where the CA and certificate are written
+	Hosts    []string      // DNS names and IP addresses of the certificate
+	Validity time.Duration // of the certificate, the CA lasts ten times as long
+}
+
+// SelfSigned are the files of a development CA and certificate
+type SelfSigned struct {
+	CA        string
+	Cert      string
+	Key       string
+	Generated bool // the certificate was written rather than reused
+	RenewedCA bool // an expiring CA was replaced, clients must trust it again
+}
+
+// EnsureSelfSigned returns the certificate and key in cfg.Dir,
+// generating them on first use and when the certificate is about to
+// expire or its SANs differ from cfg.Hosts. An existing CA in the
+// directory is reused so clients trusting it keep working, until it
+// would expire before a new certificate.
+func EnsureSelfSigned(cfg SelfSignedCfg) (*SelfSigned, error) {
+	certFile := filepath.Join(cfg.Dir, SelfSignedCert)
+	keyFile := filepath.Join(cfg.Dir, SelfSignedKey)
+
+	if fileExists(keyFile) && selfSignedCurrent(certFile, cfg.Hosts) {
+		return &SelfSigned{
+			CA:   filepath.Join(cfg.Dir, SelfSignedCA),
+			Cert: certFile,
+			Key:  keyFile,
+		}, nil
+	}
+
+	return GenerateSelfSigned(cfg)
+}
+
+// GenerateSelfSigned writes a certificate for cfg.Hosts signed by the CA
+// in cfg.Dir. A new CA is written when there is none or it would expire
+// before the certificate.
+func GenerateSelfSigned(cfg SelfSignedCfg) (*SelfSigned, error) {
+	if len(cfg.Hosts) == 0 {
+		cfg.Hosts = DefaultSelfSignedHosts
+	}
+	if cfg.Validity <= 0 {
+		// the longest validity browsers accept for server certificates
+		cfg.Validity = 397 * 24 * time.Hour
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	caFile := filepath.Join(cfg.Dir, SelfSignedCA)
+	caKeyFile := filepath.Join(cfg.Dir, SelfSignedCAKey)
+
+	ca, caKey, err := loadSelfSignedCA(caFile, caKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	renewCA := ca != nil && time.Now().Add(cfg.Validity).After(ca.NotAfter)
+	if ca == nil || renewCA {
+		caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		tpl := &x509.Certificate{
+			SerialNumber:          serialNumber(),
+			Subject:               pkix.Name{CommonName: selfSignedCAName, Organization: []string{"n2proxy"}},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(10 * cfg.Validity),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLenZero:        true,
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &caKey.PublicKey, caKey)
+		if err != nil {
+			return nil, err
+		}
+		ca, err = x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := writePEM(caFile, "CERTIFICATE", der, 0644); err != nil {
+			return nil, err
+		}
+		if err := writeKey(caKeyFile, caKey); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: cfg.Hosts[0], Organization: []string{"n2proxy"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(cfg.Validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	for _, host := range cfg.Hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+			continue
+		}
+		tpl.DNSNames = append(tpl.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	certFile := filepath.Join(cfg.Dir, SelfSignedCert)
+	keyFile := filepath.Join(cfg.Dir, SelfSignedKey)
+
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+	if err := writeKey(keyFile, key); err != nil {
+		return nil, err
+	}
+
+	return &SelfSigned{
+		CA:        caFile,
+		Cert:      certFile,
+		Key:       keyFile,
+		Generated: true,
+		RenewedCA: renewCA,
+	}, nil
+}
+
+// loadSelfSignedCA reads the CA pair, nil when either file is missing
+func loadSelfSignedCA(caFile string, caKeyFile string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	if !fileExists(caFile) || !fileExists(caKeyFile) {
+		return nil, nil, nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(caFile, caKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ca %s: %s", caFile, err.Error())
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("ca %s: %s", caFile, err.Error())
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("ca key %s: expected an ECDSA key", caKeyFile)
+	}
+
+	return ca, key, nil
+}
+
+// selfSignedCurrent reports whether a generated certificate is valid
+// for a while yet and names exactly hosts
+func selfSignedCurrent(certFile string, hosts []string) bool {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+
+	if time.Now().Add(selfSignedRenewBefore).After(cert.NotAfter) {
+		return false
+	}
+
+	if len(hosts) == 0 {
+		hosts = DefaultSelfSignedHosts
+	}
+	want := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			host = ip.String()
+		}
+		want[host] = true
+	}
+
+	have := make(map[string]bool, len(cert.DNSNames)+len(cert.IPAddresses))
+	for _, name := range cert.DNSNames {
+		have[name] = true
+	}
+	for _, ip := range cert.IPAddresses {
+		have[ip.String()] = true
+	}
+
+	if len(have) != len(want) {
+		return false
+	}
+	for host := range want {
+		if !have[host] {
+			return false
+		}
+	}
+	return true
+}
+
+func serialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return serial
+}
+
+func writePEM(filename string, blockType string, der []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
+
+func writeKey(filename string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(filename, "PRIVATE KEY", der, 0600)
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
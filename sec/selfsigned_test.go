@@ -0,0 +1,156 @@
+package sec
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readCert parses the PEM certificate in filename
+func readCert(t *testing.T, filename string) *x509.Certificate {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("no certificate in %s", filename)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// signedBy reports whether cert verifies against ca for name
+func signedBy(cert *x509.Certificate, ca *x509.Certificate, name string) bool {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	_, err := cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: name})
+	return err == nil
+}
+
+func TestEnsureSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	cfg := SelfSignedCfg{Dir: dir, Hosts: []string{"localhost", "127.0.0.1"}}
+
+	first, err := EnsureSelfSigned(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Generated || first.RenewedCA {
+		t.Fatalf("first use %+v, want a generated certificate and CA", first)
+	}
+	ca := readCert(t, first.CA)
+	if cert := readCert(t, first.Cert); !signedBy(cert, ca, "localhost") {
+		t.Fatal("certificate not signed by the CA")
+	}
+
+	original, _ := ioutil.ReadFile(first.Cert)
+
+	// current certificates are reused, host order does not matter
+	again, err := EnsureSelfSigned(SelfSignedCfg{Dir: dir, Hosts: []string{"127.0.0.1", "localhost"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Generated {
+		t.Error("current certificate regenerated")
+	}
+	if data, _ := ioutil.ReadFile(again.Cert); !bytes.Equal(data, original) {
+		t.Error("current certificate rewritten")
+	}
+
+	// a SAN change signs a new certificate with the same CA
+	cfg.Hosts = append(cfg.Hosts, "dev.example.com")
+	changed, err := EnsureSelfSigned(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed.Generated || changed.RenewedCA {
+		t.Fatalf("after a SAN change %+v, want a new certificate only", changed)
+	}
+	if cert := readCert(t, changed.Cert); !signedBy(cert, ca, "dev.example.com") {
+		t.Error("new certificate not valid for the added host with the existing CA")
+	}
+
+	// a certificate close to expiry is replaced
+	_, caKey, err := loadSelfSignedCA(first.CA, filepath.Join(dir, SelfSignedCAKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring, key := testIssue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost", "dev.example.com"},
+		IPAddresses: readCert(t, changed.Cert).IPAddresses,
+		NotAfter:    time.Now().Add(selfSignedRenewBefore - time.Hour),
+	}, ca, caKey)
+	writeTestPair(t, dir, "tls", expiring, key)
+
+	renewed, err := EnsureSelfSigned(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !renewed.Generated || renewed.RenewedCA {
+		t.Fatalf("near expiry %+v, want a new certificate only", renewed)
+	}
+	if cert := readCert(t, renewed.Cert); cert.NotAfter.Before(time.Now().Add(selfSignedRenewBefore)) {
+		t.Errorf("renewed certificate expires %s", cert.NotAfter)
+	}
+}
+
+func TestGenerateSelfSignedCA(t *testing.T) {
+	tests := []struct {
+		name     string
+		notAfter time.Duration // of the existing CA from now
+		renewed  bool
+	}{
+		{name: "current CA is reused", notAfter: 10 * 397 * 24 * time.Hour},
+		{name: "CA expiring before the certificate is replaced", notAfter: 30 * 24 * time.Hour, renewed: true},
+		{name: "expired CA is replaced", notAfter: -time.Hour, renewed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			ca, caKey := testIssue(t, &x509.Certificate{
+				Subject:               pkix.Name{CommonName: selfSignedCAName},
+				NotBefore:             time.Now().Add(-48 * time.Hour),
+				NotAfter:              time.Now().Add(tt.notAfter),
+				KeyUsage:              x509.KeyUsageCertSign,
+				BasicConstraintsValid: true,
+				IsCA:                  true,
+			}, nil, nil)
+			writeTestPair(t, dir, "ca", ca, caKey)
+
+			generated, err := GenerateSelfSigned(SelfSignedCfg{Dir: dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if generated.RenewedCA != tt.renewed {
+				t.Errorf("CA renewed %t, want %t", generated.RenewedCA, tt.renewed)
+			}
+
+			current := readCert(t, generated.CA)
+			if tt.renewed == current.Equal(ca) {
+				t.Errorf("CA replaced %t, want %t", !current.Equal(ca), tt.renewed)
+			}
+
+			cert := readCert(t, generated.Cert)
+			if !signedBy(cert, current, "localhost") {
+				t.Error("certificate not signed by the CA in the directory")
+			}
+			if cert.NotAfter.After(current.NotAfter) {
+				t.Error("certificate outlives its CA")
+			}
+		})
+	}
+}
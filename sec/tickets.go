@@ -0,0 +1,214 @@
+package sec
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SessionTicketCfg shares session ticket keys across replicas through a
+// key file. The file holds one base64 32 byte key per line; the first
+// encrypts new tickets, the others still decrypt tickets issued before
+// a rotation.
+type SessionTicketCfg struct {
+	KeyFile string `yaml:"keyFile"`
+	// Reload is how often the key file is checked for changes, default 1m
+	Reload time.Duration `yaml:"reload"`
+	// Disabled turns session tickets off
+	Disabled bool `yaml:"disabled"`
+}
+
+// SessionTickets keeps a listener's ticket keys in sync with the key
+// file
+type SessionTickets struct {
+	cfg SessionTicketCfg
+	// keys holds the current ticket keys, servers clone their
+	// tls.Config so keys set on it later would not reach them
+	keys   *tls.Config
+	mod    time.Time
+	done   chan struct{}
+	logger *zap.Logger
+}
+
+// NewSessionTickets applies the key file to tlsCfg
+func NewSessionTickets(cfg SessionTicketCfg, tlsCfg *tls.Config, logger *zap.Logger) (*SessionTickets, error) {
+	if cfg.Reload <= 0 {
+		cfg.Reload = time.Minute
+	}
+
+	st := &SessionTickets{
+		cfg:    cfg,
+		keys:   &tls.Config{},
+		done:   make(chan struct{}),
+		logger: logger,
+	}
+
+	if cfg.Disabled {
+		tlsCfg.SessionTicketsDisabled = true
+		logger.Info("Session tickets disabled")
+		return st, nil
+	}
+
+	if cfg.KeyFile == "" {
+		return nil, fmt.Errorf("session tickets require a keyFile")
+	}
+
+	if _, err := st.load(); err != nil {
+		return nil, err
+	}
+
+	tlsCfg.WrapSession = st.keys.EncryptTicket
+	tlsCfg.UnwrapSession = st.keys.DecryptTicket
+
+	return st, nil
+}
+
+// load applies the key file when it changed since the last load
+func (st *SessionTickets) load() (bool, error) {
+	info, err := os.Stat(st.cfg.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(st.mod) {
+		return false, nil
+	}
+
+	keys, err := ReadSessionTicketKeys(st.cfg.KeyFile)
+	if err != nil {
+		return false, err
+	}
+
+	st.keys.SetSessionTicketKeys(keys)
+	st.mod = info.ModTime()
+
+	st.logger.Info("Loaded session ticket keys",
+		zap.String("KeyFile", st.cfg.KeyFile),
+		zap.Int("Keys", len(keys)),
+	)
+
+	return true, nil
+}
+
+// Start checks the key file for changes until Stop
+func (st *SessionTickets) Start() {
+	if st.cfg.Disabled {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(st.cfg.Reload)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-st.done:
+				return
+			case <-ticker.C:
+				// keep the current keys until the file is readable again
+				if _, err := st.load(); err != nil {
+					st.logger.Warn("Session ticket key reload failed", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends key file checks
+func (st *SessionTickets) Stop() {
+	close(st.done)
+}
+
+// ReadSessionTicketKeys parses a key file, blank lines and # comments
+// are skipped
+func ReadSessionTicketKeys(filename string) ([][32]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][32]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		b, err := base64.StdEncoding.DecodeString(text)
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("%s line %d: expected a base64 32 byte key", filename, line)
+		}
+
+		var key [32]byte
+		copy(key[:], b)
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no session ticket keys found in %s", filename)
+	}
+
+	return keys, nil
+}
+
+// RotateSessionTicketKeys adds a new encryption key to the top of the
+// key file, creating it if needed, and keeps at most keep keys. The file
+// is replaced atomically so readers never see a partial write.
+func RotateSessionTicketKeys(filename string, keep int) error {
+	if keep < 1 {
+		keep = 1
+	}
+
+	var keys [][32]byte
+	if _, err := os.Stat(filename); err == nil {
+		keys, err = ReadSessionTicketKeys(filename)
+		if err != nil {
+			return err
+		}
+	}
+
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+
+	keys = append([][32]byte{key}, keys...)
+	if len(keys) > keep {
+		keys = keys[:keep]
+	}
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(base64.StdEncoding.EncodeToString(k[:]) + "\n")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".ticketkeys-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,195 @@
+package sec
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestReadSessionTicketKeys(t *testing.T) {
+	key := func(b byte) string {
+		return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string([]byte{b}), 32)))
+	}
+
+	tests := []struct {
+		name string
+		data string
+		keys int
+		err  string
+	}{
+		{name: "one key", data: key('a') + "\n", keys: 1},
+		{name: "comments and blank lines", data: "# current\n" + key('a') + "\n\n  # previous\n  " + key('b') + "  \n", keys: 2},
+		{name: "short key", data: key('a') + "\n" + base64.StdEncoding.EncodeToString([]byte("short")) + "\n", err: "line 2: expected a base64 32 byte key"},
+		{name: "not base64", data: "# key\nnot base64!\n", err: "line 2: expected a base64 32 byte key"},
+		{name: "no keys", data: "# empty\n", err: "no session ticket keys found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "ticket.keys")
+			if err := ioutil.WriteFile(filename, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			keys, err := ReadSessionTicketKeys(filename)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != tt.keys {
+				t.Errorf("%d keys, want %d", len(keys), tt.keys)
+			}
+			if keys[0][0] != 'a' {
+				t.Error("the first key is not the encryption key")
+			}
+		})
+	}
+}
+
+func TestRotateSessionTicketKeys(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ticket.keys")
+
+	var previous [][32]byte
+	for i, want := range []int{1, 2, 2} {
+		if err := RotateSessionTicketKeys(filename, 2); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := ReadSessionTicketKeys(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != want {
+			t.Fatalf("rotation %d: %d keys, want %d", i, len(keys), want)
+		}
+		if previous != nil && (keys[0] == previous[0] || keys[1] != previous[0]) {
+			t.Fatalf("rotation %d: the new key is not first with the previous one after it", i)
+		}
+		previous = keys
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("key file mode %o, want 600", perm)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(filepath.Dir(filename), ".ticketkeys-*")); len(tmp) != 0 {
+		t.Errorf("temporary files left behind: %v", tmp)
+	}
+}
+
+// ticketServer is a replica's listener configuration using the shared
+// key file
+func ticketServer(t *testing.T, cert tls.Certificate, keyFile string) (*tls.Config, *SessionTickets) {
+	t.Helper()
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	st, err := NewSessionTickets(SessionTicketCfg{KeyFile: keyFile}, cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg, st
+}
+
+// rotate rotates the key file and reloads st, dating the file later so
+// the change is seen on coarse file systems
+func rotate(t *testing.T, st *SessionTickets, keep int) {
+	t.Helper()
+
+	if err := RotateSessionTicketKeys(st.cfg.KeyFile, keep); err != nil {
+		t.Fatal(err)
+	}
+	mod := st.mod.Add(time.Minute)
+	if err := os.Chtimes(st.cfg.KeyFile, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := st.load(); err != nil || !changed {
+		t.Fatalf("reload: changed %t, error %v", changed, err)
+	}
+}
+
+func TestSessionTicketsAcrossReplicas(t *testing.T) {
+	ca, caKey := testCA(t, "CA")
+	leaf, key := testIssue(t, &x509.Certificate{DNSNames: []string{"example.com"}}, ca, caKey)
+	cert := testTLSCert(leaf, key)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	keyFile := filepath.Join(t.TempDir(), "ticket.keys")
+	if err := RotateSessionTicketKeys(keyFile, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	replicaA, _ := ticketServer(t, cert, keyFile)
+	replicaB, stB := ticketServer(t, cert, keyFile)
+
+	// newClient returns a client with an empty session cache
+	newClient := func() *tls.Config {
+		return &tls.Config{RootCAs: roots, ServerName: "example.com", ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	}
+
+	// a ticket issued by one replica resumes on the other
+	client := newClient()
+	if _, err := handshake(t, replicaA, client); err != nil {
+		t.Fatal(err)
+	}
+	if resumed, err := handshake(t, replicaB, client); err != nil || !resumed {
+		t.Fatalf("resumed %t on the other replica, error %v", resumed, err)
+	}
+
+	// after a rotation the previous key still decrypts
+	client = newClient()
+	if _, err := handshake(t, replicaA, client); err != nil {
+		t.Fatal(err)
+	}
+	rotate(t, stB, 2)
+	if resumed, err := handshake(t, replicaB, client); err != nil || !resumed {
+		t.Fatalf("resumed %t after a rotation, error %v", resumed, err)
+	}
+
+	// once the key is dropped the ticket is refused and a full
+	// handshake takes place
+	client = newClient()
+	if _, err := handshake(t, replicaA, client); err != nil {
+		t.Fatal(err)
+	}
+	rotate(t, stB, 1)
+	if resumed, err := handshake(t, replicaB, client); err != nil || resumed {
+		t.Fatalf("resumed %t with a dropped key, error %v", resumed, err)
+	}
+}
+
+func TestNewSessionTicketsCfg(t *testing.T) {
+	tlsCfg := &tls.Config{}
+	if _, err := NewSessionTickets(SessionTicketCfg{Disabled: true}, tlsCfg, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	if !tlsCfg.SessionTicketsDisabled {
+		t.Error("session tickets not disabled")
+	}
+
+	if _, err := NewSessionTickets(SessionTicketCfg{}, &tls.Config{}, zap.NewNop()); err == nil {
+		t.Error("no error without a key file")
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.keys")
+	if _, err := NewSessionTickets(SessionTicketCfg{KeyFile: missing}, &tls.Config{}, zap.NewNop()); err == nil {
+		t.Error("no error for a missing key file")
+	}
+}
@@ -1,16 +1,31 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/txn2/n2proxy/admin"
+	"github.com/txn2/n2proxy/alert"
+	"github.com/txn2/n2proxy/dash"
+	"github.com/txn2/n2proxy/evt"
+	"github.com/txn2/n2proxy/health"
+	"github.com/txn2/n2proxy/proxyproto"
+	"github.com/txn2/n2proxy/reqid"
 	"github.com/txn2/n2proxy/sec"
+	"github.com/txn2/n2proxy/tracing"
+	"github.com/txn2/n2proxy/upstream"
 
 	"github.com/txn2/n2proxy/rweng"
 	"go.uber.org/zap"
@@ -18,81 +33,335 @@ import (
 
 var Version = "0.0.0"
 
+// ProxyCfg configures a Proxy see NewProxy()
+type ProxyCfg struct {
+	Router         *upstream.Router
+	CfgFile        string
+	RequestIDHdr   string // header carrying the request id
+	TrustRequestID bool   // accept a request id sent by the client
+	Events         *evt.Stream
+	Tracer         *tracing.Tracer
+	Traffic        *dash.Traffic       // recent requests for the dashboard, optional
+	Certificates   []*sec.Certificates // listener certificates reported in stats
+	MaxBody        int64               // request body limit in bytes, 0 is unlimited
+}
+
 // Proxy defines the proxy handler see NewProx()
 type Proxy struct {
-	target  *url.URL
-	proxy   *httputil.ReverseProxy
-	cfgFile string
-	logger  *zap.Logger
-	eng     *rweng.Eng
+	draining       int32 // set once shutdown starts
+	router         *upstream.Router
+	proxy          *httputil.ReverseProxy
+	cfgFile        string
+	requestIDHdr   string
+	trustRequestID bool
+	logger         *zap.Logger
+	eng            *rweng.Eng
+	tracer         *tracing.Tracer
+	stats          *Stats
+	traffic        *dash.Traffic
+	maxBody        int64
 }
 
 //var _ http.RoundTripper = &transport{}
 
 // NewProxy instances a new proxy server
-func NewProxy(target string, skpver bool, cfgFile string, logger *zap.Logger) *Proxy {
-	targetUrl, err := url.Parse(target)
-	if err != nil {
-		fmt.Printf("Unable to parse URL: %s\n", err.Error())
-		os.Exit(1)
-	}
-
+func NewProxy(cfg ProxyCfg, logger *zap.Logger) *Proxy {
 	// if cfgFile exists pass proxy
-	eng, err := rweng.NewEngFromYml(cfgFile, logger)
+	eng, err := rweng.NewEngFromYml(cfg.CfgFile, cfg.Events, logger)
 	if err != nil {
 		fmt.Printf("Engine failure: %s\n", err.Error())
 		os.Exit(1)
 	}
 
-	pxy := httputil.NewSingleHostReverseProxy(targetUrl)
+	if cfg.RequestIDHdr == "" {
+		cfg.RequestIDHdr = reqid.DefaultHeader
+	}
 
-	if skpver {
-		pxy.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // client uses self-signed cert
-		}
+	// the upstream transport picks a target and rewrites the url
+	pxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// explicitly disable User-Agent so it's not set to default value
+				req.Header.Set("User-Agent", "")
+			}
+		},
+		Transport:     cfg.Router,
+		FlushInterval: cfg.Router.Response().FlushInterval,
+	}
+
+	if cfg.Router.Response().BufferPool {
+		pxy.BufferPool = upstream.NewBufferPool()
+	}
+
+	// the request id set on the response wins over any sent by the backend
+	pxy.ModifyResponse = func(resp *http.Response) error {
+		resp.Header.Del(cfg.RequestIDHdr)
+		return nil
 	}
 
 	proxy := &Proxy{
-		target: targetUrl,
-		proxy:  pxy,
-		logger: logger,
-		eng:    eng,
+		router:         cfg.Router,
+		proxy:          pxy,
+		cfgFile:        cfg.CfgFile,
+		requestIDHdr:   cfg.RequestIDHdr,
+		trustRequestID: cfg.TrustRequestID,
+		logger:         logger,
+		eng:            eng,
+		tracer:         cfg.Tracer,
+		stats:          NewStats(cfg.Certificates),
+		traffic:        cfg.Traffic,
+		maxBody:        cfg.MaxBody,
 	}
 
+	pxy.ErrorHandler = proxy.upstreamError
+
 	return proxy
 }
 
-// handle requests
-func (p *Proxy) handle(w http.ResponseWriter, r *http.Request) {
+// errorPage writes the plain text error response used for every
+// request n2proxy answers itself
+func errorPage(w http.ResponseWriter, status int, requestID string) {
+	http.Error(w, http.StatusText(status)+"\nRequest ID: "+requestID, status)
+}
+
+// upstreamError answers a failed upstream request. The log entry
+// carries the error class rather than the error text, which can
+// contain the backend url and query string.
+func (p *Proxy) upstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	class := "upstream error"
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		// the client went away, nobody reads the response
+		status, class = 499, "client canceled"
+	case errors.Is(err, upstream.ErrNoTarget):
+		status, class = http.StatusServiceUnavailable, "no available target"
+	case errors.Is(err, upstream.ErrCircuitOpen):
+		status, class = http.StatusServiceUnavailable, "circuit open"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		status, class = http.StatusGatewayTimeout, "timeout"
+	case errors.As(err, new(*net.OpError)):
+		class = "connection failed"
+	}
+
+	name := ""
+	if u := upstream.FromContext(r.Context()); u != nil {
+		name = u.Name()
+	}
+
+	requestID := reqid.FromContext(r.Context())
+
+	p.logger.Warn("Upstream request failed",
+		zap.String("RequestID", requestID),
+		zap.String("Upstream", name),
+		zap.String("method", r.Method),
+		zap.String("path", r.URL.Path),
+		zap.Int("Status", status),
+		zap.String("Error", class),
+	)
+
+	if status == 499 {
+		return
+	}
+
+	errorPage(w, status, requestID)
+}
+
+// Drain marks the proxy as shutting down, it stops reporting ready and
+// asks clients to close their connections
+func (p *Proxy) Drain() {
+	atomic.StoreInt32(&p.draining, 1)
+}
+
+// Draining reports whether shutdown has started
+func (p *Proxy) Draining() bool {
+	return atomic.LoadInt32(&p.draining) == 1
+}
+
+// Ready fails once shutdown has started
+func (p *Proxy) Ready() error {
+	if p.Draining() {
+		return errors.New("shutting down")
+	}
+	return nil
+}
+
+// statusWriter records the response status for the access log
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
 
+// Write implements http.ResponseWriter
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController flush and hijack the connection
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// handle requests arriving on listener l
+func (p *Proxy) handle(w http.ResponseWriter, r *http.Request, l *listener) {
 	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+
+	if p.Draining() {
+		w.Header().Set("Connection", "close")
+	}
+
+	// accept the client request id only when trusted and well formed
+	requestID := r.Header.Get(p.requestIDHdr)
+	if !p.trustRequestID || !reqid.Valid(requestID) {
+		requestID = reqid.New()
+	}
+	r.Header.Set(p.requestIDHdr, requestID)
+	w.Header().Set(p.requestIDHdr, requestID)
+
+	ctx, span := p.tracer.StartRequest(r)
+	defer span.End()
+	tracing.RecordRequestID(span, requestID)
+	ctx = reqid.NewContext(ctx, requestID)
+
+	// verified client certificate identity for rules, events and logs;
+	// certificate headers sent by the client are always removed
+	clientAuth := l.clientAuth()
+	identity := clientAuth.Identify(r)
+	clientAuth.Forward(r, identity)
+	ctx = sec.NewIdentityContext(ctx, identity)
+	r = r.WithContext(ctx)
+
+	// fingerprint headers sent by the client are always removed
+	fp := sec.FingerprintFromContext(ctx)
+	sec.ForwardFingerprint(r, fp)
+
 	reqPath := r.URL.Path
+	reqHost := r.Host
 	reqMethod := r.Method
 
-	end := time.Now()
-	latency := end.Sub(start)
+	// logged once the response is complete, also for requests answered
+	// by n2proxy itself
+	defer func() {
+		end := time.Now()
+		status := sw.status
+		if status == 0 {
+			// the client went away before any response
+			status = 499
+		}
 
-	p.logger.Info(reqPath,
-		zap.String("method", reqMethod),
-		zap.String("path", reqPath),
-		zap.String("time", end.Format(time.RFC3339)),
-		zap.Duration("latency", latency),
-	)
+		fields := []zap.Field{
+			zap.String("RequestID", requestID),
+			zap.String("Listener", l.cfg.Name),
+			zap.String("RemoteAddr", r.RemoteAddr),
+			zap.String("method", reqMethod),
+			zap.String("path", reqPath),
+			zap.String("proto", r.Proto),
+			zap.Int("status", status),
+			zap.String("time", end.Format(time.RFC3339)),
+			zap.Duration("latency", end.Sub(start)),
+		}
+		if identity != "" {
+			fields = append(fields, zap.String("ClientIdentity", identity))
+		}
+		if fp.JA3Hash != "" {
+			fields = append(fields, zap.String("JA3", fp.JA3Hash), zap.String("JA4", fp.JA4))
+		}
+
+		p.logger.Info(reqPath, fields...)
+	}()
+
+	// the same limit for every protocol, HTTP/2 bodies often have no
+	// Content-Length
+	if p.maxBody > 0 {
+		if r.ContentLength > p.maxBody {
+			errorPage(w, http.StatusRequestEntityTooLarge, requestID)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, p.maxBody)
+	}
 
-	r.Host = p.target.Host
+	// match the route before the rules rewrite banned paths
+	route, routeErr := p.router.Match(r)
 
 	// process request
-	p.eng.ProcessRequest(w, r)
+	_, rulesSpan := p.tracer.Start(ctx, "rules")
+	verdict := l.eng.ProcessRequest(w, r)
+	tracing.RecordRules(rulesSpan, verdict.Action, verdict.Rules, verdict.Events)
+	tracing.RecordRules(span, verdict.Action, verdict.Rules, verdict.Events)
+	rulesSpan.End()
+	p.stats.Count(verdict)
+	p.traffic.Record(r, requestID, l.cfg.Name, reqHost, reqPath, verdict)
+
+	if verdict.Err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(verdict.Err, &maxBytesErr) {
+			errorPage(w, http.StatusRequestEntityTooLarge, requestID)
+			return
+		}
+		errorPage(w, http.StatusBadRequest, requestID)
+		return
+	}
+
+	if verdict.Blocked() {
+		errorPage(w, http.StatusForbidden, requestID)
+		return
+	}
+
+	if routeErr != nil {
+		errorPage(w, http.StatusNotFound, requestID)
+		return
+	}
+	route.Rewrite(r)
+	r = r.WithContext(upstream.NewContext(r.Context(), route.Upstream()))
 
 	p.proxy.ServeHTTP(w, r)
 }
 
 // main function
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gencert" {
+		os.Exit(gencert(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ticketkeys" {
+		os.Exit(ticketkeys(os.Args[2:]))
+	}
+
 	portEnv := getEnv("PORT", "9090")
 	cfgFileEnv := getEnv("CFG", "./cfg.yml")
+	listenCfgFileEnv := getEnv("LISTENCFG", "")
 	tlsCfgFileEnv := getEnv("TLSCFG", "")
+	evtCfgFileEnv := getEnv("EVTCFG", "")
+	alertCfgFileEnv := getEnv("ALERTCFG", "")
+	adminCfgFileEnv := getEnv("ADMINCFG", "")
+	healthCfgFileEnv := getEnv("HEALTHCFG", "")
+	upstreamCfgFileEnv := getEnv("UPSTREAMCFG", "")
+	dashBufferEnv, err := strconv.Atoi(getEnv("DASH_BUFFER", "1000"))
+	if err != nil {
+		fmt.Printf("Invalid DASH_BUFFER: %s\n", err.Error())
+		os.Exit(1)
+	}
 	backendEnv := getEnv("BACKEND", "http://example.com:80")
+	reqIdHeaderEnv := getEnv("REQID_HEADER", reqid.DefaultHeader)
+	trustReqIdEnvBool := false
+	trustReqIdEnv := getEnv("TRUST_REQID", "false")
+	if trustReqIdEnv == "true" {
+		trustReqIdEnvBool = true
+	}
 	logoutEnv := getEnv("LOGOUT", "stdout")
 	tlsEnvBool := false
 	tlsEnv := getEnv("TLS", "false")
@@ -104,19 +373,118 @@ func main() {
 	if skpverEnv == "true" {
 		skpverEnvBool = true
 	}
+	otlpInsecureEnvBool := false
+	otlpInsecureEnv := getEnv("OTLP_INSECURE", "false")
+	if otlpInsecureEnv == "true" {
+		otlpInsecureEnvBool = true
+	}
+	otlpEndpointEnv := getEnv("OTLP_ENDPOINT", "")
+	otlpProtocolEnv := getEnv("OTLP_PROTOCOL", "grpc")
+	traceSampleEnv, err := strconv.ParseFloat(getEnv("TRACE_SAMPLE", "1"), 64)
+	if err != nil {
+		fmt.Printf("Invalid TRACE_SAMPLE: %s\n", err.Error())
+		os.Exit(1)
+	}
+	shutdownTimeoutEnv, err := time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", "30s"))
+	if err != nil {
+		fmt.Printf("Invalid SHUTDOWN_TIMEOUT: %s\n", err.Error())
+		os.Exit(1)
+	}
+	shutdownDelayEnv, err := time.ParseDuration(getEnv("SHUTDOWN_DELAY", "0s"))
+	if err != nil {
+		fmt.Printf("Invalid SHUTDOWN_DELAY: %s\n", err.Error())
+		os.Exit(1)
+	}
+	maxBodyEnv, err := strconv.ParseInt(getEnv("MAX_BODY", "0"), 10, 64)
+	if err != nil {
+		fmt.Printf("Invalid MAX_BODY: %s\n", err.Error())
+		os.Exit(1)
+	}
+	http2EnvBool := true
+	http2Env := getEnv("HTTP2", "true")
+	if http2Env == "false" {
+		http2EnvBool = false
+	}
+	h2cEnvBool := false
+	h2cEnv := getEnv("H2C", "false")
+	if h2cEnv == "true" {
+		h2cEnvBool = true
+	}
+	http2MaxStreamsEnv, err := strconv.Atoi(getEnv("HTTP2_MAX_STREAMS", "250"))
+	if err != nil {
+		fmt.Printf("Invalid HTTP2_MAX_STREAMS: %s\n", err.Error())
+		os.Exit(1)
+	}
+	http2MaxFrameSizeEnv, err := strconv.Atoi(getEnv("HTTP2_MAX_FRAME_SIZE", "1048576"))
+	if err != nil {
+		fmt.Printf("Invalid HTTP2_MAX_FRAME_SIZE: %s\n", err.Error())
+		os.Exit(1)
+	}
+	http3EnvBool := false
+	http3Env := getEnv("HTTP3", "false")
+	if http3Env == "true" {
+		http3EnvBool = true
+	}
+	http3PortEnv := getEnv("HTTP3_PORT", "")
+	selfSignedEnvBool := false
+	selfSignedEnv := getEnv("SELF_SIGNED", "false")
+	if selfSignedEnv == "true" {
+		selfSignedEnvBool = true
+	}
+	certDirEnv := getEnv("CERT_DIR", "./certs")
+	proxyProtocolEnv := getEnv("PROXY_PROTOCOL", "")
+	certHostsEnv := getEnv("CERT_HOSTS", strings.Join(sec.DefaultSelfSignedHosts, ","))
+	fingerprintEnvBool := false
+	fingerprintEnv := getEnv("FINGERPRINT", "false")
+	if fingerprintEnv == "true" {
+		fingerprintEnvBool = true
+	}
+	allowExpiredCertEnvBool := false
+	allowExpiredCertEnv := getEnv("ALLOW_EXPIRED_CERT", "false")
+	if allowExpiredCertEnv == "true" {
+		allowExpiredCertEnvBool = true
+	}
 	crtEnv := getEnv("CRT", "./example.crt")
 	keyEnv := getEnv("KEY", "./example.key")
 
 	// command line falls back to env
 	port := flag.String("port", portEnv, "port to listen on.")
 	cfgFile := flag.String("cfg", cfgFileEnv, "config file path.")
+	listenCfgFile := flag.String("listenCfg", listenCfgFileEnv, "listener config file path, replaces port, tls and http3.")
 	tlsCfgFile := flag.String("tlsCfg", tlsCfgFileEnv, "tls config file path.")
+	evtCfgFile := flag.String("evtCfg", evtCfgFileEnv, "security event config file path.")
+	alertCfgFile := flag.String("alertCfg", alertCfgFileEnv, "alert webhook config file path.")
+	adminCfgFile := flag.String("adminCfg", adminCfgFileEnv, "admin API config file path.")
+	healthCfgFile := flag.String("healthCfg", healthCfgFileEnv, "health endpoint and backend check config file path.")
+	dashBuffer := flag.Int("dashBuffer", dashBufferEnv, "Requests and security events kept in memory for the admin dashboard.")
 	backend := flag.String("backend", backendEnv, "backend server.")
+	upstreamCfgFile := flag.String("upstreamCfg", upstreamCfgFileEnv, "upstream pools config file path, replaces backend.")
+	reqIdHeader := flag.String("reqIdHeader", reqIdHeaderEnv, "header carrying the request id to the backend and client.")
+	trustReqId := flag.Bool("trustReqId", trustReqIdEnvBool, "Accept a request id sent by the client in reqIdHeader.")
 	logout := flag.String("logout", logoutEnv, "log output stdout | ")
 	srvtls := flag.Bool("tls", tlsEnvBool, "TLS Support (requires crt and key)")
 	crt := flag.String("crt", crtEnv, "Path to cert. (enable --tls)")
 	key := flag.String("key", keyEnv, "Path to private key. (enable --tls")
+	maxBody := flag.Int64("maxBody", maxBodyEnv, "Request body limit in bytes, larger requests get 413. 0 is unlimited.")
+	http2 := flag.Bool("http2", http2EnvBool, "Negotiate HTTP/2 with TLS clients.")
+	h2c := flag.Bool("h2c", h2cEnvBool, "Accept cleartext HTTP/2 (h2c) without TLS.")
+	http2MaxStreams := flag.Int("http2MaxStreams", http2MaxStreamsEnv, "Concurrent HTTP/2 streams allowed per connection.")
+	http2MaxFrameSize := flag.Int("http2MaxFrameSize", http2MaxFrameSizeEnv, "Largest HTTP/2 frame read in bytes, 16384-16777215.")
+	http3Enabled := flag.Bool("http3", http3EnvBool, "Serve HTTP/3 over QUIC alongside the TLS listener (requires --tls).")
+	http3Port := flag.String("http3Port", http3PortEnv, "UDP port for HTTP/3, defaults to port.")
+	selfSigned := flag.Bool("selfSigned", selfSignedEnvBool, "Generate a development CA and certificate in certDir on first start and serve it (enable --tls).")
+	certDir := flag.String("certDir", certDirEnv, "Directory for generated certificates.")
+	certHosts := flag.String("certHosts", certHostsEnv, "Comma separated DNS names and IP addresses of a generated certificate.")
+	fingerprint := flag.Bool("fingerprint", fingerprintEnvBool, "Compute JA3 and JA4 TLS client fingerprints for logs, rules and the backend (enable --tls).")
+	proxyProtocol := flag.String("proxyProtocol", proxyProtocolEnv, "Comma separated load balancer addresses or CIDRs trusted to send PROXY protocol v1 or v2 headers.")
+	allowExpiredCert := flag.Bool("allowExpiredCert", allowExpiredCertEnvBool, "Start with an expired listener certificate instead of refusing to.")
 	skpver := flag.Bool("skip-verify", skpverEnvBool, "Skip backend tls verify.")
+	otlpEndpoint := flag.String("otlpEndpoint", otlpEndpointEnv, "OTLP collector host:port, enables trace export.")
+	otlpProtocol := flag.String("otlpProtocol", otlpProtocolEnv, "OTLP protocol grpc | http")
+	otlpInsecure := flag.Bool("otlpInsecure", otlpInsecureEnvBool, "Disable TLS to the OTLP collector.")
+	traceSample := flag.Float64("traceSample", traceSampleEnv, "Trace sample ratio 0-1 for requests without a sampled parent.")
+	shutdownTimeout := flag.Duration("shutdownTimeout", shutdownTimeoutEnv, "Time allowed for in-flight requests to finish on SIGTERM or SIGINT.")
+	shutdownDelay := flag.Duration("shutdownDelay", shutdownDelayEnv, "Time to keep serving while failing readiness before the listener closes on shutdown.")
 	version := flag.Bool("version", false, "Display version.")
 	flag.Parse()
 
@@ -125,6 +493,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	// the frame size range allowed by RFC 9113
+	if *http2MaxFrameSize < 16384 || *http2MaxFrameSize > 16777215 {
+		fmt.Printf("Invalid http2MaxFrameSize %d: expected 16384-16777215\n", *http2MaxFrameSize)
+		os.Exit(1)
+	}
+
 	zapCfg := zap.NewProductionConfig()
 	zapCfg.DisableCaller = true
 	zapCfg.DisableStacktrace = true
@@ -142,56 +516,445 @@ func main() {
 		os.Exit(1)
 	}
 
-	logger.Info("Starting reverse proxy on port: " + *port)
-	logger.Info("Requests proxied to Backend: " + *backend)
+	// security events
+	var events *evt.Stream
+	if *evtCfgFile != "" {
+		logger.Info("Loading security event configuration from " + *evtCfgFile)
+		events, err = evt.NewStreamFromYaml(*evtCfgFile, Version, logger)
+		if err != nil {
+			fmt.Printf("Error configuring security events: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
 
-	// proxy
-	proxy := NewProxy(*backend, *skpver, *cfgFile, logger)
+	// alerting on security events
+	if *alertCfgFile != "" {
+		logger.Info("Loading alert configuration from " + *alertCfgFile)
+		alerter, err := alert.NewAlerterFromYaml(*alertCfgFile, logger)
+		if err != nil {
+			fmt.Printf("Error configuring alerts: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if events == nil {
+			events = evt.NewStream(nil, 0, logger)
+		}
+		events.AddSink(alerter)
+	}
 
-	mux := http.NewServeMux()
+	// recent traffic and events for the admin dashboard
+	var traffic *dash.Traffic
+	var recent *evt.Ring
+	if *adminCfgFile != "" {
+		traffic = dash.NewTraffic(*dashBuffer)
+		recent = evt.NewRing(*dashBuffer)
+		if events == nil {
+			events = evt.NewStream(nil, 0, logger)
+		}
+		events.AddSink(recent)
+	}
 
-	// server
-	mux.HandleFunc("/", proxy.handle)
+	// tracing, exported query strings are masked with the redaction
+	// settings of the --cfg rules
+	engCfg, err := rweng.NewEngCfgFromYml(*cfgFile)
+	if err != nil {
+		fmt.Printf("Error loading rule configuration: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	tracer, err := tracing.NewTracer(tracing.Cfg{
+		Endpoint:    *otlpEndpoint,
+		Protocol:    *otlpProtocol,
+		Insecure:    *otlpInsecure,
+		SampleRatio: *traceSample,
+		Redact:      engCfg.Redact,
+	}, Version, logger)
+	if err != nil {
+		fmt.Printf("Error configuring tracing: %s\n", err.Error())
+		os.Exit(1)
+	}
 
-	srv := &http.Server{
-		Addr:    ":" + *port,
-		Handler: mux,
+	// health endpoint configuration
+	var healthCfg *health.Cfg
+	if *healthCfgFile != "" {
+		logger.Info("Loading health configuration from " + *healthCfgFile)
+		healthCfg, err = health.NewCfgFromYaml(*healthCfgFile)
+		if err != nil {
+			fmt.Printf("Error configuring health checks: %s\n", err.Error())
+			os.Exit(1)
+		}
 	}
 
-	// If TLS is not specified serve the content unencrypted.
-	if *srvtls != true {
-		err = srv.ListenAndServe()
+	// upstreams, spans and trace context propagation wrap the transports
+	var router *upstream.Router
+	if *upstreamCfgFile != "" {
+		logger.Info("Loading upstream configuration from " + *upstreamCfgFile)
+		router, err = upstream.NewRouterFromYaml(*upstreamCfgFile, tracer.Transport, logger)
+		if err != nil {
+			fmt.Printf("Error configuring upstreams: %s\n", err.Error())
+			os.Exit(1)
+		}
+	} else {
+		logger.Info("Requests proxied to Backend: " + *backend)
+		uCfg := upstream.UpstreamCfg{
+			Name:       "default",
+			Targets:    []upstream.TargetCfg{{URL: *backend}},
+			SkipVerify: *skpver,
+		}
+		if healthCfg != nil {
+			uCfg.HealthCheck = healthCfg.Backend
+		}
+		u, err := upstream.NewUpstream(uCfg, tracer.Transport, logger)
 		if err != nil {
-			fmt.Printf("Error starting proxy: %s\n", err.Error())
+			fmt.Printf("Error configuring backend: %s\n", err.Error())
+			os.Exit(1)
 		}
-		os.Exit(0)
+		router, _ = upstream.NewRouter(nil, []*upstream.Upstream{u})
+	}
+
+	upstreams := router.Upstreams()
+	for _, u := range upstreams {
+		u.Start()
 	}
 
-	// Get a generic TLS configuration
-	tlsCfg := sec.GenericTLSConfig()
+	// listeners from --listenCfg, or one on --port
+	var listenCfg *ListenCfg
+	if *listenCfgFile != "" {
+		logger.Info("Loading listener configuration from " + *listenCfgFile)
+		listenCfg, err = NewListenCfgFromYaml(*listenCfgFile)
+		if err != nil {
+			fmt.Printf("Error configuring listeners: %s\n", err.Error())
+			os.Exit(1)
+		}
+	} else {
+		lc := ListenerCfg{
+			Name:      "default",
+			Address:   ":" + *port,
+			TLS:       *srvtls,
+			HTTP3:     *http3Enabled,
+			HTTP3Port: *http3Port,
+		}
+		if *proxyProtocol != "" {
+			lc.ProxyProtocol = &proxyproto.Cfg{Trusted: splitHosts(*proxyProtocol)}
+		}
+		if err := lc.validate(); err != nil {
+			fmt.Printf("Error configuring listener: %s\n", err.Error())
+			os.Exit(1)
+		}
+		listenCfg = &ListenCfg{Listeners: []ListenerCfg{lc}}
+	}
 
-	if *tlsCfgFile == "" {
-		logger.Warn("No TLS configuration specified, using default.")
+	anyTLS := false
+	for _, lc := range listenCfg.Listeners {
+		anyTLS = anyTLS || lc.TLS
 	}
 
-	if *tlsCfgFile != "" {
-		logger.Info("Loading TLS configuration from " + *tlsCfgFile)
-		tlsCfg, err = sec.NewTLSCfgFromYaml(*tlsCfgFile, logger)
+	if *selfSigned && anyTLS {
+		devCert, err := sec.EnsureSelfSigned(sec.SelfSignedCfg{
+			Dir:   *certDir,
+			Hosts: splitHosts(*certHosts),
+		})
 		if err != nil {
-			fmt.Printf("Error configuring TLS: %s\n", err.Error())
-			os.Exit(0)
+			fmt.Printf("Error generating certificate: %s\n", err.Error())
+			os.Exit(1)
 		}
+		if devCert.RenewedCA {
+			logger.Warn("Replaced the expiring development CA, clients must trust " + devCert.CA + " again.")
+		} else if devCert.Generated {
+			logger.Warn("Generated a self-signed development certificate, trust " + devCert.CA + " in clients.")
+		}
+		*crt, *key = devCert.Cert, devCert.Key
 	}
 
-	logger.Info("Starting proxy in TLS mode.")
+	// listener tls and client certificates, listeners sharing a TLS
+	// configuration share certificates and session ticket keys;
+	// --crt and --key unless tls.yml lists certificates
+	certCfgs := []sec.CertCfg{{Cert: *crt, Key: *key}}
+	certOpts := sec.CertOptions{AllowExpired: *allowExpiredCert}
+	tlsByCfg := make(map[string]*listenerTLS)
+	var certs []*sec.Certificates
+
+	listeners := make([]*listener, 0, len(listenCfg.Listeners))
+	for _, lc := range listenCfg.Listeners {
+		l := &listener{cfg: lc}
+
+		if lc.TLS {
+			if lc.TLSCfg == "" {
+				lc.TLSCfg = *tlsCfgFile
+			}
+
+			lt, ok := tlsByCfg[lc.TLSCfg]
+			if !ok {
+				lt, err = loadListenerTLS(lc.TLSCfg, certCfgs, certOpts, *fingerprint, logger)
+				if err != nil {
+					fmt.Printf("Error configuring TLS for listener %s: %s\n", lc.Name, err.Error())
+					os.Exit(1)
+				}
+				lt.Start()
+				tlsByCfg[lc.TLSCfg] = lt
+				certs = append(certs, lt.certs)
+			}
+			l.tls = lt
+		}
 
-	srv.TLSConfig = tlsCfg
-	srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0)
+		listeners = append(listeners, l)
+	}
 
-	err = srv.ListenAndServeTLS(*crt, *key)
-	if err != nil {
-		fmt.Printf("Error starting proxyin TLS mode: %s\n", err.Error())
+	// proxy
+	proxy := NewProxy(ProxyCfg{
+		Certificates:   certs,
+		MaxBody:        *maxBody,
+		Router:         router,
+		CfgFile:        *cfgFile,
+		RequestIDHdr:   *reqIdHeader,
+		TrustRequestID: *trustReqId,
+		Events:         events,
+		Tracer:         tracer,
+		Traffic:        traffic,
+	}, logger)
+
+	// rule sets by file, the admin API manages each of them
+	engs := map[string]*rweng.Eng{*cfgFile: proxy.eng}
+	for _, l := range listeners {
+		if l.cfg.Redirect {
+			continue
+		}
+
+		rules := l.cfg.Rules
+		if rules == "" {
+			rules = *cfgFile
+		}
+
+		eng, ok := engs[rules]
+		if !ok {
+			logger.Info("Loading rule configuration from " + rules)
+			eng, err = rweng.NewEngFromYml(rules, events, logger)
+			if err != nil {
+				fmt.Printf("Error configuring rules for listener %s: %s\n", l.cfg.Name, err.Error())
+				os.Exit(1)
+			}
+			// a client block applies on every listener
+			eng.ShareBlocks(proxy.eng.Blocks())
+			engs[rules] = eng
+		}
+		l.eng = eng
+	}
+
+	// admin api
+	var adminSrv *admin.Server
+	if *adminCfgFile != "" {
+		logger.Info("Loading admin API configuration from " + *adminCfgFile)
+		adminSrv, err = admin.NewServerFromYaml(*adminCfgFile, proxy.eng, proxy.stats.Snapshot, logger)
+		if err != nil {
+			fmt.Printf("Error configuring admin API: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		for _, l := range listeners {
+			if l.eng == nil || l.eng == proxy.eng {
+				continue
+			}
+			if err := adminSrv.AddRules(l.cfg.Name, l.eng); err != nil {
+				fmt.Printf("Error configuring admin API: %s\n", err.Error())
+				os.Exit(1)
+			}
+		}
+
+		err = dash.NewDashboard(recent, traffic).Register(adminSrv)
+		if err != nil {
+			fmt.Printf("Error configuring dashboard: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != nil {
+				fmt.Printf("Error starting admin API: %s\n", err.Error())
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// health endpoints, served by n2proxy rather than proxied
+	var hc *health.Health
+	if healthCfg != nil {
+		hc = health.New()
+		hc.AddCheck("shutdown", proxy.Ready)
+		for _, u := range upstreams {
+			hc.AddCheck("upstream "+u.Name(), u.Check)
+		}
+	}
+
+	// servers
+	plain := false
+	for _, l := range listeners {
+		mux := http.NewServeMux()
+
+		if hc != nil {
+			mux.HandleFunc(healthCfg.Liveness, hc.Live)
+			mux.HandleFunc(healthCfg.Readiness, hc.Ready)
+		}
+
+		if l.cfg.Redirect {
+			mux.HandleFunc("/", redirectHTTPS(l.cfg.RedirectPort))
+		} else {
+			l := l
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				proxy.handle(w, r, l)
+			})
+		}
+
+		l.srv = &http.Server{
+			Addr:    l.cfg.Address,
+			Handler: mux,
+		}
+
+		// HTTP/2 is negotiated over TLS with ALPN, h2c applies without TLS
+		l.srv.Protocols = new(http.Protocols)
+		l.srv.Protocols.SetHTTP1(true)
+		l.srv.Protocols.SetHTTP2(*http2)
+		l.srv.Protocols.SetUnencryptedHTTP2(*h2c)
+		l.srv.HTTP2 = &http.HTTP2Config{
+			MaxConcurrentStreams: *http2MaxStreams,
+			MaxReadFrameSize:     *http2MaxFrameSize,
+		}
+
+		if l.tls == nil {
+			plain = true
+			continue
+		}
+
+		l.srv.TLSConfig = l.tls.cfg
+
+		// the ClientHello fingerprint is kept on the connection context
+		if *fingerprint {
+			l.srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+				return sec.NewFingerprintContext(ctx)
+			}
+		}
+
+		// HTTP/3 shares the TLS configuration and handler, TCP responses
+		// advertise it with Alt-Svc
+		if l.cfg.HTTP3 {
+			host, h3Port, _ := net.SplitHostPort(l.cfg.Address)
+			if l.cfg.HTTP3Port != "" {
+				h3Port = l.cfg.HTTP3Port
+			}
+
+			l.h3, err = newHTTP3Server(net.JoinHostPort(host, h3Port), l.tls.cfg, mux, *fingerprint)
+			if err != nil {
+				fmt.Printf("Error configuring HTTP/3 for listener %s: %s\n", l.cfg.Name, err.Error())
+				os.Exit(1)
+			}
+			l.srv.Handler = altSvc(l.h3, mux)
+		}
+	}
+
+	if *h2c && !plain {
+		logger.Warn("h2c only applies without TLS, use http2 instead.")
+	}
+
+	for _, l := range listeners {
+		if err := l.listen(logger); err != nil {
+			fmt.Printf("Error starting listener %s: %s\n", l.cfg.Name, err.Error())
+			os.Exit(1)
+		}
+
+		mode := "plain HTTP"
+		switch {
+		case l.tls != nil:
+			mode = "TLS"
+		case l.cfg.Redirect:
+			mode = "HTTPS redirect"
+		}
+		logger.Info("Starting listener "+l.cfg.Name+" on "+l.cfg.Address,
+			zap.String("Mode", mode),
+			zap.Bool("ProxyProtocol", l.cfg.ProxyProtocol != nil),
+		)
+		if l.h3 != nil {
+			logger.Info("Starting HTTP/3 listener " + l.cfg.Name + " on UDP " + l.h3.Addr)
+		}
+	}
+
+	serveErr := make(chan error, 2*len(listeners))
+	for _, l := range listeners {
+		l := l
+		if l.h3 != nil {
+			go func() {
+				serveErr <- fmt.Errorf("listener %s: %w", l.cfg.Name, l.h3.serve())
+			}()
+		}
+		go func() {
+			serveErr <- fmt.Errorf("listener %s: %w", l.cfg.Name, l.serve())
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	exitCode := 0
+	select {
+	case err = <-serveErr:
+		fmt.Printf("Error starting proxy: %s\n", err.Error())
+		exitCode = 1
+	case sig := <-signals:
+		logger.Info("Received " + sig.String() + ", shutting down.")
+		proxy.Drain()
+
+		// keep serving while load balancers notice the failing readiness
+		if *shutdownDelay > 0 {
+			for _, l := range listeners {
+				l.srv.SetKeepAlivesEnabled(false)
+			}
+			time.Sleep(*shutdownDelay)
+		}
+	}
+
+	// stop accepting connections and drain in-flight requests on
+	// every listener at once, also when one failed to serve
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	drained := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			err := l.shutdown(ctx)
+			if err != nil {
+				logger.Warn("Listener " + l.cfg.Name + " did not drain in time: " + err.Error())
+			}
+			drained <- err
+		}(l)
 	}
+	for range listeners {
+		if err := <-drained; err != nil {
+			exitCode = 1
+		}
+	}
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(ctx); err != nil {
+			logger.Warn("Admin API did not drain in time: " + err.Error())
+		}
+	}
+	cancel()
+
+	for _, u := range upstreams {
+		u.Stop()
+	}
+	for _, lt := range tlsByCfg {
+		lt.Stop()
+	}
+
+	// flush security events, alerts and spans before exiting; handlers
+	// still running after a listener failed to drain find the stream
+	// closed and drop their events
+	events.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	if err := tracer.Shutdown(ctx); err != nil {
+		logger.Warn("Error flushing traces: " + err.Error())
+	}
+	cancel()
+
+	logger.Info("Shutdown complete.")
+	logger.Sync()
+
+	os.Exit(exitCode)
 }
 
 // getEnv gets an environment variable or sets a default if
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/txn2/n2proxy/tracing"
+	"github.com/txn2/n2proxy/upstream"
+	"go.uber.org/zap"
+)
+
+func TestStatusWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w http.ResponseWriter)
+		want  int
+	}{
+		{name: "nothing written", write: func(w http.ResponseWriter) {}},
+		{name: "body only", write: func(w http.ResponseWriter) { w.Write([]byte("ok")) }, want: http.StatusOK},
+		{name: "status", write: func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) }, want: http.StatusBadGateway},
+		{name: "first status wins", write: func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusForbidden)
+			w.WriteHeader(http.StatusOK)
+		}, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sw := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+			tt.write(sw)
+			if sw.status != tt.want {
+				t.Errorf("status %d, want %d", sw.status, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusWriterFlush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sw := &statusWriter{ResponseWriter: rec}
+
+	// streaming responses flush through the wrapper
+	if err := http.NewResponseController(sw).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !rec.Flushed {
+		t.Error("the response was not flushed")
+	}
+}
+
+// testProxy serves a proxy to backend on a loopback listener accepting
+// HTTP/1 and h2c. The router, rules and tracer of cfg are set here.
+func testProxy(t *testing.T, backend string, cfg ProxyCfg) (*Proxy, *listener) {
+	t.Helper()
+
+	logger := zap.NewNop()
+
+	cfgFile := filepath.Join(t.TempDir(), "cfg.yml")
+	if err := ioutil.WriteFile(cfgFile, []byte("urlBan:\n  - onload\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tracer, err := tracing.NewTracer(tracing.Cfg{}, Version, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := upstream.NewUpstream(upstream.UpstreamCfg{
+		Name:    "default",
+		Targets: []upstream.TargetCfg{{URL: backend}},
+	}, tracer.Transport, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := upstream.NewRouter(nil, []*upstream.Upstream{u})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Router, cfg.CfgFile, cfg.Tracer = router, cfgFile, tracer
+	proxy := NewProxy(cfg, logger)
+
+	l := &listener{cfg: ListenerCfg{Name: "main", Address: "127.0.0.1:0"}, eng: proxy.eng}
+	if err := l.listen(logger); err != nil {
+		t.Fatal(err)
+	}
+	l.srv = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxy.handle(w, r, l)
+	})}
+	l.srv.Protocols = new(http.Protocols)
+	l.srv.Protocols.SetHTTP1(true)
+	l.srv.Protocols.SetUnencryptedHTTP2(true)
+	go l.serve()
+	t.Cleanup(func() { l.srv.Close() })
+
+	return proxy, l
+}
+
+func TestShutdownDrainsInFlight(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(arrived)
+			<-release
+		}
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	proxy, l := testProxy(t, backend.URL, ProxyCfg{})
+	addr := "http://" + l.ln.Addr().String()
+	url := addr + "/slow"
+
+	type result struct {
+		resp *http.Response
+		body string
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		inFlight <- result{resp: resp, body: string(b), err: err}
+	}()
+	<-arrived
+
+	// readiness fails first, then the listener closes and waits
+	proxy.Drain()
+	if proxy.Ready() == nil {
+		t.Error("ready while draining")
+	}
+
+	// requests during the shutdown delay ask clients to reconnect
+	resp, err := http.Get(addr + "/fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !resp.Close {
+		t.Error("response while draining keeps the connection open")
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- l.shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// no new connections once shutdown started
+	if resp, err := http.Get(url); err == nil {
+		resp.Body.Close()
+		t.Error("new request accepted during shutdown")
+	}
+
+	close(release)
+
+	res := <-inFlight
+	if res.err != nil {
+		t.Fatalf("in-flight request: %v", res.err)
+	}
+	if res.resp.StatusCode != http.StatusOK || res.body != "done" {
+		t.Errorf("in-flight response %d %q, want 200 done", res.resp.StatusCode, res.body)
+	}
+	if !res.resp.Close {
+		t.Error("the in-flight connection stays open after shutdown")
+	}
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not return after the request completed")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	_, l := testProxy(t, backend.URL, ProxyCfg{})
+
+	go func() {
+		if resp, err := http.Get("http://" + l.ln.Addr().String() + "/"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-arrived
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("shutdown error %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// unsized hides the length of a body so it is sent chunked, or as
+// HTTP/2 data frames without a Content-Length
+type unsized struct {
+	io.Reader
+}
+
+func TestMaxBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("backend read: %v", err)
+		}
+		w.Write([]byte(strconv.Itoa(len(b))))
+	}))
+	defer backend.Close()
+
+	_, l := testProxy(t, backend.URL, ProxyCfg{MaxBody: 16})
+	url := "http://" + l.ln.Addr().String() + "/upload"
+
+	h1 := &http.Client{}
+	h2c := &http.Client{Transport: &http.Transport{Protocols: new(http.Protocols)}}
+	h2c.Transport.(*http.Transport).Protocols.SetUnencryptedHTTP2(true)
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		proto  string
+		size   int
+		sized  bool
+		want   int
+	}{
+		{name: "h2c within the limit", client: h2c, proto: "HTTP/2.0", size: 16, want: http.StatusOK},
+		{name: "h2c over the limit", client: h2c, proto: "HTTP/2.0", size: 17, want: http.StatusRequestEntityTooLarge},
+		{name: "h2c over the limit with a length", client: h2c, proto: "HTTP/2.0", size: 17, sized: true, want: http.StatusRequestEntityTooLarge},
+		{name: "chunked within the limit", client: h1, proto: "HTTP/1.1", size: 16, want: http.StatusOK},
+		{name: "chunked over the limit", client: h1, proto: "HTTP/1.1", size: 1024, want: http.StatusRequestEntityTooLarge},
+		{name: "length over the limit", client: h1, proto: "HTTP/1.1", size: 17, sized: true, want: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(strings.Repeat("a", tt.size))
+			if !tt.sized {
+				body = unsized{body}
+			}
+
+			resp, err := tt.client.Post(url, "text/plain", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			b, _ := ioutil.ReadAll(resp.Body)
+
+			if resp.Proto != tt.proto {
+				t.Errorf("served over %s, want %s", resp.Proto, tt.proto)
+			}
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusOK && string(b) != strconv.Itoa(tt.size) {
+				t.Errorf("backend received %s bytes, want %d", b, tt.size)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/txn2/n2proxy/evt"
+	"github.com/txn2/n2proxy/rweng"
+	"github.com/txn2/n2proxy/sec"
+)
+
+// Stats counts proxied requests by rule verdict
+type Stats struct {
+	requests uint64 // first for 64-bit atomic alignment on arm
+	clean    uint64
+	actions  map[string]*uint64
+	started  time.Time
+	certs    []*sec.Certificates
+}
+
+// NewStats instances zeroed counters, reporting the status of certs
+func NewStats(certs []*sec.Certificates) *Stats {
+	actions := make(map[string]*uint64, 0)
+	for _, a := range []string{evt.ActionBypass, evt.ActionFilter, evt.ActionRewrite, evt.ActionDropBody, evt.ActionBlock} {
+		actions[a] = new(uint64)
+	}
+
+	return &Stats{
+		actions: actions,
+		started: time.Now(),
+		certs:   certs,
+	}
+}
+
+// Count records a processed request
+func (s *Stats) Count(v *rweng.Verdict) {
+	atomic.AddUint64(&s.requests, 1)
+
+	if c, ok := s.actions[v.Action]; ok {
+		atomic.AddUint64(c, 1)
+		return
+	}
+
+	atomic.AddUint64(&s.clean, 1)
+}
+
+// Snapshot returns the current counters for rendering as JSON
+func (s *Stats) Snapshot() interface{} {
+	actions := make(map[string]uint64, len(s.actions))
+	for a, c := range s.actions {
+		actions[a] = atomic.LoadUint64(c)
+	}
+
+	snapshot := map[string]interface{}{
+		"version":    Version,
+		"started":    s.started.UTC(),
+		"uptime":     time.Since(s.started).Round(time.Second).String(),
+		"goroutines": runtime.NumGoroutine(),
+		"requests":   atomic.LoadUint64(&s.requests),
+		"clean":      atomic.LoadUint64(&s.clean),
+		"actions":    actions,
+	}
+
+	if len(s.certs) > 0 {
+		var status []sec.CertStatus
+		for _, c := range s.certs {
+			status = append(status, c.Status()...)
+		}
+		snapshot["certificates"] = status
+	}
+
+	return snapshot
+}
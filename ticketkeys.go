@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/txn2/n2proxy/sec"
+)
+
+// ticketkeys implements the ticketkeys subcommand, adding a new session
+// ticket key to a shared key file
+func ticketkeys(args []string) int {
+	fs := flag.NewFlagSet("ticketkeys", flag.ExitOnError)
+	file := fs.String("file", "./ticket.keys", "session ticket key file.")
+	keep := fs.Int("keep", 3, "keys kept, older tickets can be resumed until their key is dropped.")
+	fs.Parse(args)
+
+	if err := sec.RotateSessionTicketKeys(*file, *keep); err != nil {
+		fmt.Printf("Error rotating session ticket keys: %s\n", err.Error())
+		return 1
+	}
+
+	fmt.Printf("Rotated session ticket keys in %s\n", *file)
+
+	return 0
+}
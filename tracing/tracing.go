@@ -0,0 +1,212 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/txn2/n2proxy/redact"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap"
+)
+
+const instrumentation = "github.com/txn2/n2proxy"
+
+// Cfg defines OTLP trace export. An empty Endpoint disables export;
+// W3C trace context is still propagated to the backend.
+type Cfg struct {
+	Endpoint    string
+	Protocol    string
+	Insecure    bool
+	ServiceName string
+	SampleRatio float64
+	// Redact masks exported query strings like logs and events
+	Redact redact.Cfg
+}
+
+// Tracer creates spans for proxied requests and propagates W3C
+// traceparent and tracestate headers.
+type Tracer struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	redactor   *redact.Redactor
+}
+
+// NewTracer instances a Tracer exporting to an OTLP collector
+func NewTracer(cfg Cfg, version string, logger *zap.Logger) (*Tracer, error) {
+	redactor, err := redact.New(cfg.Redact)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tracer{
+		tracer:     noop.NewTracerProvider().Tracer(instrumentation),
+		propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+		redactor:   redactor,
+	}
+
+	if cfg.Endpoint == "" {
+		return t, nil
+	}
+
+	exporter, err := newExporter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "n2proxy"
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+		semconv.ServiceVersion(version),
+	)
+
+	t.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	t.tracer = t.provider.Tracer(instrumentation, trace.WithInstrumentationVersion(version))
+
+	logger.Info("Exporting traces",
+		zap.String("Endpoint", cfg.Endpoint),
+		zap.String("Protocol", cfg.Protocol),
+		zap.Float64("SampleRatio", cfg.SampleRatio),
+	)
+
+	return t, nil
+}
+
+func newExporter(cfg Cfg) (*otlptrace.Exporter, error) {
+	ctx := context.Background()
+
+	switch strings.ToLower(cfg.Protocol) {
+	case "", "grpc":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case "http", "http/protobuf":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+
+	return nil, fmt.Errorf("unknown otlp protocol: %s", cfg.Protocol)
+}
+
+// StartRequest extracts trace context from an incoming request and
+// starts its server span.
+func (t *Tracer) StartRequest(r *http.Request) (context.Context, trace.Span) {
+	ctx := t.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	return t.tracer.Start(ctx, "proxy "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+			semconv.ServerAddress(r.Host),
+			semconv.UserAgentOriginal(r.UserAgent()),
+			attribute.String("client.address", r.RemoteAddr),
+		),
+	)
+}
+
+// Start starts an internal child span
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, trace.Span) {
+	return t.tracer.Start(ctx, name)
+}
+
+// Transport wraps rt with an upstream client span and injects the
+// span's trace context into the outgoing request headers.
+func (t *Tracer) Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &transport{tracer: t, next: rt}
+}
+
+// Shutdown flushes pending spans
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t.provider == nil {
+		return nil
+	}
+	return t.provider.Shutdown(ctx)
+}
+
+type transport struct {
+	tracer *Tracer
+	next   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (tr *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	attrs := []attribute.KeyValue{
+		semconv.HTTPRequestMethodKey.String(r.Method),
+		semconv.URLScheme(r.URL.Scheme),
+		semconv.URLPath(r.URL.Path),
+		semconv.ServerAddress(r.URL.Host),
+	}
+	// the collector is outside the redaction boundary of logs and
+	// events, so only the masked query is exported
+	if r.URL.RawQuery != "" {
+		attrs = append(attrs, semconv.URLQuery(tr.tracer.redactor.URI(r.URL.RawQuery)))
+	}
+
+	ctx, span := tr.tracer.tracer.Start(r.Context(), "upstream "+r.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+	defer span.End()
+
+	// the proxy already owns a clone of the request headers
+	r = r.WithContext(ctx)
+	tr.tracer.propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+
+	resp, err := tr.next.RoundTrip(r)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+
+	return resp, nil
+}
+
+// RecordRules annotates a span with the most severe rule action and
+// the ids of the matched rules and emitted events
+func RecordRules(span trace.Span, action string, rules []string, events []string) {
+	span.SetAttributes(
+		attribute.String("n2proxy.rule.action", action),
+		attribute.StringSlice("n2proxy.rule.ids", rules),
+		attribute.StringSlice("n2proxy.event.ids", events),
+		attribute.Int("n2proxy.rule.hits", len(rules)),
+	)
+}
+
+// RecordRequestID annotates a span with the n2proxy request id
+func RecordRequestID(span trace.Span, id string) {
+	span.SetAttributes(attribute.String("n2proxy.request_id", id))
+}
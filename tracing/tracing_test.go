@@ -0,0 +1,188 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/txn2/n2proxy/redact"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	parentTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentSpanID  = "00f067aa0ba902b7"
+	traceparent   = "00-" + parentTraceID + "-" + parentSpanID + "-01"
+)
+
+// recorder keeps the spans ended by a tracer provider
+type recorder struct {
+	mu    sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (rc *recorder) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (rc *recorder) OnEnd(s sdktrace.ReadOnlySpan) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.spans = append(rc.spans, s)
+}
+
+func (rc *recorder) Shutdown(context.Context) error   { return nil }
+func (rc *recorder) ForceFlush(context.Context) error { return nil }
+
+// recordingTracer returns a tracer sampling every span into a recorder
+func recordingTracer(t *testing.T, cfg Cfg) (*Tracer, *recorder) {
+	t.Helper()
+
+	tr, err := NewTracer(cfg, "test", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &recorder{}
+	tr.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithSpanProcessor(rc),
+	)
+	tr.tracer = tr.provider.Tracer(instrumentation)
+
+	return tr, rc
+}
+
+func TestStartRequestExtractsTraceparent(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		parent bool
+	}{
+		{name: "traceparent", header: traceparent, parent: true},
+		{name: "none"},
+		{name: "malformed", header: "00-xyz-01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, _ := recordingTracer(t, Cfg{})
+
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set("traceparent", tt.header)
+			}
+
+			_, span := tr.StartRequest(r)
+			defer span.End()
+
+			traceID := span.SpanContext().TraceID().String()
+			if got := traceID == parentTraceID; got != tt.parent {
+				t.Errorf("trace id %s, continued %t, want %t", traceID, got, tt.parent)
+			}
+			if !span.SpanContext().IsValid() {
+				t.Error("invalid span context")
+			}
+		})
+	}
+}
+
+func TestTransportInjectsTraceparent(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	// without an endpoint spans are not recorded, the incoming trace
+	// context is still passed on
+	tr, err := NewTracer(Cfg{}, "test", zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := httptest.NewRequest("GET", "/", nil)
+	in.Header.Set("traceparent", traceparent)
+	in.Header.Set("tracestate", "vendor=value")
+	ctx, span := tr.StartRequest(in)
+	defer span.End()
+
+	out, err := http.NewRequestWithContext(ctx, "GET", backend.URL+"/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.Transport(nil).RoundTrip(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	state, err := trace.ParseTraceState(got.Get("tracestate"))
+	if err != nil || state.Get("vendor") != "value" {
+		t.Errorf("tracestate %q, want vendor=value", got.Get("tracestate"))
+	}
+	if got.Get("traceparent") != traceparent {
+		t.Errorf("traceparent %q, want %q", got.Get("traceparent"), traceparent)
+	}
+}
+
+func TestTransportUpstreamSpan(t *testing.T) {
+	var got string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+
+	tr, rc := recordingTracer(t, Cfg{Redact: redact.Cfg{Fields: []string{"account"}}})
+
+	in := httptest.NewRequest("GET", "/", nil)
+	in.Header.Set("traceparent", traceparent)
+	ctx, span := tr.StartRequest(in)
+
+	out, err := http.NewRequestWithContext(ctx, "GET", backend.URL+"/path?account=12345&page=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := tr.Transport(nil).RoundTrip(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	span.End()
+
+	if len(rc.spans) != 2 {
+		t.Fatalf("%d spans, want the upstream and server spans", len(rc.spans))
+	}
+	upstream := rc.spans[0]
+
+	// the backend sees the upstream span as its parent
+	want := "00-" + parentTraceID + "-" + upstream.SpanContext().SpanID().String() + "-01"
+	if got != want {
+		t.Errorf("traceparent %q, want %q", got, want)
+	}
+	if upstream.Parent().SpanID() != rc.spans[1].SpanContext().SpanID() {
+		t.Error("the upstream span is not a child of the server span")
+	}
+
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range upstream.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if q := attrs[semconv.URLQueryKey].AsString(); q == "" || q == "account=12345&page=2" {
+		t.Errorf("exported query %q, want account masked", q)
+	}
+	if code := attrs[semconv.HTTPResponseStatusCodeKey].AsInt64(); code != http.StatusBadGateway {
+		t.Errorf("status code %d, want 502", code)
+	}
+}
+
+func TestNewTracerRedactError(t *testing.T) {
+	if _, err := NewTracer(Cfg{Redact: redact.Cfg{Detect: []string{"phone"}}}, "test", zap.NewNop()); err == nil {
+		t.Error("NewTracer accepted an unknown redaction detector")
+	}
+}
@@ -0,0 +1,174 @@
+package upstream
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Load balancing strategies
+const (
+	StrategyRoundRobin = "roundRobin"
+	StrategyWeighted   = "weighted"
+	StrategyLeastConn  = "leastConn"
+	StrategyHash       = "hash"
+)
+
+// hashReplicas is the number of ring points per unit of weight
+const hashReplicas = 100
+
+// balancer picks a target from the available targets of an upstream
+type balancer interface {
+	pick(r *http.Request, available []*Target) *Target
+}
+
+func newBalancer(cfg UpstreamCfg, targets []*Target) (balancer, error) {
+	switch cfg.Strategy {
+	case "", StrategyRoundRobin:
+		return &roundRobin{}, nil
+	case StrategyWeighted:
+		return &weighted{}, nil
+	case StrategyLeastConn:
+		return &leastConn{}, nil
+	case StrategyHash:
+		return newHashRing(targets, cfg.HashHeader), nil
+	}
+
+	return nil, fmt.Errorf("unknown load balancing strategy: %s", cfg.Strategy)
+}
+
+// roundRobin cycles through the available targets
+type roundRobin struct {
+	next uint64
+}
+
+func (b *roundRobin) pick(r *http.Request, available []*Target) *Target {
+	n := atomic.AddUint64(&b.next, 1)
+	return available[n%uint64(len(available))]
+}
+
+// weighted is smooth weighted round robin, spreading each target's
+// share evenly rather than in bursts
+type weighted struct {
+	mu sync.Mutex
+}
+
+func (b *weighted) pick(r *http.Request, available []*Target) *Target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *Target
+	total := 0
+
+	for _, t := range available {
+		t.current += t.Weight
+		total += t.Weight
+		if best == nil || t.current > best.current {
+			best = t
+		}
+	}
+
+	best.current -= total
+
+	return best
+}
+
+// leastConn picks the target with the fewest in-flight requests,
+// scanning from a rotating offset so ties are spread out
+type leastConn struct {
+	next uint64
+}
+
+func (b *leastConn) pick(r *http.Request, available []*Target) *Target {
+	offset := int(atomic.AddUint64(&b.next, 1) % uint64(len(available)))
+
+	var best *Target
+	for i := range available {
+		t := available[(offset+i)%len(available)]
+		if best == nil || t.Active() < best.Active() {
+			best = t
+		}
+	}
+
+	return best
+}
+
+// hashRing is consistent hashing by client IP or a request header, so
+// a client keeps its target while the target set is stable
+type hashRing struct {
+	header string
+	points []uint32
+	owners map[uint32]*Target
+}
+
+func newHashRing(targets []*Target, header string) *hashRing {
+	h := &hashRing{
+		header: header,
+		points: make([]uint32, 0),
+		owners: make(map[uint32]*Target, 0),
+	}
+
+	for _, t := range targets {
+		for i := 0; i < hashReplicas*t.Weight; i++ {
+			p := hashKey(t.URL.String() + "#" + strconv.Itoa(i))
+			if _, ok := h.owners[p]; ok {
+				continue
+			}
+			h.owners[p] = t
+			h.points = append(h.points, p)
+		}
+	}
+
+	sort.Slice(h.points, func(i, j int) bool { return h.points[i] < h.points[j] })
+
+	return h
+}
+
+func (h *hashRing) pick(r *http.Request, available []*Target) *Target {
+	key := ""
+	if h.header != "" {
+		key = r.Header.Get(h.header)
+	}
+	if key == "" {
+		key, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+
+	ok := make(map[*Target]bool, len(available))
+	for _, t := range available {
+		ok[t] = true
+	}
+
+	// walk clockwise to the first available owner
+	hash := hashKey(key)
+	start := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= hash })
+	for i := 0; i < len(h.points); i++ {
+		t := h.owners[h.points[(start+i)%len(h.points)]]
+		if ok[t] {
+			return t
+		}
+	}
+
+	return available[0]
+}
+
+// hashKey is FNV-1a with the murmur3 finalizer, FNV alone leaves keys
+// differing in their last characters, like ring point names and client
+// IPs, close together on the ring
+func hashKey(s string) uint32 {
+	f := fnv.New32a()
+	f.Write([]byte(s))
+	h := f.Sum32()
+
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
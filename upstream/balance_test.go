@@ -0,0 +1,174 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testTargets(weights ...int) []*Target {
+	targets := make([]*Target, 0, len(weights))
+	for i, w := range weights {
+		u, _ := url.Parse(fmt.Sprintf("http://10.0.0.%d:8080", i+1))
+		targets = append(targets, &Target{URL: u, Weight: w})
+	}
+	return targets
+}
+
+func TestBalancerDistribution(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		weights  []int
+		picks    int
+		want     []int
+	}{
+		{name: "round robin", strategy: StrategyRoundRobin, weights: []int{1, 1, 1}, picks: 9, want: []int{3, 3, 3}},
+		{name: "weighted", strategy: StrategyWeighted, weights: []int{5, 1, 1}, picks: 7, want: []int{5, 1, 1}},
+		{name: "weighted even", strategy: StrategyWeighted, weights: []int{2, 2}, picks: 8, want: []int{4, 4}},
+		{name: "least conn ties", strategy: StrategyLeastConn, weights: []int{1, 1}, picks: 10, want: []int{5, 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := testTargets(tt.weights...)
+			b, err := newBalancer(UpstreamCfg{Strategy: tt.strategy}, targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			counts := make(map[*Target]int)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for i := 0; i < tt.picks; i++ {
+				counts[b.pick(r, targets)]++
+			}
+
+			for i, target := range targets {
+				if counts[target] != tt.want[i] {
+					t.Errorf("target %d picked %d times, want %d", i, counts[target], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLeastConnPicksFewestActive(t *testing.T) {
+	targets := testTargets(1, 1, 1)
+	targets[0].active = 3
+	targets[1].active = 1
+	targets[2].active = 2
+
+	b := &leastConn{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < len(targets); i++ {
+		if got := b.pick(r, targets); got != targets[1] {
+			t.Fatalf("picked %s, want %s", got.URL, targets[1].URL)
+		}
+	}
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	if _, err := newBalancer(UpstreamCfg{Strategy: "random"}, testTargets(1)); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+}
+
+func TestHashRingKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		value      string
+		sameAs     func(r *http.Request)
+	}{
+		{
+			name:       "client ip ignores the port",
+			remoteAddr: "192.0.2.10:1234",
+			sameAs:     func(r *http.Request) { r.RemoteAddr = "192.0.2.10:5678" },
+		},
+		{
+			name:       "header",
+			header:     "X-Session",
+			remoteAddr: "192.0.2.10:1234",
+			value:      "session-a",
+			sameAs:     func(r *http.Request) { r.RemoteAddr = "198.51.100.7:1234" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := testTargets(1, 1, 1, 1)
+			h := newHashRing(targets, tt.header)
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.value != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			first := h.pick(r, targets)
+
+			tt.sameAs(r)
+			if got := h.pick(r, targets); got != first {
+				t.Errorf("picked %s, want %s", got.URL, first.URL)
+			}
+		})
+	}
+}
+
+func TestHashRingConsistency(t *testing.T) {
+	targets := testTargets(1, 1, 1, 1)
+	h := newHashRing(targets, "X-Session")
+
+	before := make(map[string]*Target)
+	counts := make(map[*Target]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("session-%d", i)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Session", key)
+		before[key] = h.pick(r, targets)
+		counts[before[key]]++
+	}
+
+	// every target owns a share of the keys
+	for i, target := range targets {
+		if counts[target] < 150 || counts[target] > 350 {
+			t.Errorf("target %d owns %d of 1000 keys", i, counts[target])
+		}
+	}
+
+	// keys of an unavailable target move, all others stay
+	available := targets[1:]
+	for key, was := range before {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Session", key)
+		got := h.pick(r, available)
+
+		if was == targets[0] {
+			if got == targets[0] {
+				t.Fatalf("%s: picked the unavailable target", key)
+			}
+			continue
+		}
+		if got != was {
+			t.Errorf("%s moved from %s to %s", key, was.URL, got.URL)
+		}
+	}
+}
+
+func TestHashRingWeight(t *testing.T) {
+	targets := testTargets(3, 1)
+	h := newHashRing(targets, "X-Session")
+
+	counts := make(map[*Target]int)
+	for i := 0; i < 1000; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Session", fmt.Sprintf("session-%d", i))
+		counts[h.pick(r, targets)]++
+	}
+
+	if counts[targets[0]] < 2*counts[targets[1]] {
+		t.Errorf("weight 3 target owns %d keys, weight 1 target %d", counts[targets[0]], counts[targets[1]])
+	}
+}
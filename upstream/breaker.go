@@ -0,0 +1,158 @@
+package upstream
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrCircuitOpen is returned while an upstream's circuit breaker is open
+var ErrCircuitOpen = errors.New("upstream circuit open")
+
+// BreakerCfg opens the circuit when at least MinRequests complete in a
+// Window and the share of failures reaches ErrorRatio. After OpenTime
+// one trial request is let through; its result closes or reopens the
+// circuit.
+type BreakerCfg struct {
+	ErrorRatio  float64       `yaml:"errorRatio"`
+	MinRequests int           `yaml:"minRequests"`
+	Window      time.Duration `yaml:"window"`
+	OpenTime    time.Duration `yaml:"openTime"`
+}
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// breaker is a circuit breaker over fixed windows of request results
+type breaker struct {
+	cfg         BreakerCfg
+	mu          sync.Mutex
+	state       int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	trial       bool // a half open trial request is in flight
+	logger      *zap.Logger
+}
+
+func newBreaker(cfg *BreakerCfg, logger *zap.Logger) *breaker {
+	if cfg == nil {
+		return nil
+	}
+
+	b := &breaker{cfg: *cfg, logger: logger}
+	if b.cfg.ErrorRatio <= 0 || b.cfg.ErrorRatio > 1 {
+		b.cfg.ErrorRatio = 0.5
+	}
+	if b.cfg.MinRequests < 1 {
+		b.cfg.MinRequests = 20
+	}
+	if b.cfg.Window <= 0 {
+		b.cfg.Window = 10 * time.Second
+	}
+	if b.cfg.OpenTime <= 0 {
+		b.cfg.OpenTime = 30 * time.Second
+	}
+
+	return b
+}
+
+// allow reports whether a request may be sent. A nil breaker allows
+// everything.
+func (b *breaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.cfg.OpenTime {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.trial = true
+		return true
+	case circuitHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+
+	return true
+}
+
+// record counts the result of an allowed request
+func (b *breaker) record(ok bool, now time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitHalfOpen {
+		b.trial = false
+		if ok {
+			b.reset(circuitClosed, now)
+			b.logger.Info("Upstream circuit closed")
+			return
+		}
+		b.reset(circuitOpen, now)
+		b.logger.Warn("Upstream circuit reopened")
+		return
+	}
+
+	if b.state != circuitClosed {
+		return
+	}
+
+	if now.Sub(b.windowStart) >= b.cfg.Window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+
+	b.requests++
+	if !ok {
+		b.failures++
+	}
+
+	if b.requests >= b.cfg.MinRequests && float64(b.failures)/float64(b.requests) >= b.cfg.ErrorRatio {
+		b.logger.Warn("Upstream circuit opened",
+			zap.Int("Requests", b.requests),
+			zap.Int("Failures", b.failures),
+			zap.Duration("OpenTime", b.cfg.OpenTime),
+		)
+		b.reset(circuitOpen, now)
+	}
+}
+
+// release ends an allowed request that has no result, such as one the
+// client canceled. A half open trial is let through again.
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitHalfOpen {
+		b.trial = false
+	}
+}
+
+func (b *breaker) reset(state int, now time.Time) {
+	b.state = state
+	b.openedAt = now
+	b.windowStart, b.requests, b.failures = now, 0, 0
+}
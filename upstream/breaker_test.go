@@ -0,0 +1,136 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	cfg := &BreakerCfg{ErrorRatio: 0.5, MinRequests: 4, Window: 10 * time.Second, OpenTime: 30 * time.Second}
+
+	// a step asks allow, records a result or releases a request at an
+	// offset from the start, then checks the state
+	type step struct {
+		at      time.Duration
+		record  *bool // nil asks allow
+		release bool
+		allow   bool
+		state   int
+	}
+	ok, fail := true, false
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "stays closed below min requests",
+			steps: []step{
+				{record: &fail, state: circuitClosed},
+				{record: &fail, state: circuitClosed},
+				{record: &fail, state: circuitClosed},
+				{allow: true, state: circuitClosed},
+			},
+		},
+		{
+			name: "stays closed below the error ratio",
+			steps: []step{
+				{record: &ok, state: circuitClosed},
+				{record: &ok, state: circuitClosed},
+				{record: &ok, state: circuitClosed},
+				{record: &fail, state: circuitClosed},
+				{allow: true, state: circuitClosed},
+			},
+		},
+		{
+			name: "opens at the error ratio",
+			steps: []step{
+				{record: &ok, state: circuitClosed},
+				{record: &ok, state: circuitClosed},
+				{record: &fail, state: circuitClosed},
+				{record: &fail, state: circuitOpen},
+				{at: 29 * time.Second, allow: false, state: circuitOpen},
+			},
+		},
+		{
+			name: "failures of an old window are dropped",
+			steps: []step{
+				{record: &fail, state: circuitClosed},
+				{record: &fail, state: circuitClosed},
+				{record: &fail, state: circuitClosed},
+				{at: 11 * time.Second, record: &fail, state: circuitClosed},
+			},
+		},
+		{
+			name: "half open lets one trial through and closes on success",
+			steps: []step{
+				{record: &fail}, {record: &fail}, {record: &fail}, {record: &fail, state: circuitOpen},
+				{at: 30 * time.Second, allow: true, state: circuitHalfOpen},
+				{at: 30 * time.Second, allow: false, state: circuitHalfOpen},
+				{at: 31 * time.Second, record: &ok, state: circuitClosed},
+				{at: 31 * time.Second, allow: true, state: circuitClosed},
+			},
+		},
+		{
+			name: "failed trial reopens",
+			steps: []step{
+				{record: &fail}, {record: &fail}, {record: &fail}, {record: &fail, state: circuitOpen},
+				{at: 30 * time.Second, allow: true, state: circuitHalfOpen},
+				{at: 31 * time.Second, record: &fail, state: circuitOpen},
+				{at: 60 * time.Second, allow: false, state: circuitOpen},
+				{at: 61 * time.Second, allow: true, state: circuitHalfOpen},
+			},
+		},
+		{
+			name: "released trial lets the next one through",
+			steps: []step{
+				{record: &fail}, {record: &fail}, {record: &fail}, {record: &fail, state: circuitOpen},
+				{at: 30 * time.Second, allow: true, state: circuitHalfOpen},
+				{at: 31 * time.Second, release: true, state: circuitHalfOpen},
+				{at: 31 * time.Second, allow: true, state: circuitHalfOpen},
+				{at: 31 * time.Second, allow: false, state: circuitHalfOpen},
+			},
+		},
+		{
+			name: "released requests are not counted",
+			steps: []step{
+				{record: &fail}, {record: &fail}, {record: &fail},
+				{release: true}, {release: true}, {release: true},
+				{allow: true, state: circuitClosed},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBreaker(cfg, zap.NewNop())
+			start := time.Now()
+			b.reset(circuitClosed, start)
+
+			for i, s := range tt.steps {
+				now := start.Add(s.at)
+				if s.record != nil {
+					b.record(*s.record, now)
+				} else if s.release {
+					b.release()
+				} else if got := b.allow(now); got != s.allow {
+					t.Fatalf("step %d: allow %t, want %t", i, got, s.allow)
+				}
+				if b.state != s.state {
+					t.Fatalf("step %d: state %d, want %d", i, b.state, s.state)
+				}
+			}
+		})
+	}
+}
+
+func TestNilBreaker(t *testing.T) {
+	b := newBreaker(nil, zap.NewNop())
+	if !b.allow(time.Now()) {
+		t.Error("a nil breaker must allow requests")
+	}
+	b.record(false, time.Now())
+	b.release()
+}
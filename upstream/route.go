@@ -0,0 +1,218 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ErrNoRoute is returned for requests no route matches
+var ErrNoRoute = errors.New("no route")
+
+// RouteCfg sends matching requests to a named upstream. Every field
+// set must match; routes are tried in order.
+type RouteCfg struct {
+	Name        string            `yaml:"name"`
+	Host        string            `yaml:"host"`       // exact or *.example.com
+	PathPrefix  string            `yaml:"pathPrefix"` // e.g. /api/
+	PathRegexp  string            `yaml:"pathRegexp"`
+	Methods     []string          `yaml:"methods"`
+	Headers     map[string]string `yaml:"headers"` // exact values, "*" requires presence
+	Upstream    string            `yaml:"upstream"`
+	StripPrefix string            `yaml:"stripPrefix"` // removed from the path before proxying
+	AddPrefix   string            `yaml:"addPrefix"`   // added to the path after StripPrefix
+}
+
+// Route is a compiled RouteCfg
+type Route struct {
+	cfg      RouteCfg
+	methods  map[string]bool
+	rgx      *regexp.Regexp
+	upstream *Upstream
+}
+
+// Name returns the route name
+func (rt *Route) Name() string {
+	return rt.cfg.Name
+}
+
+// Upstream returns the upstream requests are sent to
+func (rt *Route) Upstream() *Upstream {
+	return rt.upstream
+}
+
+// match reports whether the request matches every condition
+func (rt *Route) match(r *http.Request) bool {
+	if rt.cfg.Host != "" && !matchHost(rt.cfg.Host, r.Host) {
+		return false
+	}
+	if rt.cfg.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rt.cfg.PathPrefix) {
+		return false
+	}
+	if rt.rgx != nil && !rt.rgx.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(rt.methods) > 0 && !rt.methods[r.Method] {
+		return false
+	}
+	for name, value := range rt.cfg.Headers {
+		got, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (value != "*" && got[0] != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Rewrite applies the route prefix rewriting to the request path
+func (rt *Route) Rewrite(r *http.Request) {
+	if rt.cfg.StripPrefix != "" && strings.HasPrefix(r.URL.Path, rt.cfg.StripPrefix) {
+		r.URL.Path = ensureSlash(strings.TrimPrefix(r.URL.Path, rt.cfg.StripPrefix))
+		if r.URL.RawPath != "" {
+			r.URL.RawPath = ensureSlash(strings.TrimPrefix(r.URL.RawPath, rt.cfg.StripPrefix))
+		}
+	}
+
+	if rt.cfg.AddPrefix != "" {
+		r.URL.Path = singleJoiningSlash(rt.cfg.AddPrefix, r.URL.Path)
+		if r.URL.RawPath != "" {
+			r.URL.RawPath = singleJoiningSlash(rt.cfg.AddPrefix, r.URL.RawPath)
+		}
+	}
+}
+
+func ensureSlash(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return "/" + p
+	}
+	return p
+}
+
+// matchHost compares a host pattern to a Host header, ignoring case
+// and port
+func matchHost(pattern string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	pattern = strings.ToLower(pattern)
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	}
+
+	return host == pattern
+}
+
+// Router selects the upstream for a request. It implements
+// http.RoundTripper, sending each request to the upstream chosen for
+// it with NewContext.
+type Router struct {
+	routes    []*Route
+	upstreams []*Upstream
+	response  ResponseCfg
+}
+
+// NewRouter instances a Router. Without routes every request goes to
+// the first upstream.
+func NewRouter(routes []RouteCfg, upstreams []*Upstream) (*Router, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams configured")
+	}
+
+	byName := make(map[string]*Upstream, len(upstreams))
+	for _, u := range upstreams {
+		byName[u.Name()] = u
+	}
+
+	router := &Router{
+		routes:    make([]*Route, 0, len(routes)),
+		upstreams: upstreams,
+	}
+
+	for i, cfg := range routes {
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("route-%d", i)
+		}
+
+		u, ok := byName[cfg.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("route %s: unknown upstream: %s", cfg.Name, cfg.Upstream)
+		}
+
+		rt := &Route{
+			cfg:      cfg,
+			methods:  make(map[string]bool, 0),
+			upstream: u,
+		}
+
+		for _, m := range cfg.Methods {
+			rt.methods[strings.ToUpper(m)] = true
+		}
+
+		if cfg.PathRegexp != "" {
+			rgx, err := regexp.Compile(cfg.PathRegexp)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %s", cfg.Name, err.Error())
+			}
+			rt.rgx = rgx
+		}
+
+		router.routes = append(router.routes, rt)
+	}
+
+	return router, nil
+}
+
+// Response returns the response copying configuration
+func (rr *Router) Response() ResponseCfg {
+	return rr.response
+}
+
+// Upstreams returns every configured upstream
+func (rr *Router) Upstreams() []*Upstream {
+	return rr.upstreams
+}
+
+// Match returns the first route matching the request, ErrNoRoute if
+// none does. Without routes it returns a catch-all route to the first
+// upstream.
+func (rr *Router) Match(r *http.Request) (*Route, error) {
+	if len(rr.routes) == 0 {
+		return &Route{cfg: RouteCfg{Name: "default"}, upstream: rr.upstreams[0]}, nil
+	}
+
+	for _, rt := range rr.routes {
+		if rt.match(r) {
+			return rt, nil
+		}
+	}
+
+	return nil, ErrNoRoute
+}
+
+type ctxKey struct{}
+
+// NewContext returns a context carrying the upstream for a request
+func NewContext(ctx context.Context, u *Upstream) context.Context {
+	return context.WithValue(ctx, ctxKey{}, u)
+}
+
+// FromContext returns the upstream for a request, nil if none
+func FromContext(ctx context.Context) *Upstream {
+	u, _ := ctx.Value(ctxKey{}).(*Upstream)
+	return u
+}
+
+// RoundTrip implements http.RoundTripper
+func (rr *Router) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := FromContext(req.Context())
+	if u == nil {
+		return nil, ErrNoRoute
+	}
+	return u.RoundTrip(req)
+}
@@ -0,0 +1,158 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func testUpstreams(t *testing.T, names ...string) []*Upstream {
+	t.Helper()
+
+	upstreams := make([]*Upstream, 0, len(names))
+	for _, name := range names {
+		u, err := NewUpstream(UpstreamCfg{
+			Name:    name,
+			Targets: []TargetCfg{{URL: "http://127.0.0.1:8080"}},
+		}, nil, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams
+}
+
+func TestRouterMatch(t *testing.T) {
+	routes := []RouteCfg{
+		{Name: "admin", Host: "admin.example.com", Upstream: "admin"},
+		{Name: "tenants", Host: "*.example.com", PathPrefix: "/api/", Upstream: "api"},
+		{Name: "reports", PathRegexp: `^/reports/\d+$`, Methods: []string{"get"}, Upstream: "reports"},
+		{Name: "canary", Headers: map[string]string{"X-Canary": "1"}, Upstream: "canary"},
+		{Name: "debug", Headers: map[string]string{"X-Debug": "*"}, Upstream: "canary"},
+	}
+
+	router, err := NewRouter(routes, testUpstreams(t, "admin", "api", "reports", "canary"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		host    string
+		path    string
+		headers map[string]string
+		want    string // route name, empty for ErrNoRoute
+	}{
+		{name: "exact host", host: "admin.example.com", path: "/", want: "admin"},
+		{name: "host ignores case and port", host: "Admin.Example.com:8443", path: "/", want: "admin"},
+		{name: "first matching route wins", host: "admin.example.com", path: "/api/users", want: "admin"},
+		{name: "wildcard host and prefix", host: "acme.example.com", path: "/api/users", want: "tenants"},
+		{name: "wildcard needs a subdomain", host: "example.com", path: "/api/users", want: ""},
+		{name: "prefix mismatch", host: "acme.example.com", path: "/apiv2", want: ""},
+		{name: "regexp and method", path: "/reports/42", want: "reports"},
+		{name: "method mismatch", method: http.MethodPost, path: "/reports/42", want: ""},
+		{name: "regexp mismatch", path: "/reports/latest", want: ""},
+		{name: "header value", path: "/", headers: map[string]string{"x-canary": "1"}, want: "canary"},
+		{name: "header value mismatch", path: "/", headers: map[string]string{"X-Canary": "0"}, want: ""},
+		{name: "header presence", path: "/", headers: map[string]string{"X-Debug": ""}, want: "debug"},
+		{name: "no route", host: "other.test", path: "/", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, tt.path, nil)
+			r.Host = tt.host
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			rt, err := router.Match(r)
+			if tt.want == "" {
+				if err != ErrNoRoute {
+					t.Errorf("got route %v, want ErrNoRoute", rt)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rt.Name() != tt.want {
+				t.Errorf("got route %s, want %s", rt.Name(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterDefaultRoute(t *testing.T) {
+	upstreams := testUpstreams(t, "first", "second")
+	router, err := NewRouter(nil, upstreams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt, err := router.Match(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.Upstream() != upstreams[0] {
+		t.Errorf("got upstream %s, want first", rt.Upstream().Name())
+	}
+}
+
+func TestNewRouterErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []RouteCfg
+		names  []string
+	}{
+		{name: "no upstreams"},
+		{name: "unknown upstream", routes: []RouteCfg{{Upstream: "missing"}}, names: []string{"api"}},
+		{name: "invalid regexp", routes: []RouteCfg{{PathRegexp: "(", Upstream: "api"}}, names: []string{"api"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRouter(tt.routes, testUpstreams(t, tt.names...)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestRouteRewrite(t *testing.T) {
+	tests := []struct {
+		name        string
+		stripPrefix string
+		addPrefix   string
+		path        string
+		want        string
+	}{
+		{name: "unchanged", path: "/api/users", want: "/api/users"},
+		{name: "strip", stripPrefix: "/api", path: "/api/users", want: "/users"},
+		{name: "strip to root", stripPrefix: "/api/", path: "/api/", want: "/"},
+		{name: "strip keeps a leading slash", stripPrefix: "/api/", path: "/api/users", want: "/users"},
+		{name: "strip other prefix", stripPrefix: "/web", path: "/api/users", want: "/api/users"},
+		{name: "add", addPrefix: "/v2", path: "/users", want: "/v2/users"},
+		{name: "add with slash", addPrefix: "/v2/", path: "/users", want: "/v2/users"},
+		{name: "strip and add", stripPrefix: "/api", addPrefix: "/internal", path: "/api/users", want: "/internal/users"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := &Route{cfg: RouteCfg{StripPrefix: tt.stripPrefix, AddPrefix: tt.addPrefix}}
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			rt.Rewrite(r)
+			if r.URL.Path != tt.want {
+				t.Errorf("got %s, want %s", r.URL.Path, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package upstream
+
+import (
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/txn2/n2proxy/health"
+)
+
+// TargetCfg is a backend server in an upstream
+type TargetCfg struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"` // weighted and hash strategies, default 1
+}
+
+// Target is a backend server and its load and health state
+type Target struct {
+	active       int64 // first for 64-bit atomic alignment on arm
+	ejectedUntil int64 // unix nanoseconds, passive outlier ejection
+	fails        int32 // consecutive failures
+	URL          *url.URL
+	Weight       int
+	checker      *health.Checker
+	current      int // smooth weighted round robin state, guarded by the balancer
+}
+
+// Active returns the number of in-flight requests
+func (t *Target) Active() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+
+// Ejected reports whether passive outlier detection removed the target
+func (t *Target) Ejected(now time.Time) bool {
+	return now.UnixNano() < atomic.LoadInt64(&t.ejectedUntil)
+}
+
+// Healthy reports the active health check state, true without checks
+func (t *Target) Healthy() bool {
+	return t.checker == nil || t.checker.Healthy()
+}
+
+// available reports whether the target can take requests
+func (t *Target) available(now time.Time) bool {
+	return t.Healthy() && !t.Ejected(now)
+}
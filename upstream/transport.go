@@ -0,0 +1,96 @@
+package upstream
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+)
+
+// TransportCfg tunes the connection pool to an upstream's targets
+type TransportCfg struct {
+	MaxIdleConns        int           `yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost int           `yaml:"maxIdleConnsPerHost"`
+	MaxConnsPerHost     int           `yaml:"maxConnsPerHost"` // 0 is unlimited
+	IdleConnTimeout     time.Duration `yaml:"idleConnTimeout"`
+	KeepAlive           time.Duration `yaml:"keepAlive"` // tcp keep-alive probe interval, -1 disables
+	DisableKeepAlives   bool          `yaml:"disableKeepAlives"`
+	DisableHTTP2        bool          `yaml:"disableHTTP2"` // HTTP/2 is negotiated with https targets by default
+	H2C                 bool          `yaml:"h2c"`          // HTTP/2 with prior knowledge to http targets
+}
+
+// ResponseCfg tunes how responses are copied to clients
+type ResponseCfg struct {
+	// FlushInterval flushes buffered response data to the client
+	// periodically, -1 flushes after every write. Event streams and
+	// responses without a length are always flushed immediately.
+	FlushInterval time.Duration `yaml:"flushInterval"`
+	// BufferPool reuses copy buffers across responses
+	BufferPool bool `yaml:"bufferPool"`
+}
+
+// newTransport builds the base transport to an upstream's targets
+func newTransport(cfg UpstreamCfg) *http.Transport {
+	tc := cfg.Transport
+
+	if tc.KeepAlive == 0 {
+		tc.KeepAlive = 30 * time.Second
+	}
+	if tc.MaxIdleConns == 0 {
+		tc.MaxIdleConns = 100
+	}
+	if tc.MaxIdleConnsPerHost == 0 {
+		tc.MaxIdleConnsPerHost = 32
+	}
+	if tc.IdleConnTimeout == 0 {
+		tc.IdleConnTimeout = 90 * time.Second
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{
+		Timeout:   cfg.Timeouts.Dial,
+		KeepAlive: tc.KeepAlive,
+	}).DialContext
+	t.TLSHandshakeTimeout = cfg.Timeouts.TLSHandshake
+	t.ResponseHeaderTimeout = cfg.Timeouts.ResponseHeader
+	t.MaxIdleConns = tc.MaxIdleConns
+	t.MaxIdleConnsPerHost = tc.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = tc.MaxConnsPerHost
+	t.IdleConnTimeout = tc.IdleConnTimeout
+	t.DisableKeepAlives = tc.DisableKeepAlives
+
+	switch {
+	case tc.H2C:
+		protocols := new(http.Protocols)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		t.Protocols = protocols
+	case tc.DisableHTTP2:
+		protocols := new(http.Protocols)
+		protocols.SetHTTP1(true)
+		t.Protocols = protocols
+	}
+
+	return t
+}
+
+// bufferPool is an httputil.BufferPool of 32KB copy buffers
+type bufferPool struct {
+	pool sync.Pool
+}
+
+// NewBufferPool instances a pool of response copy buffers
+func NewBufferPool() httputil.BufferPool {
+	return &bufferPool{pool: sync.Pool{
+		New: func() interface{} { return make([]byte, 32*1024) },
+	}}
+}
+
+func (b *bufferPool) Get() []byte {
+	return b.pool.Get().([]byte)
+}
+
+func (b *bufferPool) Put(buf []byte) {
+	b.pool.Put(buf)
+}
@@ -0,0 +1,178 @@
+package upstream
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestNewTransport(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          TransportCfg
+		maxIdle      int
+		maxIdleHost  int
+		maxConnsHost int
+		idleTimeout  time.Duration
+		keepAlives   bool
+		http1        bool
+		http2        bool
+		h2c          bool
+	}{
+		{
+			name:        "defaults",
+			maxIdle:     100,
+			maxIdleHost: 32,
+			idleTimeout: 90 * time.Second,
+			keepAlives:  true,
+			http1:       true,
+			http2:       true,
+		},
+		{
+			name: "pool settings",
+			cfg: TransportCfg{
+				MaxIdleConns:        10,
+				MaxIdleConnsPerHost: 5,
+				MaxConnsPerHost:     20,
+				IdleConnTimeout:     time.Second,
+				DisableKeepAlives:   true,
+			},
+			maxIdle:      10,
+			maxIdleHost:  5,
+			maxConnsHost: 20,
+			idleTimeout:  time.Second,
+			http1:        true,
+			http2:        true,
+		},
+		{
+			name:        "http2 disabled",
+			cfg:         TransportCfg{DisableHTTP2: true},
+			maxIdle:     100,
+			maxIdleHost: 32,
+			idleTimeout: 90 * time.Second,
+			keepAlives:  true,
+			http1:       true,
+		},
+		{
+			name:        "h2c",
+			cfg:         TransportCfg{H2C: true},
+			maxIdle:     100,
+			maxIdleHost: 32,
+			idleTimeout: 90 * time.Second,
+			keepAlives:  true,
+			http2:       true,
+			h2c:         true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTransport(UpstreamCfg{Transport: tt.cfg})
+
+			if tr.MaxIdleConns != tt.maxIdle || tr.MaxIdleConnsPerHost != tt.maxIdleHost || tr.MaxConnsPerHost != tt.maxConnsHost {
+				t.Errorf("pool %d/%d/%d, want %d/%d/%d", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.MaxConnsPerHost,
+					tt.maxIdle, tt.maxIdleHost, tt.maxConnsHost)
+			}
+			if tr.IdleConnTimeout != tt.idleTimeout {
+				t.Errorf("idle timeout %s, want %s", tr.IdleConnTimeout, tt.idleTimeout)
+			}
+			if tr.DisableKeepAlives == tt.keepAlives {
+				t.Errorf("keep-alives disabled %t", tr.DisableKeepAlives)
+			}
+
+			if tr.Protocols == nil {
+				// the default negotiates HTTP/1 and HTTP/2
+				if !tt.http1 || !tt.http2 || tt.h2c {
+					t.Error("protocols not set")
+				}
+				return
+			}
+			if tr.Protocols.HTTP1() != tt.http1 || tr.Protocols.HTTP2() != tt.http2 || tr.Protocols.UnencryptedHTTP2() != tt.h2c {
+				t.Errorf("protocols %s", tr.Protocols)
+			}
+		})
+	}
+}
+
+func TestRoundTripH2C(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		h2c  bool
+		want string
+	}{
+		{name: "http/1.1 by default", want: "HTTP/1.1"},
+		{name: "h2c with prior knowledge", h2c: true, want: "HTTP/2.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := NewUpstream(UpstreamCfg{
+				Name:      "test",
+				Targets:   []TargetCfg{{URL: srv.URL}},
+				Transport: TransportCfg{H2C: tt.h2c},
+			}, nil, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := u.RoundTrip(httptest.NewRequest(http.MethodGet, srv.URL+"/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Errorf("backend saw %s, want %s", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterResponseCfg(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "upstream.yml")
+	yml := `
+upstreams:
+  - name: app
+    targets:
+      - url: http://127.0.0.1:8080
+response:
+  flushInterval: 100ms
+  bufferPool: true
+`
+	if err := ioutil.WriteFile(filename, []byte(yml), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	router, err := NewRouterFromYaml(filename, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := router.Response(); got.FlushInterval != 100*time.Millisecond || !got.BufferPool {
+		t.Errorf("response %+v", got)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool()
+
+	buf := pool.Get()
+	if len(buf) != 32*1024 {
+		t.Fatalf("buffer of %d bytes, want 32KB", len(buf))
+	}
+	pool.Put(buf)
+}
@@ -0,0 +1,513 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/txn2/n2proxy/health"
+	"github.com/txn2/n2proxy/sec"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// ErrNoTarget is returned when every target of an upstream is
+// unhealthy or ejected
+var ErrNoTarget = errors.New("no available upstream target")
+
+// OutlierCfg ejects a target after ConsecutiveErrors transport errors
+// or 502, 503 and 504 responses in a row
+type OutlierCfg struct {
+	ConsecutiveErrors  int           `yaml:"consecutiveErrors"`
+	EjectionTime       time.Duration `yaml:"ejectionTime"`
+	MaxEjectionPercent int           `yaml:"maxEjectionPercent"`
+}
+
+// TimeoutCfg bounds the stages of an upstream request
+type TimeoutCfg struct {
+	Dial           time.Duration `yaml:"dial"`
+	TLSHandshake   time.Duration `yaml:"tlsHandshake"`
+	ResponseHeader time.Duration `yaml:"responseHeader"`
+	Request        time.Duration `yaml:"request"` // whole request including the body, default none
+}
+
+// RetryCfg retries idempotent requests without a body on transport
+// errors and 502, 503 and 504 responses, on another target when one
+// is available
+type RetryCfg struct {
+	Attempts   int           `yaml:"attempts"` // retries after the first try
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+// UpstreamCfg defines a named pool of backend targets
+type UpstreamCfg struct {
+	Name        string            `yaml:"name"`
+	Strategy    string            `yaml:"strategy"`   // roundRobin, weighted, leastConn or hash
+	HashHeader  string            `yaml:"hashHeader"` // hash strategy key, default the client IP
+	Targets     []TargetCfg       `yaml:"targets"`
+	HealthCheck *health.CheckCfg  `yaml:"healthCheck"`
+	Outlier     *OutlierCfg       `yaml:"outlier"`
+	Timeouts    TimeoutCfg        `yaml:"timeouts"`
+	Retry       *RetryCfg         `yaml:"retry"`
+	Breaker     *BreakerCfg       `yaml:"circuitBreaker"`
+	Transport   TransportCfg      `yaml:"transport"`
+	TLS         *sec.ClientTLSCfg `yaml:"tls"`
+	SkipVerify  bool              `yaml:"skipVerify"` // same as tls.skipVerify
+}
+
+// Cfg defines the upstreams and routing configuration
+type Cfg struct {
+	Upstreams []UpstreamCfg `yaml:"upstreams"`
+	Routes    []RouteCfg    `yaml:"routes"`
+	Response  ResponseCfg   `yaml:"response"`
+}
+
+// Upstream load balances requests over its targets. It implements
+// http.RoundTripper, rewriting each request to the picked target.
+type Upstream struct {
+	cfg       UpstreamCfg
+	targets   []*Target
+	balancer  balancer
+	breaker   *breaker
+	transport http.RoundTripper
+	logger    *zap.Logger
+}
+
+// NewUpstream instances an Upstream. wrap, when not nil, wraps the
+// transport to the targets (e.g. for tracing).
+func NewUpstream(cfg UpstreamCfg, wrap func(http.RoundTripper) http.RoundTripper, logger *zap.Logger) (*Upstream, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("upstreams require a name")
+	}
+
+	if len(cfg.Targets) == 0 {
+		return nil, fmt.Errorf("upstream %s: at least one target required", cfg.Name)
+	}
+
+	if cfg.Outlier != nil {
+		if cfg.Outlier.ConsecutiveErrors < 1 {
+			cfg.Outlier.ConsecutiveErrors = 5
+		}
+		if cfg.Outlier.EjectionTime <= 0 {
+			cfg.Outlier.EjectionTime = 30 * time.Second
+		}
+		if cfg.Outlier.MaxEjectionPercent <= 0 {
+			cfg.Outlier.MaxEjectionPercent = 50
+		}
+	}
+
+	if cfg.Retry != nil {
+		if cfg.Retry.Backoff <= 0 {
+			cfg.Retry.Backoff = 100 * time.Millisecond
+		}
+		if cfg.Retry.MaxBackoff <= 0 {
+			cfg.Retry.MaxBackoff = time.Second
+		}
+	}
+
+	if cfg.Timeouts.Dial <= 0 {
+		cfg.Timeouts.Dial = 5 * time.Second
+	}
+	if cfg.Timeouts.TLSHandshake <= 0 {
+		cfg.Timeouts.TLSHandshake = 10 * time.Second
+	}
+	if cfg.Timeouts.ResponseHeader <= 0 {
+		cfg.Timeouts.ResponseHeader = 60 * time.Second
+	}
+
+	logger = logger.With(zap.String("Upstream", cfg.Name))
+
+	base := newTransport(cfg)
+	if cfg.TLS != nil || cfg.SkipVerify {
+		tlsCfg := sec.ClientTLSCfg{}
+		if cfg.TLS != nil {
+			tlsCfg = *cfg.TLS
+		}
+		tlsCfg.SkipVerify = tlsCfg.SkipVerify || cfg.SkipVerify
+
+		clientTLS, err := sec.NewClientTLSConfig(tlsCfg, logger)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %s", cfg.Name, err.Error())
+		}
+		base.TLSClientConfig = clientTLS
+	}
+
+	u := &Upstream{
+		cfg:       cfg,
+		targets:   make([]*Target, 0, len(cfg.Targets)),
+		transport: base,
+		breaker:   newBreaker(cfg.Breaker, logger),
+		logger:    logger,
+	}
+
+	if wrap != nil {
+		u.transport = wrap(base)
+	}
+
+	for _, tCfg := range cfg.Targets {
+		targetURL, err := url.Parse(tCfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %s", cfg.Name, err.Error())
+		}
+		if targetURL.Scheme == "" || targetURL.Host == "" {
+			return nil, fmt.Errorf("upstream %s: target url requires scheme and host: %s", cfg.Name, tCfg.URL)
+		}
+
+		if tCfg.Weight < 1 {
+			tCfg.Weight = 1
+		}
+
+		t := &Target{URL: targetURL, Weight: tCfg.Weight}
+		if cfg.HealthCheck != nil {
+			t.checker = health.NewChecker(targetURL, *cfg.HealthCheck, base, logger)
+		}
+
+		u.targets = append(u.targets, t)
+	}
+
+	b, err := newBalancer(cfg, u.targets)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %s", cfg.Name, err.Error())
+	}
+	u.balancer = b
+
+	return u, nil
+}
+
+// Name returns the upstream name
+func (u *Upstream) Name() string {
+	return u.cfg.Name
+}
+
+// Targets returns the upstream targets
+func (u *Upstream) Targets() []*Target {
+	return u.targets
+}
+
+// Start runs the active health checks
+func (u *Upstream) Start() {
+	for _, t := range u.targets {
+		if t.checker != nil {
+			t.checker.Start()
+		}
+	}
+}
+
+// Stop ends the active health checks
+func (u *Upstream) Stop() {
+	for _, t := range u.targets {
+		if t.checker != nil {
+			t.checker.Stop()
+		}
+	}
+}
+
+// Check returns ErrNoTarget when no target can take requests. It is
+// suitable for health.Health.AddCheck.
+func (u *Upstream) Check() error {
+	if len(u.available(time.Now())) == 0 {
+		return ErrNoTarget
+	}
+	return nil
+}
+
+func (u *Upstream) available(now time.Time) []*Target {
+	available := make([]*Target, 0, len(u.targets))
+	for _, t := range u.targets {
+		if t.available(now) {
+			available = append(available, t)
+		}
+	}
+	return available
+}
+
+// Pick selects a target for the request
+func (u *Upstream) Pick(r *http.Request) (*Target, error) {
+	available := u.available(time.Now())
+	if len(available) == 0 {
+		return nil, ErrNoTarget
+	}
+	return u.balancer.pick(r, available), nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (u *Upstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !u.breaker.allow(time.Now()) {
+		return nil, ErrCircuitOpen
+	}
+
+	// the request timeout ends when the response body is closed,
+	// upgraded connections are not bounded
+	var cancel context.CancelFunc = func() {}
+	if u.cfg.Timeouts.Request > 0 && req.Header.Get("Upgrade") == "" {
+		ctx, c := context.WithTimeout(req.Context(), u.cfg.Timeouts.Request)
+		req, cancel = req.WithContext(ctx), c
+	}
+
+	attempts := 1
+	if u.cfg.Retry != nil && retryable(req) {
+		attempts += u.cfg.Retry.Attempts
+	}
+
+	var resp *http.Response
+	var err error
+
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if resp != nil {
+				resp.Body.Close()
+				resp = nil
+			}
+			if !sleep(req.Context(), backoff(u.cfg.Retry, i)) {
+				err = req.Context().Err()
+				break
+			}
+			u.logger.Debug("Retrying upstream request", zap.Int("Attempt", i))
+		}
+
+		resp, err = u.try(req)
+		if !failed(resp, err) || req.Context().Err() != nil {
+			break
+		}
+	}
+
+	// a canceled request says nothing about the upstream
+	if errors.Is(err, context.Canceled) {
+		u.breaker.release()
+	} else {
+		u.breaker.record(!failed(resp, err), time.Now())
+	}
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// the body of a 101 response is the upgraded connection
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &upgradedBody{ReadWriteCloser: rwc, done: cancel}
+	} else {
+		resp.Body = &trackedBody{ReadCloser: resp.Body, done: cancel}
+	}
+
+	return resp, nil
+}
+
+// try sends the request once to a picked target
+func (u *Upstream) try(req *http.Request) (*http.Response, error) {
+	t, err := u.Pick(req)
+	if err != nil {
+		return nil, err
+	}
+
+	out := new(http.Request)
+	*out = *req
+	out.URL = rewriteURL(req.URL, t.URL)
+	out.Host = t.URL.Host
+
+	atomic.AddInt64(&t.active, 1)
+
+	resp, err := u.transport.RoundTrip(out)
+	u.observe(t, resp, err)
+
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		atomic.AddInt64(&t.active, -1)
+		return resp, err
+	}
+
+	// the request is in flight until the response body is closed
+	resp.Body = &trackedBody{ReadCloser: resp.Body, done: func() { atomic.AddInt64(&t.active, -1) }}
+
+	return resp, nil
+}
+
+// failed reports whether a result counts as an upstream failure
+func failed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryable reports whether a request is idempotent and can be resent
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// backoff doubles the retry delay for each attempt up to MaxBackoff
+func backoff(cfg *RetryCfg, attempt int) time.Duration {
+	d := cfg.Backoff << uint(attempt-1)
+	if d <= 0 || d > cfg.MaxBackoff {
+		d = cfg.MaxBackoff
+	}
+	return d
+}
+
+// sleep waits for d, false if the context ends first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// observe applies passive outlier detection to a result
+func (u *Upstream) observe(t *Target, resp *http.Response, err error) {
+	if u.cfg.Outlier == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if !failed(resp, err) {
+		atomic.StoreInt32(&t.fails, 0)
+		return
+	}
+
+	if int(atomic.AddInt32(&t.fails, 1)) < u.cfg.Outlier.ConsecutiveErrors {
+		return
+	}
+
+	now := time.Now()
+	ejected := 0
+	for _, other := range u.targets {
+		if other.Ejected(now) {
+			ejected++
+		}
+	}
+
+	// keep a share of the targets in rotation
+	if (ejected+1)*100 > len(u.targets)*u.cfg.Outlier.MaxEjectionPercent {
+		return
+	}
+
+	atomic.StoreInt32(&t.fails, 0)
+	atomic.StoreInt64(&t.ejectedUntil, now.Add(u.cfg.Outlier.EjectionTime).UnixNano())
+
+	u.logger.Warn("Ejected upstream target",
+		zap.String("Target", t.URL.String()),
+		zap.Duration("EjectionTime", u.cfg.Outlier.EjectionTime),
+	)
+}
+
+// rewriteURL points a request URL at a target, joining paths and
+// queries as httputil.NewSingleHostReverseProxy does
+func rewriteURL(in *url.URL, target *url.URL) *url.URL {
+	out := *in
+	out.Scheme = target.Scheme
+	out.Host = target.Host
+
+	if target.Path != "" {
+		out.Path = singleJoiningSlash(target.Path, in.Path)
+		if in.RawPath != "" {
+			out.RawPath = singleJoiningSlash(target.EscapedPath(), in.EscapedPath())
+		}
+	}
+
+	if target.RawQuery == "" || in.RawQuery == "" {
+		out.RawQuery = target.RawQuery + in.RawQuery
+	} else {
+		out.RawQuery = target.RawQuery + "&" + in.RawQuery
+	}
+
+	return &out
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// trackedBody calls done once when the response body is closed
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// upgradedBody calls done once when the upgraded connection is closed
+type upgradedBody struct {
+	io.ReadWriteCloser
+	once sync.Once
+	done func()
+}
+
+func (b *upgradedBody) Close() error {
+	err := b.ReadWriteCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// NewRouterFromYaml loads upstreams and routes from yaml data
+func NewRouterFromYaml(filename string, wrap func(http.RoundTripper) http.RoundTripper, logger *zap.Logger) (*Router, error) {
+
+	ymlData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := Cfg{}
+
+	err = yaml.Unmarshal([]byte(ymlData), &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams := make([]*Upstream, 0, len(cfg.Upstreams))
+	names := make(map[string]bool, 0)
+
+	for _, uCfg := range cfg.Upstreams {
+		if names[uCfg.Name] {
+			return nil, fmt.Errorf("duplicate upstream name: %s", uCfg.Name)
+		}
+		names[uCfg.Name] = true
+
+		u, err := NewUpstream(uCfg, wrap, logger)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, u)
+	}
+
+	router, err := NewRouter(cfg.Routes, upstreams)
+	if err != nil {
+		return nil, err
+	}
+	router.response = cfg.Response
+
+	return router, nil
+}
@@ -0,0 +1,242 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRoundTripRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		failures int32
+		attempts int
+		want     int
+		tries    int32
+	}{
+		{name: "success", method: http.MethodGet, attempts: 2, want: http.StatusOK, tries: 1},
+		{name: "retried until success", method: http.MethodGet, failures: 2, attempts: 2, want: http.StatusOK, tries: 3},
+		{name: "attempts exhausted", method: http.MethodGet, failures: 5, attempts: 2, want: http.StatusServiceUnavailable, tries: 3},
+		{name: "not idempotent", method: http.MethodPost, failures: 1, attempts: 2, want: http.StatusServiceUnavailable, tries: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tries int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&tries, 1) <= tt.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer srv.Close()
+
+			u, err := NewUpstream(UpstreamCfg{
+				Name:    "test",
+				Targets: []TargetCfg{{URL: srv.URL}},
+				Retry:   &RetryCfg{Attempts: tt.attempts, Backoff: time.Millisecond},
+			}, nil, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := u.RoundTrip(httptest.NewRequest(tt.method, srv.URL+"/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.want {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if got := atomic.LoadInt32(&tries); got != tt.tries {
+				t.Errorf("%d tries, want %d", got, tt.tries)
+			}
+		})
+	}
+}
+
+func TestRoundTripRetryCancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	u, err := NewUpstream(UpstreamCfg{
+		Name:    "test",
+		Targets: []TargetCfg{{URL: srv.URL}},
+		Retry:   &RetryCfg{Attempts: 3, Backoff: time.Minute, MaxBackoff: time.Minute},
+	}, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, srv.URL+"/", nil).WithContext(ctx)
+
+	// cancel while waiting to retry
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	resp, err := u.RoundTrip(req)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error %v, want context.Canceled", err)
+	}
+	if resp != nil {
+		t.Errorf("got a response with status %d, want none", resp.StatusCode)
+	}
+}
+
+func TestRoundTripCircuitOpen(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	u, err := NewUpstream(UpstreamCfg{
+		Name:    "test",
+		Targets: []TargetCfg{{URL: srv.URL}},
+		Breaker: &BreakerCfg{MinRequests: 2},
+	}, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := u.RoundTrip(httptest.NewRequest(http.MethodGet, srv.URL+"/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if _, err := u.RoundTrip(httptest.NewRequest(http.MethodGet, srv.URL+"/", nil)); err != ErrCircuitOpen {
+		t.Errorf("error %v, want ErrCircuitOpen", err)
+	}
+}
+
+func TestRoundTripCanceledTrial(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hang" {
+			select {
+			case <-hang:
+			case <-r.Context().Done():
+			}
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	u, err := NewUpstream(UpstreamCfg{
+		Name:    "test",
+		Targets: []TargetCfg{{URL: srv.URL}},
+		Breaker: &BreakerCfg{MinRequests: 1, OpenTime: 10 * time.Millisecond},
+	}, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := u.RoundTrip(httptest.NewRequest(http.MethodGet, srv.URL+"/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	// the client goes away during the half open trial
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req := httptest.NewRequest(http.MethodGet, srv.URL+"/hang", nil).WithContext(ctx)
+	if _, err := u.RoundTrip(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("error %v, want context.Canceled", err)
+	}
+
+	if u.breaker.state != circuitHalfOpen || u.breaker.trial {
+		t.Errorf("state %d trial %t, want half open without a trial", u.breaker.state, u.breaker.trial)
+	}
+
+	// the next request is the trial, and its failure reopens the circuit
+	resp, err = u.RoundTrip(httptest.NewRequest(http.MethodGet, srv.URL+"/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if u.breaker.state != circuitOpen {
+		t.Errorf("state %d, want open", u.breaker.state)
+	}
+}
+
+func TestRoundTripUpgradeReleasesTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		brw.Flush()
+		// echo until the client closes
+		buf := make([]byte, 64)
+		for {
+			n, err := brw.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(buf[:n])
+		}
+	}))
+	defer srv.Close()
+
+	u, err := NewUpstream(UpstreamCfg{
+		Name:     "test",
+		Targets:  []TargetCfg{{URL: srv.URL}},
+		Timeouts: TimeoutCfg{Request: time.Minute},
+	}, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, srv.URL+"/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+
+	resp, err := u.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d, want 101", resp.StatusCode)
+	}
+
+	body, ok := resp.Body.(*upgradedBody)
+	if !ok {
+		t.Fatalf("body %T, want the upgraded connection", resp.Body)
+	}
+
+	if _, err := body.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := body.Read(buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q %v, want ping", buf, err)
+	}
+
+	released := make(chan struct{})
+	body.done = func() { close(released) }
+	body.Close()
+
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Error("closing the upgraded connection did not release the request")
+	}
+}